@@ -1,7 +1,9 @@
 package pgdriver
 
 import (
+	"database/sql"
 	"io"
+	"time"
 
 	"github.com/docker/distribution/context"
 )
@@ -12,5 +14,41 @@ type KVStorage interface {
 	Append(ctx context.Context, key string, data io.Reader) (int64, error)
 	Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
 	Delete(ctx context.Context, key string) error
+	// Size returns the authoritative size of an object
+	Size(ctx context.Context, key string) (int64, error)
 	URLFor(ctx context.Context, key string, resolveRedirect bool) (string, error)
+	// Close releases resources held by the storage
+	Close() error
+}
+
+// implementations of KVStorage
+var (
+	_ KVStorage = (*inmemory)(nil)
+	_ KVStorage = (*mdsBinStorage)(nil)
+	_ KVStorage = (*pgBlobStorage)(nil)
+	_ KVStorage = (*filesystem)(nil)
+	_ KVStorage = (*s3Storage)(nil)
+	_ KVStorage = (*routedStorage)(nil)
+	_ KVStorage = (*shardedStorage)(nil)
+)
+
+// deleteMarker is implemented by storages keeping their own metainformation
+// in PostgreSQL. Keys journaled by deleteID are marked deleted within
+// the transaction deleting files, so objects are never lost even if
+// their actual deletion fails.
+type deleteMarker interface {
+	markDeleted(tx *sql.Tx, deleteID string) error
+}
+
+// pathReader is implemented by storages keeping their own metainformation
+// in PostgreSQL, so a file and its object are resolved by a single query.
+// errNoKVObject is returned for files without an object.
+type pathReader interface {
+	getByPath(ctx context.Context, path string, offset int64) (io.ReadCloser, error)
+}
+
+// signedURLer is implemented by storages able to produce signed links,
+// which are valid until expiry
+type signedURLer interface {
+	SignedURLFor(ctx context.Context, key string, expiry time.Time) (string, error)
 }
@@ -0,0 +1,67 @@
+package pgdriver
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/docker/distribution/context"
+)
+
+var inFlightBytes = new(expvar.Int)
+
+// byteBudget limits the total amount of bytes being written
+// by all writers of a driver at the same time
+type byteBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	// released is closed and replaced on each release to wake up waiters
+	released chan struct{}
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	return &byteBudget{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes are available or ctx is done.
+// n must not exceed the limit.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			inFlightBytes.Add(n)
+			return nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+	inFlightBytes.Add(-n)
+}
+
+// chunk returns the length of the next portion of p,
+// which can be written within the budget
+func (b *byteBudget) chunk(p []byte) int64 {
+	if int64(len(p)) > b.limit {
+		return b.limit
+	}
+	return int64(len(p))
+}
@@ -0,0 +1,127 @@
+package pgdriver
+
+import (
+	stdcontext "context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	. "gopkg.in/check.v1"
+)
+
+type BudgetSuite struct{}
+
+var _ = Suite(&BudgetSuite{})
+
+func (s *BudgetSuite) TestAcquireBlocksWhenExhausted(c *C) {
+	ctx := context.Background()
+	b := newByteBudget(100)
+	c.Assert(b.acquire(ctx, 60), IsNil)
+	c.Assert(inFlightBytes.Value(), Equals, int64(60))
+
+	acquired := make(chan struct{})
+	go func() {
+		c.Check(b.acquire(ctx, 50), IsNil)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		c.Fatal("acquire must block while the budget is exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b.release(60)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		c.Fatal("acquire must proceed after release")
+	}
+
+	c.Assert(inFlightBytes.Value(), Equals, int64(50))
+	b.release(50)
+	c.Assert(inFlightBytes.Value(), Equals, int64(0))
+}
+
+func (s *BudgetSuite) TestAcquireCancelled(c *C) {
+	b := newByteBudget(10)
+	c.Assert(b.acquire(context.Background(), 10), IsNil)
+	defer b.release(10)
+
+	ctx, cancel := stdcontext.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(b.acquire(ctx, 1), Equals, stdcontext.DeadlineExceeded)
+	c.Assert(inFlightBytes.Value(), Equals, int64(10))
+}
+
+func (s *BudgetSuite) TestChunk(c *C) {
+	b := newByteBudget(10)
+	c.Assert(b.chunk(make([]byte, 5)), Equals, int64(5))
+	c.Assert(b.chunk(make([]byte, 50)), Equals, int64(10))
+}
+
+// stalledStorage does not read stored data until stalled is closed
+type stalledStorage struct {
+	KVStorage
+	stalled chan struct{}
+}
+
+func (s stalledStorage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	<-s.stalled
+	return io.Copy(ioutil.Discard, data)
+}
+
+func (stalledStorage) Delete(ctx context.Context, key string) error { return nil }
+
+func (s *BudgetSuite) TestWriterBlocksWhenExhausted(c *C) {
+	storage := stalledStorage{stalled: make(chan struct{})}
+	d := &driver{storage: storage, budget: newByteBudget(10)}
+	write := func(ctx context.Context, data string) (storagedriver.FileWriter, chan error) {
+		fw, err := newFileWriter(ctx, d, "/budget", false)
+		c.Assert(err, IsNil)
+		written := make(chan error, 1)
+		go func() {
+			_, err := fw.Write([]byte(data))
+			written <- err
+		}()
+		return fw, written
+	}
+
+	// the stalled upload holds the whole budget
+	stalled, stalledWritten := write(context.Background(), "0123456789")
+	defer stalled.Cancel()
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(inFlightBytes.Value(), Equals, int64(10))
+
+	// a writer waiting for the budget can be cancelled
+	ctx, cancel := stdcontext.WithCancel(context.Background())
+	cancelled, cancelledWritten := write(ctx, "data")
+	defer cancelled.Cancel()
+	cancel()
+	select {
+	case err := <-cancelledWritten:
+		c.Assert(err, Equals, stdcontext.Canceled)
+	case <-time.After(time.Second):
+		c.Fatal("Write must return once its context is cancelled")
+	}
+
+	blocked, blockedWritten := write(context.Background(), "data")
+	defer blocked.Cancel()
+	select {
+	case <-blockedWritten:
+		c.Fatal("Write must block while the budget is exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(storage.stalled)
+	for _, written := range []chan error{stalledWritten, blockedWritten} {
+		select {
+		case err := <-written:
+			c.Assert(err, IsNil)
+		case <-time.After(time.Second):
+			c.Fatal("Write must proceed once the budget is released")
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package pgdriver
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"expvar"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+	. "gopkg.in/check.v1"
+)
+
+// fakePG answers queries of pgcluster. Its data source name
+// is the role of a node: master, replica, lagging or down,
+// optionally followed by the replayed position of WAL: master@100.
+// It's PostgreSQL 9.6 unless the role is prefixed by pg10/, which has
+// WAL functions renamed, or by noversion/, which fails to report a version.
+// A flapping node is in recovery every second time it's asked.
+// A demoting node is the master until promoted is set, a promoting one after.
+// A hung node does not answer until a query is canceled.
+// Writes are counted by roles of nodes, nodes in recovery reject them.
+type fakePG struct{}
+
+var (
+	flaps    int64
+	promoted int32
+
+	writesMu sync.Mutex
+	writes   = make(map[string]int)
+)
+
+func init() {
+	sql.Register("fakepg", fakePG{})
+}
+
+func (fakePG) Open(name string) (sqldriver.Conn, error) {
+	if name == "down" {
+		return nil, errors.New("connection refused")
+	}
+	return fakePGConn(name), nil
+}
+
+type fakePGConn string
+
+func (c fakePGConn) Prepare(query string) (sqldriver.Stmt, error) {
+	stmt := fakePGStmt{role: string(c), query: query, version: 90600}
+	switch {
+	case strings.HasPrefix(stmt.role, "pg10/"):
+		stmt.role, stmt.version = stmt.role[len("pg10/"):], 100000
+	case strings.HasPrefix(stmt.role, "noversion/"):
+		stmt.role, stmt.version = stmt.role[len("noversion/"):], 0
+	}
+	if i := strings.IndexByte(stmt.role, '@'); i >= 0 {
+		stmt.role, stmt.lsn = stmt.role[:i], stmt.role[i+1:]
+	}
+	return stmt, nil
+}
+
+func (fakePGConn) Close() error { return nil }
+
+func (fakePGConn) Begin() (sqldriver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakePGStmt struct {
+	role    string
+	lsn     string
+	query   string
+	version int64
+}
+
+func (fakePGStmt) Close() error { return nil }
+
+func (fakePGStmt) NumInput() int { return -1 }
+
+func (s fakePGStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	if s.inRecovery() {
+		return nil, &pq.Error{Code: "25006", Message: "cannot execute " + s.query + " in a read-only transaction"}
+	}
+	writesMu.Lock()
+	writes[s.role]++
+	writesMu.Unlock()
+	return sqldriver.RowsAffected(1), nil
+}
+
+func (s fakePGStmt) inRecovery() bool {
+	switch s.role {
+	case "demoting":
+		return atomic.LoadInt32(&promoted) != 0
+	case "promoting":
+		return atomic.LoadInt32(&promoted) == 0
+	default:
+		return s.role != "master"
+	}
+}
+
+func (s fakePGStmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	if s.role == "hung" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return s.Query(nil)
+}
+
+func (s fakePGStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "server_version_num"):
+		if s.version == 0 {
+			return nil, errors.New("unrecognized configuration parameter")
+		}
+		return &fakePGRows{values: []sqldriver.Value{s.version}}, nil
+	case strings.Contains(s.query, "xlog") && s.version >= 100000,
+		strings.Contains(s.query, "_wal_") && s.version < 100000:
+		return nil, errors.New("function does not exist")
+	case strings.Contains(s.query, "pg_xlog_location_diff"), strings.Contains(s.query, "pg_wal_lsn_diff"):
+		lsn, _ := strconv.ParseInt(s.lsn, 10, 64)
+		return &fakePGRows{values: []sqldriver.Value{s.inRecovery(), lsn}}, nil
+	case strings.Contains(s.query, "pg_is_in_recovery") && s.role == "flapping":
+		return &fakePGRows{values: []sqldriver.Value{atomic.AddInt64(&flaps, 1)%2 == 0}}, nil
+	case strings.Contains(s.query, "pg_is_in_recovery"):
+		return &fakePGRows{values: []sqldriver.Value{s.inRecovery()}}, nil
+	case strings.Contains(s.query, "pg_last_xact_replay_timestamp"):
+		lag := 0.0
+		if s.role == "lagging" {
+			lag = time.Hour.Seconds()
+		}
+		return &fakePGRows{values: []sqldriver.Value{lag}}, nil
+	default:
+		return nil, errors.New("unexpected query: " + s.query)
+	}
+}
+
+type fakePGRows struct {
+	values []sqldriver.Value
+	done   bool
+}
+
+func (r *fakePGRows) Columns() []string { return make([]string, len(r.values)) }
+
+func (*fakePGRows) Close() error { return nil }
+
+func (r *fakePGRows) Next(dest []sqldriver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+type ClusterSuite struct{}
+
+var _ = Suite(&ClusterSuite{})
+
+func (s *ClusterSuite) TestHealth(c *C) {
+	for _, t := range []struct {
+		nodes  []string
+		health pgcluster.HealthStatus
+	}{
+		{[]string{"master"}, pgcluster.HEALTHY},
+		{[]string{"master", "replica", "down"}, pgcluster.HEALTHY},
+		{[]string{"replica", "master", "lagging"}, pgcluster.HEALTHY},
+		{[]string{"master", "down"}, pgcluster.DEGRADED},
+		{[]string{"down", "master", "lagging"}, pgcluster.DEGRADED},
+		{[]string{"replica", "down"}, pgcluster.UNHEALTHY},
+		{[]string{"down"}, pgcluster.UNHEALTHY},
+		// WAL functions are renamed in PostgreSQL 10
+		{[]string{"pg10/master", "pg10/lagging", "pg10/replica"}, pgcluster.HEALTHY},
+		{[]string{"pg10/master", "pg10/lagging"}, pgcluster.DEGRADED},
+	} {
+		cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", t.nodes)
+		c.Assert(err, IsNil)
+		cluster.SetMaxReplicationLag(time.Minute)
+
+		health := cluster.Health()
+		c.Assert(health, Equals, t.health, Commentf("%v", t.nodes))
+		c.Assert(expvar.Get("pgcluster_stats").(*expvar.Map).Get("health").String(), Equals, `"`+t.health.String()+`"`)
+		c.Assert(cluster.Close(), IsNil)
+	}
+}
+
+func (s *ClusterSuite) TestReplicaByServerVersion(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"pg10/master", "pg10/lagging", "pg10/replica"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	cluster.SetMaxReplicationLag(time.Minute)
+	cluster.ReElect()
+
+	replica, ok := cluster.Replica()
+	c.Assert(ok, Equals, true)
+	c.Assert(replica, Not(Equals), cluster.DB(pgcluster.MASTER))
+	// the lagging replica is skipped
+	var lag float64
+	c.Assert(replica.QueryRow("SELECT extract(epoch FROM now() - pg_last_xact_replay_timestamp())").Scan(&lag), IsNil)
+	c.Assert(lag, Equals, 0.0)
+}
+
+func (s *ClusterSuite) TestHealthIgnoresLagByDefault(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master", "lagging"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+
+	c.Assert(cluster.Health(), Equals, pgcluster.HEALTHY)
+}
+
+func (s *ClusterSuite) TestReady(c *C) {
+	for _, t := range []struct {
+		nodes []string
+		ready bool
+	}{
+		{[]string{"master"}, true},
+		{[]string{"down", "replica", "master"}, true},
+		{[]string{"replica"}, false},
+		{[]string{"down"}, false},
+	} {
+		cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", t.nodes)
+		c.Assert(err, IsNil)
+
+		err = cluster.Ready(context.Background())
+		if t.ready {
+			c.Assert(err, IsNil, Commentf("%v", t.nodes))
+		} else {
+			c.Assert(err, FitsTypeOf, pgcluster.NoMasterError{}, Commentf("%v", t.nodes))
+		}
+		c.Assert(cluster.Close(), IsNil)
+	}
+
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(cluster.Ready(ctx), FitsTypeOf, pgcluster.NoMasterError{})
+}
+
+func (s *ClusterSuite) TestNodes(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master", "replica", "down"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	c.Assert(cluster.Nodes(), DeepEquals, []pgcluster.NodeRole{pgcluster.NodeMaster, pgcluster.NodeReplica, pgcluster.NodeDown})
+	c.Assert(pgcluster.NodeDown.String(), Equals, "down")
+
+	flapping, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"flapping"})
+	c.Assert(err, IsNil)
+	defer flapping.Close()
+
+	first := flapping.Nodes()[0]
+	second := flapping.Nodes()[0]
+	c.Assert(first, Not(Equals), second)
+	c.Assert([]pgcluster.NodeRole{first, second}, DeepEquals, []pgcluster.NodeRole{first, 1 - first})
+	c.Assert(first == pgcluster.NodeMaster || first == pgcluster.NodeReplica, Equals, true)
+}
+
+func (s *ClusterSuite) TestElectMostRecentMaster(c *C) {
+	for _, t := range []struct {
+		nodes  []string
+		master int64
+	}{
+		{[]string{"down", "master@100", "master@200"}, 2},
+		{[]string{"replica@300", "master@200", "master@100"}, 1},
+		{[]string{"down", "master@100", "master@0100"}, 1},
+		{[]string{"down", "replica@100", "master"}, 2},
+		{[]string{"master@100", "master@200"}, 0},
+	} {
+		cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", t.nodes)
+		c.Assert(err, IsNil)
+
+		c.Assert(expvar.Get("pgcluster_stats").(*expvar.Map).Get("master").String(), Equals, strconv.FormatInt(t.master, 10), Commentf("%v", t.nodes))
+		c.Assert(cluster.Close(), IsNil)
+	}
+}
+
+func (s *ClusterSuite) TestSplitBrain(c *C) {
+	stats := expvar.Get("pgcluster_stats").(*expvar.Map)
+	splitBrain := func() int64 { return stats.Get("split_brain").(*expvar.Int).Value() }
+
+	before := splitBrain()
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master@100", "replica", "master@200"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	c.Assert(splitBrain(), Equals, before+1)
+
+	master := cluster.DB(pgcluster.MASTER)
+	cluster.ReElect()
+	c.Assert(cluster.DB(pgcluster.MASTER), Equals, master)
+	c.Assert(stats.Get("master").String(), Equals, "0")
+	c.Assert(splitBrain(), Equals, before+2)
+
+	c.Assert(cluster.Nodes(), DeepEquals, []pgcluster.NodeRole{pgcluster.NodeMaster, pgcluster.NodeReplica, pgcluster.NodeSplitMaster})
+}
+
+func (s *ClusterSuite) TestElectionStats(c *C) {
+	stats := expvar.Get("pgcluster_stats").(*expvar.Map)
+	stat := func(name string) int64 { return stats.Get(name).(*expvar.Int).Value() }
+
+	runs, changes, failed := stat("election_runs"), stat("master_changes"), stat("failed_elections")
+
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"demoting", "promoting", "down"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	defer atomic.StoreInt32(&promoted, 0)
+
+	c.Assert(stat("election_runs"), Equals, runs+1)
+	c.Assert(stat("master_changes"), Equals, changes)
+	c.Assert(stat("reachable_nodes"), Equals, int64(2))
+
+	// the elected master is still the master
+	cluster.ReElect()
+	c.Assert(stat("election_runs"), Equals, runs+2)
+	c.Assert(stat("master_changes"), Equals, changes)
+
+	atomic.StoreInt32(&promoted, 1)
+	cluster.ReElect()
+	c.Assert(stat("master_changes"), Equals, changes+1)
+	c.Assert(stats.Get("master").String(), Equals, "1")
+
+	cluster.ReElect()
+	c.Assert(stat("master_changes"), Equals, changes+1)
+	c.Assert(stat("failed_elections"), Equals, failed)
+
+	noMaster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"replica", "down"})
+	c.Assert(err, IsNil)
+	defer noMaster.Close()
+	c.Assert(stat("failed_elections"), Equals, failed+1)
+	c.Assert(stat("master_changes"), Equals, changes+1)
+	c.Assert(stat("reachable_nodes"), Equals, int64(1))
+}
+
+func (s *ClusterSuite) TestWritesSurviveFailover(c *C) {
+	stats := expvar.Get("pgcluster_stats").(*expvar.Map)
+	changes := stats.Get("master_changes").(*expvar.Int).Value()
+	written := func(role string) int {
+		writesMu.Lock()
+		defer writesMu.Unlock()
+		return writes[role]
+	}
+	before := map[string]int{"demoting": written("demoting"), "promoting": written("promoting")}
+
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"demoting", "promoting"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	defer atomic.StoreInt32(&promoted, 0)
+
+	d := &driver{cluster: cluster, retries: newRetryPolicy(3, time.Millisecond, nil)}
+	write := func() error {
+		return d.retry(context.Background(), func() error {
+			_, err := cluster.DB(pgcluster.MASTER).Exec("INSERT INTO mfs")
+			return err
+		})
+	}
+
+	c.Assert(write(), IsNil)
+	c.Assert(written("demoting"), Equals, before["demoting"]+1)
+
+	// the master is demoted under the driver: the rejected write
+	// is retried against the promoted node after re-election
+	atomic.StoreInt32(&promoted, 1)
+	c.Assert(write(), IsNil)
+	c.Assert(written("demoting"), Equals, before["demoting"]+1)
+	c.Assert(written("promoting"), Equals, before["promoting"]+1)
+	c.Assert(stats.Get("master_changes").(*expvar.Int).Value(), Equals, changes+1)
+	c.Assert(stats.Get("master").String(), Equals, "1")
+}
+
+func (s *ClusterSuite) TestElectByServerVersion(c *C) {
+	stats := expvar.Get("pgcluster_stats").(*expvar.Map)
+	stat := func(name string) int64 { return stats.Get(name).(*expvar.Int).Value() }
+
+	failed := stat("failed_elections")
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"pg10/replica@300", "down", "pg10/master@100"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	c.Assert(stat("failed_elections"), Equals, failed)
+	c.Assert(stat("reachable_nodes"), Equals, int64(2))
+	c.Assert(stats.Get("master").String(), Equals, "2")
+	c.Assert(cluster.Ready(context.Background()), IsNil)
+
+	// nodes of unknown versions can not be elected
+	noVersion, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"pg10/replica", "noversion/master"})
+	c.Assert(err, IsNil)
+	defer noVersion.Close()
+	c.Assert(stat("failed_elections"), Equals, failed+1)
+	c.Assert(stat("reachable_nodes"), Equals, int64(1))
+	c.Assert(noVersion.Ready(context.Background()), FitsTypeOf, pgcluster.NoMasterError{})
+}
+
+func (s *ClusterSuite) TestHungNode(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+	master := cluster.DB(pgcluster.MASTER)
+
+	added := make(chan error, 1)
+	go func() { added <- cluster.AddNode("hung") }()
+	time.Sleep(100 * time.Millisecond)
+
+	// the election asking the hung node holds no lock
+	configured := make(chan struct{})
+	go func() {
+		cluster.SetMaxOpenConns(10)
+		close(configured)
+	}()
+	select {
+	case <-configured:
+	case <-time.After(time.Second):
+		c.Fatal("configuration is blocked by the election")
+	}
+
+	// queries of the hung node time out
+	select {
+	case err = <-added:
+		c.Assert(err, IsNil)
+	case <-time.After(10 * time.Second):
+		c.Fatal("the election is not bounded by a timeout")
+	}
+	c.Assert(cluster.DB(pgcluster.MASTER), Equals, master)
+}
+
+func (s *ClusterSuite) TestCloseTwice(c *C) {
+	before := runtime.NumGoroutine()
+
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master", "replica"})
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Close(), IsNil)
+	c.Assert(cluster.Close(), IsNil)
+
+	// goroutines of sql.DB exit asynchronously after Close
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(runtime.NumGoroutine() <= before, Equals, true, Commentf("%d goroutines leaked", runtime.NumGoroutine()-before))
+}
+
+func (s *ClusterSuite) TestAddNode(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"replica"})
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Ready(context.Background()), NotNil)
+
+	c.Assert(cluster.AddNode("master"), IsNil)
+	c.Assert(cluster.Ready(context.Background()), IsNil)
+	c.Assert(cluster.Nodes(), DeepEquals, []pgcluster.NodeRole{pgcluster.NodeReplica, pgcluster.NodeMaster})
+	c.Assert(expvar.Get("pgcluster_stats").(*expvar.Map).Get("master").String(), Equals, "1")
+
+	c.Assert(cluster.AddNode("master"), Equals, pgcluster.ErrDublicatedDataSource)
+
+	c.Assert(cluster.Close(), IsNil)
+	c.Assert(cluster.AddNode("lagging"), Equals, pgcluster.ErrClusterClosed)
+}
+
+func (s *ClusterSuite) TestRemoveNode(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master", "replica"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+
+	c.Assert(cluster.AddNode("master@5"), IsNil)
+	master := cluster.DB(pgcluster.MASTER)
+
+	c.Assert(cluster.RemoveNode("master"), IsNil)
+	c.Assert(cluster.DB(pgcluster.MASTER), Not(Equals), master)
+	c.Assert(cluster.Ready(context.Background()), IsNil)
+	c.Assert(cluster.Nodes(), DeepEquals, []pgcluster.NodeRole{pgcluster.NodeReplica, pgcluster.NodeMaster})
+	c.Assert(expvar.Get("pgcluster_stats").(*expvar.Map).Get("master").String(), Equals, "1")
+
+	c.Assert(cluster.RemoveNode("master"), Equals, pgcluster.ErrUnknownDataSource)
+	c.Assert(cluster.RemoveNode("replica"), IsNil)
+	c.Assert(expvar.Get("pgcluster_stats").(*expvar.Map).Get("master").String(), Equals, "0")
+	c.Assert(cluster.RemoveNode("master@5"), Equals, pgcluster.ErrZeroDataSource)
+	c.Assert(cluster.Ready(context.Background()), IsNil)
+}
@@ -0,0 +1,83 @@
+package pgdriver
+
+import (
+	"database/sql"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// consistencySamples limits the number of keys reported per inconsistency
+const consistencySamples = 10
+
+const (
+	// files referring to missing or deleted mds rows
+	selectDanglingFiles = `SELECT {mfs}.key, count(*) OVER () FROM {mfs} LEFT JOIN {mds} ON {mfs}.key = {mds}.key
+		WHERE {mfs}.key IS NOT NULL AND ({mds}.key IS NULL OR {mds}.deleted) LIMIT $1`
+	// live mds rows without any file referring to them
+	selectOrphanedMDS = `SELECT {mds}.key, count(*) OVER () FROM {mds} LEFT JOIN {mfs} ON {mds}.key = {mfs}.key
+		WHERE NOT {mds}.deleted AND {mfs}.key IS NULL LIMIT $1`
+)
+
+// ConsistencyReport describes dangling references between mfs and mds tables
+type ConsistencyReport struct {
+	// DanglingFiles is the number of files referring to missing or deleted mds rows
+	DanglingFiles int64
+	// DanglingFileKeys contains some keys of such files
+	DanglingFileKeys []string
+	// OrphanedMDS is the number of live mds rows no file refers to
+	OrphanedMDS int64
+	// OrphanedMDSKeys contains some keys of such rows
+	OrphanedMDSKeys []string
+}
+
+// CheckConsistency compares keys of files with rows of mds table.
+// It makes sense for MDS backend only.
+func (d *Driver) CheckConsistency(ctx context.Context) (ConsistencyReport, error) {
+	return d.drv.CheckConsistency(ctx)
+}
+
+func (d *driver) CheckConsistency(ctx context.Context) (ConsistencyReport, error) {
+	var (
+		report ConsistencyReport
+		err    error
+	)
+
+	db := d.cluster.DB(pgcluster.MASTER)
+	report.DanglingFiles, report.DanglingFileKeys, err = d.sampleKeys(db, selectDanglingFiles)
+	if err != nil {
+		return report, err
+	}
+
+	report.OrphanedMDS, report.OrphanedMDSKeys, err = d.sampleKeys(db, selectOrphanedMDS)
+	if err != nil {
+		return report, err
+	}
+
+	context.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"dangling_files": report.DanglingFiles, "orphaned_mds": report.OrphanedMDS}).Info("consistency check")
+	return report, nil
+}
+
+// sampleKeys runs query returning keys with total count of them
+func (d *driver) sampleKeys(db *sql.DB, query string) (int64, []string, error) {
+	rows, err := db.Query(d.q(query), consistencySamples)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		total int64
+		keys  []string
+	)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key, &total); err != nil {
+			return 0, nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return total, keys, rows.Err()
+}
@@ -2,11 +2,19 @@ package pgdriver
 
 import (
 	"bytes"
+	stdcontext "context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"expvar"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -29,9 +37,13 @@ const (
 	driverSQLName = "postgres"
 	driverName    = "postgres"
 
+	defaultConnectTimeout = 5 * time.Second
+
 	tableMeta = "mfs"
+	tableMDS  = "mds"
 
 	contentSize = "pgdriver_content_size"
+	contentPath = "pgdriver_content_path"
 
 	disableRedirectHeader  = "X-Disable-Redirect"
 	resolveStorageRedirect = "X-Resolve-Redirect"
@@ -39,9 +51,56 @@ const (
 
 const (
 	// checks if the file or dir exists and returns its type
-	checksFileExistsAndGetType = "SELECT dir FROM mfs WHERE path=$1"
+	checksFileExistsAndGetType = "SELECT dir FROM {mfs} WHERE path=$1"
 	// inserts metainformation about file or dir
-	insertMetaAboutFileOrDir = "INSERT INTO mfs (path, parent, dir, size, modtime, key, owner) VALUES ($1, $2, $3, $4, now(), $5, $6)"
+	insertMetaAboutFileOrDir = "INSERT INTO {mfs} (path, parent, dir, size, modtime, key, owner) VALUES ($1, $2, $3, $4, now(), $5, $6)"
+	// inserts missing directories given by arrays of paths and their parents.
+	// Directories created concurrently are skipped.
+	insertParentDirs = `INSERT INTO {mfs} (path, parent, dir, size, modtime, key, owner)
+		SELECT ($1::text[])[i], ($2::text[])[i], true, 0, now(), NULL, $3 FROM generate_series(1, $4) i
+		ON CONFLICT (path) DO NOTHING`
+	// inserts metainformation about file. Key is NULL if a file has no KV object
+	insertFile = "INSERT INTO {mfs} (path, parent, dir, size, modtime, key, owner, inline, digest, expires_at) VALUES ($1, $2, false, $3, now(), $4, $5, $6, $7, $8)"
+	// records a key failed to be deleted from KV storage
+	insertDeleteJournal = "INSERT INTO {mfs_delete_journal} (key) VALUES ($1)"
+	// records a key of a deleted file to be deleted from KV storage after commit
+	insertPendingDelete = "INSERT INTO {mfs_delete_journal} (key, delete_id) VALUES ($1, $2)"
+	// keeps keys still referred to by files in KV storage
+	unjournalReferenced = `DELETE FROM {mfs_delete_journal} WHERE delete_id = $1
+		AND EXISTS (SELECT 1 FROM {mfs} WHERE {mfs}.key = {mfs_delete_journal}.key)`
+	// finds a KV object with the same content.
+	// Files being appended to have no digest, so they are skipped.
+	selectDuplicate = "SELECT key FROM {mfs} WHERE digest = $1 AND size = $2 AND key IS NOT NULL AND key <> $3 LIMIT 1 FOR SHARE"
+)
+
+// Modes to store zero-length files
+const (
+	// zeroLengthStore stores an empty object in KV storage
+	zeroLengthStore = "store"
+	// zeroLengthInline stores empty content in mfs
+	zeroLengthInline = "inline"
+	// zeroLengthFlag stores no content at all.
+	// A file without both key and inline content is empty.
+	zeroLengthFlag = "flag"
+)
+
+// errNoKVObject means that a file has no object in KVStorage
+var errNoKVObject = errors.New("file has no KV object")
+
+// errEllipticsUnavailable is returned for the elliptics backend,
+// as no build of the driver includes its bindings yet
+var errEllipticsUnavailable = errors.New("elliptics binary storage backend is not available in this build")
+
+// Policies to handle KV storage failures during Delete
+const (
+	// deletePolicyBestEffort commits metainformation first and logs KV failures
+	deletePolicyBestEffort = "best-effort"
+	// deletePolicyStrict deletes keys from KV storage before commit,
+	// so Delete is rolled back if any of them fails
+	deletePolicyStrict = "strict"
+	// deletePolicyJournal is like best-effort, but records failed keys
+	// to mfs_delete_journal
+	deletePolicyJournal = "journal"
 )
 
 func init() {
@@ -50,18 +109,82 @@ func init() {
 	// it would be visible in /debug/vars
 	// even if postgres driver is not used.
 	// I don't want to do any `test and set` magic
-	metrics := expvar.NewMap("postgres_driver")
+	metrics := expvar.NewMap(metricsName)
 	metrics.Set("bytes_written", bytesWrittenToStorage)
+	metrics.Set("in_flight_bytes", inFlightBytes)
+	metrics.Set("in_flight_writers", inFlightWriters)
+	metrics.Set("oldest_writer_age_seconds", expvar.Func(func() interface{} { return liveWriters.oldest().Seconds() }))
+	metrics.Set("blob_sizes", blobSizes)
+	// latencies of storage operations, errors included
+	metrics.Set("get_content_latency", getContentTimer)
+	metrics.Set("put_content_latency", putContentTimer)
+	metrics.Set("writer_latency", writerTimer)
+	metrics.Set("reader_latency", readerTimer)
+	metrics.Set("stat_latency", statTimer)
+	metrics.Set("list_latency", listTimer)
+	metrics.Set("move_latency", moveTimer)
+	metrics.Set("delete_latency", deleteTimer)
+	// describes KV storage of the latest created driver
+	metrics.Set("backend", expvar.Func(func() interface{} { return backendInfo.Load() }))
 
 	// TODO: move to MDS init
 	// an MDS metric
 	metrics.Set("bytes_proxied_in_mds_append", bytesProxiedInAppend)
+	metrics.Set("mds_append_proxy_latency", appendProxyDuration)
+	metrics.Set("mds_upload_errors", mdsUploadErrors)
+	metrics.Set("mds_get_errors", mdsGetErrors)
+	metrics.Set("mds_delete_errors", mdsDeleteErrors)
+	metrics.Set("mds_append_proxy_errors", mdsAppendProxyErrors)
 }
 
 var (
 	bytesWrittenToStorage = expvarmetrics.NewMeterVar()
+	// writers storing data right now
+	inFlightWriters = expvarmetrics.NewGaugeVar()
+	liveWriters     = newWriterRegistry()
+	// sizes of committed files
+	blobSizes   = expvarmetrics.NewHistogramVar()
+	backendInfo atomic.Value
+
+	getContentTimer = expvarmetrics.NewTimerVar()
+	putContentTimer = expvarmetrics.NewTimerVar()
+	writerTimer     = expvarmetrics.NewTimerVar()
+	readerTimer     = expvarmetrics.NewTimerVar()
+	statTimer       = expvarmetrics.NewTimerVar()
+	listTimer       = expvarmetrics.NewTimerVar()
+	moveTimer       = expvarmetrics.NewTimerVar()
+	deleteTimer     = expvarmetrics.NewTimerVar()
 )
 
+// describeBackend returns the type of KV storage and its key parameters.
+// Credentials must never be reported here.
+func describeBackend(kvType string, st KVStorage) map[string]string {
+	description := map[string]string{
+		"type": kvType,
+	}
+
+	if m, ok := st.(*mdsBinStorage); ok {
+		description["host"] = m.Storage.Host
+		description["namespace"] = m.Namespace
+	}
+
+	return description
+}
+
+// OwnerFunc derives the owner of new files and dirs from a request context.
+// An empty string means the owner is unknown.
+type OwnerFunc func(ctx context.Context) string
+
+// defaultOwnerFunc takes the name of a user authenticated by the registry
+func defaultOwnerFunc(ctx context.Context) string {
+	return context.GetStringValue(ctx, auth.UserNameKey)
+}
+
+// contentDigest formats sha256 of content like a registry digest
+func contentDigest(hasher hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+}
+
 func generateKey() string {
 	return uuid.NewRandom().String()
 }
@@ -80,6 +203,17 @@ func setContentSize(ctx context.Context, size int64) context.Context {
 	return context.WithValue(ctx, contentSize, size)
 }
 
+func getContentPath(ctx context.Context) string {
+	if path, ok := ctx.Value(contentPath).(string); ok {
+		return path
+	}
+	return ""
+}
+
+func setContentPath(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, contentPath, path)
+}
+
 func isRoot(path string) bool {
 	return path == "/"
 }
@@ -95,16 +229,101 @@ func getContentLength(ctx context.Context) int64 {
 }
 
 type postgreDriverConfig struct {
-	URLs           []string
+	URLs []string
+	// ConnectTimeout bounds connecting to a cluster on start.
+	// It is 5 seconds by default.
 	ConnectTimeout time.Duration
-	MaxOpenConns   int
+	// AutoMigrate applies pending migrations of the schema on start.
+	// Otherwise the driver fails to start if the schema is not up to date.
+	AutoMigrate  bool
+	MaxOpenConns int
 	// pointer is here to distinguish 0 vlaue from zerovalue by comparing with `nil`
 	MaxIdleConns *int
+	// MaxReplicationLag makes Health treat lagging replicas as unavailable.
+	// 0 disables the check.
+	MaxReplicationLag time.Duration
 
 	DisableURLFor bool
+	// MetaTable and MDSTable override names of tables.
+	// Names can be qualified by a schema: registry.mfs
+	MetaTable string
+	MDSTable  string
+	// Schema qualifies table names, which have no schema
+	Schema string
+	// DeletePolicy is one of best-effort (default), strict or journal
+	DeletePolicy string
+	// DirSizeAggregation makes Stat report a directory size
+	// as total size of its childs
+	DirSizeAggregation bool
+	// LazyDirectories disables creation of directories on write.
+	// They are materialized on first access instead.
+	LazyDirectories bool
+	// ZeroLengthBlobs is one of store (default), inline or flag
+	ZeroLengthBlobs string
+	// SynchronousCommit sets synchronous_commit for transactions of writers,
+	// so Commit returns after the configured acknowledgment, e.g. remote_apply
+	// waits for synchronous standbys. The server setting is used by default.
+	SynchronousCommit string
+	// MaxInFlightBytes limits the total amount of bytes
+	// being written by all writers. 0 means no limit.
+	// Writers wait for the budget until their context is done.
+	MaxInFlightBytes int64
+	// Dedup makes files with identical content share a single KV object.
+	// Appending to a file of a shared object copies it first.
+	Dedup bool
+	// SkipIdenticalContent makes PutContent only update modtime
+	// if the stored content has the same digest
+	SkipIdenticalContent bool
+	// VerifyOnRead makes readers of whole files fail at the end
+	// if the content does not match the digest computed on write
+	VerifyOnRead bool
+	// ReadFromReplica makes Stat, Exists and reads look up metainformation
+	// on a replica if there's one
+	ReadFromReplica bool
+	// ReadYourWritesWindow makes paths written within the window read from
+	// the master, so a lagging replica does not hide them. 0 disables it.
+	ReadYourWritesWindow time.Duration
+	// DisableResumableUploads makes Writer refuse to append to stored content,
+	// so blobs are uploaded in one go instead of being rewritten on append
+	DisableResumableUploads bool
+	// PreparedStatements makes Stat, Exists and reads run prepared statements
+	// on the master, so their queries are not parsed and planned per call
+	PreparedStatements bool
+	// RetryAttempts limits attempts of operations failed with
+	// transient PostgreSQL errors. 1 disables retries.
+	RetryAttempts int
+	// RetryDelay is the delay before the first retry.
+	// It is doubled for each next one.
+	RetryDelay time.Duration
+	// RetryCodes are PostgreSQL error codes treated as transient
+	RetryCodes []string
 
 	Type    string
 	Options map[string]interface{}
+	// Routes send new objects to Backends by the first matching rule.
+	// Other objects are kept by the backend of Type and Options.
+	Routes   []routeConfig
+	Backends map[string]backendConfig
+}
+
+// validate checks settings, which can be checked without connecting
+func (cfg *postgreDriverConfig) validate() error {
+	if cfg.MaxOpenConns < 0 {
+		return fmt.Errorf("MaxOpenConns must not be negative: %d", cfg.MaxOpenConns)
+	}
+
+	if cfg.MaxIdleConns != nil {
+		if *cfg.MaxIdleConns < 0 {
+			return fmt.Errorf("MaxIdleConns must not be negative: %d", *cfg.MaxIdleConns)
+		}
+
+		// NOTE: database/sql silently lowers MaxIdleConns to MaxOpenConns
+		if cfg.MaxOpenConns > 0 && *cfg.MaxIdleConns > cfg.MaxOpenConns {
+			return fmt.Errorf("MaxIdleConns (%d) must not exceed MaxOpenConns (%d)", *cfg.MaxIdleConns, cfg.MaxOpenConns)
+		}
+	}
+
+	return nil
 }
 
 type factoryPostgreDriver struct{}
@@ -134,11 +353,78 @@ func (f *factoryPostgreDriver) Create(parameters map[string]interface{}) (storag
 	return pgdriverNew(&config)
 }
 
+// connect creates a cluster and pings its master.
+// It gives up after timeout, as a dead host can hang connecting for minutes.
+func connect(urls []string, timeout time.Duration) (*pgcluster.Cluster, error) {
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		cluster *pgcluster.Cluster
+		err     error
+	}
+
+	connected := make(chan result, 1)
+	go func() {
+		// NOTE: the cluster elects a master on creation, which
+		// is not bounded by the context
+		cluster, err := pgcluster.NewPostgreSQLCluster(driverSQLName, urls)
+		if err == nil {
+			if err = cluster.DB(pgcluster.MASTER).PingContext(ctx); err != nil {
+				cluster.Close()
+				cluster = nil
+			}
+		}
+		connected <- result{cluster, err}
+	}()
+
+	select {
+	case r := <-connected:
+		return r.cluster, r.err
+	case <-ctx.Done():
+		// clean up a cluster connected too late
+		go func() {
+			if r := <-connected; r.cluster != nil {
+				r.cluster.Close()
+			}
+		}()
+		return nil, fmt.Errorf("unable to connect to PostgreSQL within %v: %v", timeout, ctx.Err())
+	}
+}
+
 type driver struct {
+	*sqlTables
+
 	cluster *pgcluster.Cluster
 	storage KVStorage
 
-	disableURLFor bool
+	disableURLFor      bool
+	deletePolicy       string
+	dirSizeAggregation bool
+	lazyDirectories    bool
+	zeroLengthBlobs    string
+	synchronousCommit  string
+	ownerFunc          OwnerFunc
+	skipIdentical      bool
+	dedup              bool
+	verifyOnRead       bool
+
+	budget  *byteBudget
+	retries *retryPolicy
+	stmts   *stmtCache
+
+	readFromReplica  bool
+	recent           *recentWrites
+	disableResumable bool
+
+	// background tracks deletions of marked keys left running by Delete,
+	// so Close waits for them. backgroundSlots bounds their number.
+	background      sync.WaitGroup
+	backgroundSlots chan struct{}
 }
 
 type baseEmbed struct {
@@ -148,6 +434,8 @@ type baseEmbed struct {
 // Driver implements Storage interface. It uses PostgreSQL and plain KV storage to save data
 type Driver struct {
 	baseEmbed
+
+	drv *driver
 }
 
 func pgdriverNew(cfg *postgreDriverConfig) (*Driver, error) {
@@ -156,12 +444,27 @@ func pgdriverNew(cfg *postgreDriverConfig) (*Driver, error) {
 		err error
 	)
 
-	cluster, err := pgcluster.NewPostgreSQLCluster(driverSQLName, cfg.URLs)
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	tables, err := newSQLTables(cfg.Schema, cfg.MetaTable, cfg.MDSTable)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := connect(cfg.URLs, cfg.ConnectTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = cluster.DB(pgcluster.MASTER).Ping(); err != nil {
+	if cfg.AutoMigrate {
+		err = migrate(context.Background(), cluster.DB(pgcluster.MASTER), tables)
+	} else {
+		err = checkSchemaVersion(context.Background(), cluster.DB(pgcluster.MASTER), tables)
+	}
+	if err != nil {
+		cluster.Close()
 		return nil, err
 	}
 
@@ -173,14 +476,39 @@ func pgdriverNew(cfg *postgreDriverConfig) (*Driver, error) {
 		cluster.SetMaxIdleConns(*cfg.MaxIdleConns)
 	}
 
-	switch cfg.Type {
-	case "inmemory":
-		st, err = newInMemory()
-	case "mds":
-		st, err = newMDSBinStorage(cluster, cfg.Options)
+	cluster.SetMaxReplicationLag(cfg.MaxReplicationLag)
+
+	switch cfg.ZeroLengthBlobs {
+	case "":
+		cfg.ZeroLengthBlobs = zeroLengthStore
+	case zeroLengthStore, zeroLengthInline, zeroLengthFlag:
+		// pass
 	default:
 		cluster.Close()
-		return nil, fmt.Errorf("Unsupported binary storage backend %s", cfg.Type)
+		return nil, fmt.Errorf("Unsupported mode for zero-length blobs %s", cfg.ZeroLengthBlobs)
+	}
+
+	switch cfg.SynchronousCommit {
+	case "", "on", "off", "local", "remote_write", "remote_apply":
+		// pass
+	default:
+		cluster.Close()
+		return nil, fmt.Errorf("Unsupported synchronous_commit level %s", cfg.SynchronousCommit)
+	}
+
+	switch cfg.DeletePolicy {
+	case "":
+		cfg.DeletePolicy = deletePolicyBestEffort
+	case deletePolicyBestEffort, deletePolicyStrict, deletePolicyJournal:
+		// pass
+	default:
+		cluster.Close()
+		return nil, fmt.Errorf("Unsupported delete policy %s", cfg.DeletePolicy)
+	}
+
+	st, err = newKVStorage(cluster, tables, cfg.Type, cfg.Options)
+	if err == nil && len(cfg.Routes) != 0 {
+		st, err = newRoutes(cluster, tables, st, cfg.Routes, cfg.Backends)
 	}
 
 	if err != nil {
@@ -188,20 +516,151 @@ func pgdriverNew(cfg *postgreDriverConfig) (*Driver, error) {
 		return nil, err
 	}
 
+	backendInfo.Store(describeBackend(cfg.Type, st))
+
+	drv := &driver{
+		sqlTables:          tables,
+		cluster:            cluster,
+		storage:            st,
+		disableURLFor:      cfg.DisableURLFor,
+		deletePolicy:       cfg.DeletePolicy,
+		dirSizeAggregation: cfg.DirSizeAggregation,
+		lazyDirectories:    cfg.LazyDirectories,
+		zeroLengthBlobs:    cfg.ZeroLengthBlobs,
+		synchronousCommit:  cfg.SynchronousCommit,
+		ownerFunc:          defaultOwnerFunc,
+		skipIdentical:      cfg.SkipIdenticalContent,
+		dedup:              cfg.Dedup,
+		verifyOnRead:       cfg.VerifyOnRead,
+		disableResumable:   cfg.DisableResumableUploads,
+		retries:            newRetryPolicy(cfg.RetryAttempts, cfg.RetryDelay, cfg.RetryCodes),
+		backgroundSlots:    make(chan struct{}, backgroundDeletes),
+	}
+
+	if cfg.MaxInFlightBytes > 0 {
+		drv.budget = newByteBudget(cfg.MaxInFlightBytes)
+	}
+
+	if cfg.PreparedStatements {
+		drv.stmts = newStmtCache()
+	}
+
+	if cfg.ReadFromReplica {
+		drv.readFromReplica = true
+		if cfg.ReadYourWritesWindow > 0 {
+			drv.recent = newRecentWrites(cfg.ReadYourWritesWindow)
+		}
+	}
+
 	d := &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
-				StorageDriver: &driver{
-					cluster:       cluster,
-					storage:       st,
-					disableURLFor: cfg.DisableURLFor,
-				},
+				StorageDriver: drv,
 			},
 		},
+		drv: drv,
 	}
 	return d, nil
 }
 
+func newKVStorage(cluster *pgcluster.Cluster, tables *sqlTables, kvType string, options map[string]interface{}) (KVStorage, error) {
+	switch kvType {
+	case "inmemory":
+		return newInMemoryBinStorage(options)
+	case "mds":
+		return newMDSBinStorage(cluster, tables, options)
+	case "postgres":
+		return newPGBlobStorage(cluster, tables)
+	case "filesystem":
+		return newFilesystem(options)
+	case "s3":
+		return newS3Storage(options)
+	case "elliptics":
+		return nil, errEllipticsUnavailable
+	default:
+		return nil, fmt.Errorf("Unsupported binary storage backend %s", kvType)
+	}
+}
+
+// newRoutes creates routed backends on top of the default one.
+// All of them are closed if any fails.
+func newRoutes(cluster *pgcluster.Cluster, tables *sqlTables, st KVStorage, routes []routeConfig, configs map[string]backendConfig) (KVStorage, error) {
+	backends := map[string]KVStorage{defaultBackend: st}
+	closeAll := func() {
+		for _, backend := range backends {
+			backend.Close()
+		}
+	}
+
+	for name, cfg := range configs {
+		if name == defaultBackend {
+			closeAll()
+			return nil, fmt.Errorf("backend name %q is reserved", defaultBackend)
+		}
+
+		backend, err := newKVStorage(cluster, tables, cfg.Type, cfg.Options)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("backend %q: %v", name, err)
+		}
+		backends[name] = backend
+	}
+
+	routed, err := newRoutedStorage(cluster, tables, backends, routes)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return routed, nil
+}
+
+// Close releases KV storage resources and closes connections to the cluster.
+// The driver must not be used after Close.
+func (d *Driver) Close() error {
+	// NOTE: background deletions use both KV storage and the cluster
+	d.drv.background.Wait()
+
+	var errs []error
+	if err := d.drv.storage.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if d.drv.stmts != nil {
+		d.drv.stmts.Close()
+	}
+
+	if err := d.drv.cluster.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	return nil
+}
+
+// Health reports the state of the PostgreSQL cluster. A degraded cluster
+// is functional, so it deserves a warning rather than a failure.
+func (d *Driver) Health() pgcluster.HealthStatus {
+	return d.drv.cluster.Health()
+}
+
+// Owner returns the owner of the file or dir stored at "path".
+// An empty string is returned if the owner is unknown.
+func (d *Driver) Owner(ctx context.Context, path string) (string, error) {
+	return d.drv.Owner(ctx, path)
+}
+
+// SetOwnerFunc replaces the way owners of new files and dirs are derived
+// from a request context. It must be called before the driver is used.
+func (d *Driver) SetOwnerFunc(f OwnerFunc) {
+	if f == nil {
+		f = defaultOwnerFunc
+	}
+	d.drv.ownerFunc = f
+}
+
 // Name returns the driver name
 func (d *driver) Name() string {
 	return driverName
@@ -210,13 +669,18 @@ func (d *driver) Name() string {
 // GetContent retrieves the content stored at "path" as a []byte.
 // This should primarily be used for small objects.
 func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
-	key, err := d.getKey(ctx, d.cluster.DB(pgcluster.MASTER), path)
-	if err != nil {
-		return nil, err
-	}
-
-	reader, err := d.storage.Get(ctx, key, 0)
-	if err != nil {
+	defer getContentTimer.UpdateSince(time.Now())
+	reader, err := d.read(ctx, path, 0)
+	switch err {
+	case nil:
+		if d.verifyOnRead {
+			if reader, err = d.verifyRead(ctx, path, reader); err != nil {
+				return nil, err
+			}
+		}
+	case errNoKVObject:
+		return d.getInline(ctx, path, 0, -1)
+	default:
 		return nil, err
 	}
 	defer reader.Close()
@@ -229,26 +693,226 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 	return output.Bytes(), nil
 }
 
+// GetContentRange retrieves length bytes of the content stored at "path"
+// starting at offset. Fewer bytes are returned if the content ends earlier.
+func (d *Driver) GetContentRange(ctx context.Context, path string, offset, length int64) ([]byte, error) {
+	return d.drv.GetContentRange(ctx, path, offset, length)
+}
+
+// GetContentRange reads only the requested range from KV storage,
+// so small parts of large objects are not buffered as a whole
+func (d *driver) GetContentRange(ctx context.Context, path string, offset, length int64) ([]byte, error) {
+	defer getContentTimer.UpdateSince(time.Now())
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: driverName}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("length must not be negative: %d", length)
+	}
+
+	var (
+		isDir bool
+		size  int64
+		key   sql.NullString
+	)
+	err := d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q("SELECT dir, size, key FROM {mfs} WHERE path = $1"), path).Scan(&isDir, &size, &key)
+	switch {
+	case err == sql.ErrNoRows, err == nil && isDir:
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case err != nil:
+		return nil, err
+	}
+
+	if offset > size {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: driverName}
+	}
+
+	if !key.Valid {
+		return d.getInline(ctx, path, offset, length)
+	}
+
+	if offset == size || length == 0 {
+		return []byte{}, nil
+	}
+
+	reader, err := d.storage.Get(ctx, key.String, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if length > size-offset {
+		length = size - offset
+	}
+	content := make([]byte, length)
+	n, err := io.ReadFull(reader, content)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return content[:n], err
+}
+
+// read returns the object of the file stored at path from KV storage.
+// errNoKVObject is returned if the file has no object.
+func (d *driver) read(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if r, ok := d.storage.(pathReader); ok {
+		return r.getByPath(ctx, path, offset)
+	}
+
+	key, err := d.getKey(ctx, d.hot(path), path)
+	if err != nil {
+		return nil, err
+	}
+	return d.storage.Get(ctx, key, offset)
+}
+
 type rowQuerier interface {
-	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx stdcontext.Context, query string, args ...interface{}) *sql.Row
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx stdcontext.Context, query string, args ...interface{}) (*sql.Rows, error)
 }
 
+// getKey returns a key of KV object of a file.
+// errNoKVObject is returned if a file has no KV object.
 func (d *driver) getKey(ctx context.Context, db rowQuerier, path string) (string, error) {
-	var key string
-	err := db.QueryRow("SELECT key FROM mfs WHERE path=$1", path).Scan(&key)
+	var (
+		key   sql.NullString
+		isDir bool
+	)
+	err := db.QueryRowContext(ctx, d.q("SELECT key, dir FROM {mfs} WHERE path=$1"), path).Scan(&key, &isDir)
+	switch err {
+	case sql.ErrNoRows:
+		return "", storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case nil:
+		if isDir {
+			return "", storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+		}
+		if !key.Valid {
+			return "", errNoKVObject
+		}
+		return key.String, nil
+	default:
+		return "", err
+	}
+}
+
+// getInline returns length bytes of content of a file stored in mfs
+// starting at offset. A negative length means the rest of content.
+// Only the requested bytes are transferred from PostgreSQL.
+func (d *driver) getInline(ctx context.Context, path string, offset int64, length int64) ([]byte, error) {
+	var (
+		size    sql.NullInt64
+		content []byte
+		err     error
+	)
+
+	db := d.cluster.DB(pgcluster.MASTER)
+	// NOTE: substring counts bytes from 1
+	if length < 0 {
+		err = db.QueryRowContext(ctx, d.q("SELECT octet_length(inline), substring(inline FROM $2) FROM {mfs} WHERE path=$1"),
+			path, offset+1).Scan(&size, &content)
+	} else {
+		err = db.QueryRowContext(ctx, d.q("SELECT octet_length(inline), substring(inline FROM $2 FOR $3) FROM {mfs} WHERE path=$1"),
+			path, offset+1, length).Scan(&size, &content)
+	}
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case nil:
+		if offset < 0 || offset > size.Int64 {
+			return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: driverName}
+		}
+		if content == nil {
+			content = []byte{}
+		}
+		return content, nil
+	default:
+		return nil, err
+	}
+}
+
+// ownerOf returns the owner derived from ctx. An unknown owner is stored as NULL.
+func (d *driver) ownerOf(ctx context.Context) interface{} {
+	if owner := d.ownerFunc(ctx); owner != "" {
+		return owner
+	}
+	return nil
+}
+
+// Owner returns the owner of the file or dir stored at "path".
+func (d *driver) Owner(ctx context.Context, path string) (string, error) {
+	var owner sql.NullString
+	err := d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q("SELECT owner FROM {mfs} WHERE path=$1"), path).Scan(&owner)
 	switch err {
 	case sql.ErrNoRows:
 		return "", storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
 	case nil:
-		return key, nil
+		return owner.String, nil
 	default:
 		return "", err
 	}
 }
 
+// ListByOwner returns paths of files and dirs owned by owner under prefix.
+// An empty owner matches paths, which owner is unknown.
+func (d *Driver) ListByOwner(ctx context.Context, owner string, prefix string) ([]string, error) {
+	return d.drv.ListByOwner(ctx, owner, prefix)
+}
+
+// ListByOwner walks the subtree by parent_idx filtering rows by owner
+func (d *driver) ListByOwner(ctx context.Context, owner string, prefix string) ([]string, error) {
+	defer listTimer.UpdateSince(time.Now())
+	if err := d.checkListed(ctx, prefix); err != nil {
+		return nil, err
+	}
+
+	var ownerValue interface{}
+	if owner != "" {
+		ownerValue = owner
+	}
+
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q(`
+		WITH RECURSIVE t(path, owner) AS (
+		        SELECT path, owner FROM {mfs} WHERE parent = $1
+		    UNION ALL
+		        SELECT {mfs}.path, {mfs}.owner FROM t, {mfs} WHERE {mfs}.parent = t.path
+		)
+		SELECT path FROM t WHERE owner IS NOT DISTINCT FROM $2 ORDER BY path;
+	`), prefix, ownerValue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
 // PutContent stores the []byte content at a location designated by "path".
 // This should primarily be used for small objects.
 func (d *driver) PutContent(ctx context.Context, path string, content []byte) error {
+	defer putContentTimer.UpdateSince(time.Now())
+	if d.skipIdentical {
+		touched, err := d.touchIdentical(ctx, path, content)
+		if err != nil {
+			return err
+		}
+		if touched {
+			return nil
+		}
+	}
+
 	ctx = setContentSize(ctx, int64(len(content)))
 	writer, err := d.Writer(ctx, path, false)
 	if err != nil {
@@ -263,10 +927,37 @@ func (d *driver) PutContent(ctx context.Context, path string, content []byte) er
 	return writer.Commit()
 }
 
+// touchIdentical updates modtime of the file at path if it has the same content.
+// It reports whether the file has been updated.
+func (d *driver) touchIdentical(ctx context.Context, path string, content []byte) (bool, error) {
+	hasher := sha256.New()
+	hasher.Write(content)
+	digest := contentDigest(hasher)
+
+	var result sql.Result
+	err := d.retry(ctx, func() (err error) {
+		result, err = d.cluster.DB(pgcluster.MASTER).ExecContext(ctx, d.q("UPDATE {mfs} SET modtime = now() WHERE path = $1 AND NOT dir AND size = $2 AND digest = $3"),
+			path, len(content), digest)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
 // Writer returns a FileWriter which will store the content written to it
 // at the location designated by "path" after the call to Commit.
 func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	defer writerTimer.UpdateSince(time.Now())
 	ctx = setContentSize(ctx, getContentLength(ctx))
+	ctx = setContentPath(ctx, path)
 	return newFileWriter(ctx, d, path, append)
 }
 
@@ -274,50 +965,362 @@ func (d *driver) Writer(ctx context.Context, path string, append bool) (storaged
 // with a given byte offset.
 // May be used to resume reading a stream by providing a nonzero offset.
 func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	key, err := d.getKey(ctx, d.cluster.DB(pgcluster.MASTER), path)
-	if err != nil {
+	defer readerTimer.UpdateSince(time.Now())
+	reader, err := d.read(ctx, path, offset)
+	switch err {
+	case nil:
+		// NOTE: only the whole content can be verified
+		if d.verifyOnRead && offset == 0 {
+			return d.verifyRead(ctx, path, reader)
+		}
+		return reader, nil
+	case errNoKVObject:
+		// inline content is served without KV storage at all
+		content, err := d.getInline(ctx, path, offset, -1)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	default:
 		return nil, err
 	}
-	return d.storage.Get(ctx, key, offset)
 }
 
 // Stat retrieves the FileInfo for the given path, including the current
 // size in bytes and the creation time.
 func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	defer statTimer.UpdateSince(time.Now())
 	info := storagedriver.FileInfoFields{
 		Path: path,
 	}
 
-	// NOTE: should size of directory be evaluated as total size of its childs?
-	err := d.cluster.DB(pgcluster.MASTER).QueryRow("SELECT dir, size, modtime FROM mfs WHERE path=$1", path).Scan(&info.IsDir, &info.Size, &info.ModTime)
-	switch err {
-	case sql.ErrNoRows:
-		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
-	case nil:
+	// NOTE: there is no row of the root, but its size is known
+	if isRoot(path) && d.dirSizeAggregation {
+		if d.lazyDirectories {
+			if _, err := d.materializeDirectories(ctx, path); err != nil {
+				return nil, err
+			}
+		}
+		size, err := d.dirSize(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		info.IsDir, info.Size = true, size
+		return &storagedriver.FileInfoInternal{FileInfoFields: info}, nil
+	}
+
+	err := d.hot(path).QueryRowContext(ctx, d.q("SELECT dir, size, modtime FROM {mfs} WHERE path=$1"), path).Scan(&info.IsDir, &info.Size, &info.ModTime)
+	if err == sql.ErrNoRows && d.lazyDirectories {
+		materialized, merr := d.materializeDirectories(ctx, path)
+		switch {
+		case merr != nil:
+			return nil, merr
+		case materialized:
+			// NOTE: materialized directories may be not replicated yet
+			err = d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q("SELECT dir, size, modtime FROM {mfs} WHERE path=$1"), path).Scan(&info.IsDir, &info.Size, &info.ModTime)
+		}
+	}
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case nil:
+		if info.IsDir && d.dirSizeAggregation {
+			if info.Size, err = d.dirSize(ctx, path); err != nil {
+				return nil, err
+			}
+		}
 		return &storagedriver.FileInfoInternal{FileInfoFields: info}, nil
 	default:
 		return nil, err
 	}
 }
 
+// dirSize evaluates size of a directory as total size of its childs
+func (d *driver) dirSize(ctx context.Context, path string) (int64, error) {
+	var size int64
+	// NOTE: directories are stored with zero size, so it's safe to sum them up
+	err := d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q(`
+		WITH RECURSIVE t(path, size) AS (
+		        SELECT path, size FROM {mfs} WHERE parent = $1
+		    UNION ALL
+		        SELECT {mfs}.path, {mfs}.size FROM t, {mfs} WHERE {mfs}.parent = t.path
+		)
+		SELECT COALESCE(SUM(size), 0) FROM t;
+	`), path).Scan(&size)
+	return size, err
+}
+
+// dirSizes sums up sizes of files under each of dirs by a single query.
+// Empty directories are absent in the result.
+func (d *driver) dirSizes(ctx context.Context, dirs []string) (map[string]int64, error) {
+	sizes := make(map[string]int64, len(dirs))
+	if len(dirs) == 0 {
+		return sizes, nil
+	}
+
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q(`
+		WITH RECURSIVE t(root, path, size) AS (
+		        SELECT parent, path, size FROM {mfs} WHERE parent = ANY($1::text[])
+		    UNION ALL
+		        SELECT t.root, {mfs}.path, {mfs}.size FROM t, {mfs} WHERE {mfs}.parent = t.path
+		)
+		SELECT root, COALESCE(SUM(size), 0) FROM t GROUP BY root;
+	`), textArray(dirs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			dir  string
+			size int64
+		)
+		if err = rows.Scan(&dir, &size); err != nil {
+			return nil, err
+		}
+		sizes[dir] = size
+	}
+	return sizes, rows.Err()
+}
+
+// StatMany retrieves FileInfo for many paths by a single query.
+// Missing paths are not an error: they are just absent in the result.
+func (d *Driver) StatMany(ctx context.Context, paths []string) (map[string]storagedriver.FileInfo, error) {
+	return d.drv.StatMany(ctx, paths)
+}
+
+func (d *driver) StatMany(ctx context.Context, paths []string) (map[string]storagedriver.FileInfo, error) {
+	defer statTimer.UpdateSince(time.Now())
+	infos := make(map[string]storagedriver.FileInfo, len(paths))
+	if len(paths) == 0 {
+		return infos, nil
+	}
+
+	found, err := d.statPaths(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.dirSizeAggregation {
+		var dirs []string
+		for _, info := range found {
+			if info.IsDir {
+				dirs = append(dirs, info.Path)
+			}
+		}
+		sizes, err := d.dirSizes(ctx, dirs)
+		if err != nil {
+			return nil, err
+		}
+		for i := range found {
+			if found[i].IsDir {
+				found[i].Size = sizes[found[i].Path]
+			}
+		}
+	}
+
+	for _, info := range found {
+		infos[info.Path] = &storagedriver.FileInfoInternal{FileInfoFields: info}
+	}
+
+	if d.lazyDirectories {
+		// missing directories may be not materialized yet
+		for _, path := range paths {
+			if _, ok := infos[path]; ok {
+				continue
+			}
+			info, err := d.Stat(ctx, path)
+			switch err.(type) {
+			case nil:
+				infos[path] = info
+			case storagedriver.PathNotFoundError:
+				// pass
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	return infos, nil
+}
+
+// statPaths reads rows of paths. Rows are read before anything else is queried,
+// so the connection is released.
+func (d *driver) statPaths(ctx context.Context, paths []string) ([]storagedriver.FileInfoFields, error) {
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q("SELECT path, dir, size, modtime FROM {mfs} WHERE path = ANY($1::text[])"), textArray(paths))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []storagedriver.FileInfoFields
+	for rows.Next() {
+		var info storagedriver.FileInfoFields
+		if err = rows.Scan(&info.Path, &info.IsDir, &info.Size, &info.ModTime); err != nil {
+			return nil, err
+		}
+		found = append(found, info)
+	}
+	return found, rows.Err()
+}
+
+// Exists reports whether a file or a directory is stored at "path".
+// It's cheaper than Stat, as no FileInfo is built.
+func (d *Driver) Exists(ctx context.Context, path string) (bool, error) {
+	return d.drv.Exists(ctx, path)
+}
+
+func (d *driver) Exists(ctx context.Context, path string) (bool, error) {
+	if isRoot(path) {
+		return true, nil
+	}
+
+	found, err := d.exists(ctx, d.hot(path), path)
+	if err == nil && !found && d.lazyDirectories {
+		var materialized bool
+		if materialized, err = d.materializeDirectories(ctx, path); err != nil || !materialized {
+			return false, err
+		}
+		found, err = d.exists(ctx, d.cluster.DB(pgcluster.MASTER), path)
+	}
+	return found, err
+}
+
+// exists probes mfs for path
+func (d *driver) exists(ctx context.Context, db rowQuerier, path string) (bool, error) {
+	var ph interface{}
+	switch err := db.QueryRowContext(ctx, d.q("SELECT 1 FROM {mfs} WHERE path=$1"), path).Scan(&ph); err {
+	case sql.ErrNoRows:
+		return false, nil
+	case nil:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// listPageSize is the number of children fetched at once by List
+const listPageSize = 1000
+
 // List returns a list of the objects that are direct descendants of the given path.
 func (d *driver) List(ctx context.Context, path string) ([]string, error) {
-	//NOTE: should I use Tx?
-	if !isRoot(path) {
-		var ph interface{}
-		switch err := d.cluster.DB(pgcluster.MASTER).QueryRow("SELECT 1 FROM mfs WHERE path=$1", path).Scan(&ph); err {
-		case sql.ErrNoRows:
-			return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	defer listTimer.UpdateSince(time.Now())
+	if err := d.checkListed(ctx, path); err != nil {
+		return nil, err
+	}
+
+	var (
+		listing []string
+		cursor  string
+	)
+	for {
+		page, next, err := d.listPage(ctx, path, cursor, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		listing = append(listing, page...)
+		if next == "" {
+			return listing, nil
+		}
+		cursor = next
+	}
+}
+
+// ListPage returns at most limit direct descendants of the given path ordered
+// by name, which follow cursor. An empty cursor starts from the first one.
+// The returned cursor refers to the next page. It's empty after the last page.
+func (d *Driver) ListPage(ctx context.Context, path, cursor string, limit int) ([]string, string, error) {
+	return d.drv.ListPage(ctx, path, cursor, limit)
+}
+
+func (d *driver) ListPage(ctx context.Context, path, cursor string, limit int) ([]string, string, error) {
+	defer listTimer.UpdateSince(time.Now())
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("limit must be positive: %d", limit)
+	}
+
+	if err := d.checkListed(ctx, path); err != nil {
+		return nil, "", err
+	}
+
+	return d.listPage(ctx, path, cursor, limit)
+}
+
+// ErrStopList is used as a return value from ListFn to stop listing.
+// It's not returned by ListFunc.
+var ErrStopList = errors.New("stop listing")
+
+// ListFn is called once per direct descendant visited by ListFunc
+type ListFn func(path string) error
+
+// ListFunc calls f for each direct descendant of the given path as rows
+// are fetched, so children are not accumulated in memory.
+// An error returned by f stops listing and is returned unless it's ErrStopList.
+func (d *Driver) ListFunc(ctx context.Context, path string, f ListFn) error {
+	return d.drv.ListFunc(ctx, path, f)
+}
+
+func (d *driver) ListFunc(ctx context.Context, path string, f ListFn) error {
+	defer listTimer.UpdateSince(time.Now())
+	if err := d.checkListed(ctx, path); err != nil {
+		return err
+	}
+
+	// NOTE: the connection is held until rows are closed
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q("SELECT path FROM {mfs} WHERE parent=$1 ORDER BY path"), path)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item string
+		if err = rows.Scan(&item); err != nil {
+			return err
+		}
+
+		switch err = f(item); err {
 		case nil:
 			// pass
+		case ErrStopList:
+			return nil
 		default:
-			return nil, err
+			return err
 		}
 	}
+	return rows.Err()
+}
+
+// checkListed ensures that the directory to list exists
+func (d *driver) checkListed(ctx context.Context, path string) error {
+	if d.lazyDirectories {
+		if _, err := d.materializeDirectories(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	if isRoot(path) {
+		return nil
+	}
 
-	rows, err := d.cluster.DB(pgcluster.MASTER).Query("SELECT path FROM mfs WHERE parent=$1", path)
+	found, err := d.exists(ctx, d.hot(path), path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if !found {
+		return storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	}
+	return nil
+}
+
+// listPage fetches a page by a keyset cursor. One extra row
+// is fetched to find out if there is the next page.
+func (d *driver) listPage(ctx context.Context, path, cursor string, limit int) ([]string, string, error) {
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q("SELECT path FROM {mfs} WHERE parent=$1 AND path > $2 ORDER BY path LIMIT $3"), path, cursor, limit+1)
+	if err != nil {
+		return nil, "", err
 	}
 	defer rows.Close()
 
@@ -325,168 +1328,637 @@ func (d *driver) List(ctx context.Context, path string) ([]string, error) {
 	for rows.Next() {
 		var item string
 		if err := rows.Scan(&item); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		listing = append(listing, item)
 	}
-	return listing, nil
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(listing) <= limit {
+		return listing, "", nil
+	}
+	listing = listing[:limit]
+	return listing, listing[limit-1], nil
+}
+
+// ListModifiedSince returns files under prefix modified after since.
+// It allows to mirror a tree incrementally.
+func (d *Driver) ListModifiedSince(ctx context.Context, prefix string, since time.Time) ([]storagedriver.FileInfo, error) {
+	return d.drv.ListModifiedSince(ctx, prefix, since)
+}
+
+func (d *driver) ListModifiedSince(ctx context.Context, prefix string, since time.Time) ([]storagedriver.FileInfo, error) {
+	defer listTimer.UpdateSince(time.Now())
+	if err := d.checkListed(ctx, prefix); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q(`
+		WITH RECURSIVE t(path, dir, size, modtime) AS (
+		        SELECT path, dir, size, modtime FROM {mfs} WHERE parent = $1
+		    UNION ALL
+		        SELECT {mfs}.path, {mfs}.dir, {mfs}.size, {mfs}.modtime FROM t, {mfs} WHERE {mfs}.parent = t.path
+		)
+		SELECT path, size, modtime FROM t WHERE NOT dir AND modtime > $2 ORDER BY path;
+	`), prefix, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []storagedriver.FileInfo
+	for rows.Next() {
+		info := storagedriver.FileInfoFields{}
+		if err = rows.Scan(&info.Path, &info.Size, &info.ModTime); err != nil {
+			return nil, err
+		}
+		files = append(files, &storagedriver.FileInfoInternal{FileInfoFields: info})
+	}
+	return files, rows.Err()
+}
+
+// ErrSkipDir is used as a return value from WalkFn to indicate that
+// the directory named in the call is to be skipped. If it's returned for a file,
+// the remaining files of its directory are skipped.
+var ErrSkipDir = errors.New("skip this directory")
+
+// WalkFn is called once per file or directory visited by Walk
+type WalkFn func(fileInfo storagedriver.FileInfo) error
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *Driver) Walk(ctx context.Context, path string, f WalkFn) error {
+	return d.drv.Walk(ctx, path, f)
+}
+
+// Walk traverses all descendants of the given path in depth-first order
+// calling f for each of them. The whole tree is fetched by one query.
+func (d *driver) Walk(ctx context.Context, path string, f WalkFn) error {
+	if d.lazyDirectories {
+		if _, err := d.materializeDirectories(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	if !isRoot(path) {
+		found, err := d.exists(ctx, d.hot(path), path)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+		}
+	}
+
+	// NOTE: ordering by an array of path components keeps every subtree contiguous,
+	// which is required to skip it
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q(`
+		WITH RECURSIVE t(path, dir, size, modtime) AS (
+		        SELECT path, dir, size, modtime FROM {mfs} WHERE parent = $1
+		    UNION ALL
+		        SELECT {mfs}.path, {mfs}.dir, {mfs}.size, {mfs}.modtime FROM t, {mfs} WHERE {mfs}.parent = t.path
+		)
+		SELECT path, dir, size, modtime FROM t ORDER BY string_to_array(path, '/');
+	`), path)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var skipped string
+	for rows.Next() {
+		var info storagedriver.FileInfoFields
+		if err := rows.Scan(&info.Path, &info.IsDir, &info.Size, &info.ModTime); err != nil {
+			return err
+		}
+
+		if skipped != "" && strings.HasPrefix(info.Path, skipped) {
+			continue
+		}
+		skipped = ""
+
+		switch err := f(&storagedriver.FileInfoInternal{FileInfoFields: info}); err {
+		case nil:
+			// pass
+		case ErrSkipDir:
+			if info.IsDir {
+				skipped = info.Path + "/"
+			} else if parent := filepath.Dir(info.Path); isRoot(parent) {
+				skipped = parent
+			} else {
+				skipped = parent + "/"
+			}
+		default:
+			return err
+		}
+	}
+
+	return rows.Err()
 }
 
 // Move moves an object stored at sourcePath to destPath, removing the
 // original object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	tx, err := d.cluster.DB(pgcluster.MASTER).Begin()
+	defer moveTimer.UpdateSince(time.Now())
+	defer d.wrote(sourcePath, destPath)
+	if d.lazyDirectories {
+		if _, err := d.materializeDirectories(ctx, sourcePath); err != nil {
+			return err
+		}
+	}
+
+	// NOTE: the key of an overwritten file is deleted like keys of deleted files
+	return d.deleteBy(ctx, func(deleteID string) error {
+		return d.move(ctx, sourcePath, destPath, deleteID)
+	})
+}
+
+// move renames the file or the directory sourcePath to destPath.
+// The key of the file overwritten at destPath is journaled by deleteID.
+func (d *driver) move(ctx context.Context, sourcePath string, destPath string, deleteID string) error {
+	tx, err := d.cluster.DB(pgcluster.MASTER).BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// Check that the source exists and is a file.
+	// Check that the source exists and get its type.
 	var isDir = false
-	switch err := tx.QueryRow(checksFileExistsAndGetType, sourcePath).Scan(&isDir); err {
+	switch err := tx.QueryRowContext(ctx, d.q(checksFileExistsAndGetType), sourcePath).Scan(&isDir); err {
 	case sql.ErrNoRows:
-		return storagedriver.PathNotFoundError{Path: sourcePath}
+		return storagedriver.PathNotFoundError{Path: sourcePath, DriverName: driverName}
 	case nil:
 		if isDir {
-			return fmt.Errorf("source `%s` is a directory. Moving directories is not supported", sourcePath)
+			if err = d.moveDirectory(ctx, tx, sourcePath, destPath); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+	default:
+		return err
+	}
+
+	var owner = d.ownerOf(ctx)
+
+	// Check that the dest is not a directory.
+	switch err := tx.QueryRowContext(ctx, d.q(checksFileExistsAndGetType), destPath).Scan(&isDir); err {
+	case sql.ErrNoRows:
+		parent := filepath.Dir(destPath)
+		var (
+			size   int64
+			key    sql.NullString
+			inline []byte
+			digest sql.NullString
+		)
+
+		if err = tx.QueryRowContext(ctx, d.q(`DELETE FROM {mfs} WHERE path = $1 RETURNING size, key, inline, digest`), sourcePath).Scan(&size, &key, &inline, &digest); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, d.q(insertFile), destPath, parent, size, key, owner, inline, digest, expiresAt(ctx))
+		if err != nil {
+			return err
+		}
+
+		if err = d.createParentDirectories(ctx, tx, destPath, owner); err != nil {
+			return err
+		}
+
+	case nil:
+		if isDir {
+			return fmt.Errorf("destination `%s` is a directory. Moving directories is not supported", destPath)
+		}
+		// TODO: looks ugly. Actually I can merge previous queries here by adding dir = true
+		// Delete source record and update dest record with some fields.
+		// NOTE: all parts of the statement see the dest record before the update,
+		// so the replaced key is journaled
+		_, err = tx.ExecContext(ctx, d.q(`
+			WITH t AS (DELETE FROM {mfs} WHERE path = $1 RETURNING size, key, inline, digest),
+			replaced AS (SELECT key FROM {mfs} WHERE path = $2 AND key IS NOT NULL),
+			updated AS (
+			    UPDATE {mfs} SET (size, modtime, key, inline, digest, expires_at) = (t.size, now(), t.key, t.inline, t.digest, $3)
+			    FROM t WHERE {mfs}.path = $2
+			)
+			INSERT INTO {mfs_delete_journal} (key, delete_id) SELECT key, $4 FROM replaced;`), sourcePath, destPath, expiresAt(ctx), deleteID)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	return d.commitDelete(ctx, tx, deleteID)
+}
+
+// moveDirectory renames the directory sourcePath and all its childs to destPath
+// by a single UPDATE. Only metainformation is changed, so keys stay untouched.
+func (d *driver) moveDirectory(ctx context.Context, tx *sql.Tx, sourcePath string, destPath string) error {
+	if destPath == sourcePath || strings.HasPrefix(destPath, sourcePath+"/") {
+		return fmt.Errorf("unable to move directory `%s` into itself: %s", sourcePath, destPath)
+	}
+
+	var isDir = false
+	switch err := tx.QueryRowContext(ctx, d.q(checksFileExistsAndGetType), destPath).Scan(&isDir); err {
+	case sql.ErrNoRows:
+		// pass
+	case nil:
+		return fmt.Errorf("destination `%s` already exists. Moving directories to existing paths is not supported", destPath)
+	default:
+		return err
+	}
+
+	if err := d.createParentDirectories(ctx, tx, destPath, d.ownerOf(ctx)); err != nil {
+		return err
+	}
+
+	// NOTE: the whole subtree is renamed by a single statement.
+	// Parents of descendants share the prefix of their paths.
+	_, err := tx.ExecContext(ctx, d.q(`
+		UPDATE {mfs} SET (path, parent, modtime) = (
+			$2::text || substr(path, length($1::text) + 1),
+			CASE WHEN path = $1 THEN $3::text ELSE $2::text || substr(parent, length($1::text) + 1) END,
+			now())
+		WHERE path = $1 OR path LIKE $4
+	`), sourcePath, destPath, filepath.Dir(destPath), likeChildren(sourcePath))
+	return err
+}
+
+// createParentDirectories creates all missing parent directories of "path".
+// In lazy mode it checks that "path" can be created and creates only
+// parents under materialized directories.
+func (d *driver) createParentDirectories(ctx context.Context, tx *sql.Tx, path string, owner interface{}) error {
+	if d.lazyDirectories {
+		return d.checkLazyParentDirectories(ctx, tx, path, owner)
+	}
+	return d.insertParentDirectories(ctx, tx, path, owner)
+}
+
+// insertParentDirectories creates all missing parent directories of "path"
+// by a single statement
+func (d *driver) insertParentDirectories(ctx context.Context, tx *sql.Tx, path string, owner interface{}) error {
+	return d.insertDirectories(ctx, tx, path, parentDirectories(path), owner)
+}
+
+// insertDirectories creates missing directories. Directories of "path" are
+// checked to be not files.
+func (d *driver) insertDirectories(ctx context.Context, tx *sql.Tx, path string, directories []string, owner interface{}) error {
+	if len(directories) == 0 {
+		return nil
+	}
+
+	parents := make([]string, 0, len(directories))
+	for _, dir := range directories {
+		parents = append(parents, filepath.Dir(dir))
+	}
+
+	if _, err := tx.ExecContext(ctx, d.q(insertParentDirs), textArray(directories), textArray(parents), owner, len(directories)); err != nil {
+		return err
+	}
+
+	// NOTE: the check follows the insert, as a conflicting insert waits
+	// for the concurrent transaction, so a file committed by it is seen here.
+	// Directories inserted under a file are rolled back with the error.
+	return d.checkParentDirectories(ctx, tx, path, directories)
+}
+
+// CreateDir creates an empty directory at "path" and its missing parents.
+// Existing directories are kept.
+func (d *Driver) CreateDir(ctx context.Context, path string) error {
+	return d.drv.CreateDir(ctx, path)
+}
+
+func (d *driver) CreateDir(ctx context.Context, path string) error {
+	if isRoot(path) {
+		return nil
+	}
+	defer d.wrote(path)
+
+	return d.retry(ctx, func() error {
+		tx, err := d.beginWrite(ctx)
+		if err != nil {
+			return err
 		}
+		defer tx.Rollback()
+
+		if err = d.insertDirectories(ctx, tx, path, append([]string{path}, parentDirectories(path)...), d.ownerOf(ctx)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// checkParentDirectories verifies that no one of parents of "path" is a file
+func (d *driver) checkParentDirectories(ctx context.Context, tx *sql.Tx, path string, parents []string) error {
+	var ph interface{}
+	switch err := tx.QueryRowContext(ctx, d.q("SELECT 1 FROM {mfs} WHERE path = ANY($1::text[]) AND NOT dir LIMIT 1"), textArray(parents)).Scan(&ph); err {
+	case nil:
+		return fmt.Errorf("unable to rewrite file by directory: %s", path)
+	case sql.ErrNoRows:
+		return nil
 	default:
 		return err
 	}
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	defer deleteTimer.UpdateSince(time.Now())
+	defer d.wrote(path)
+	if d.lazyDirectories {
+		if _, err := d.materializeDirectories(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	return d.deleteBy(ctx, func(deleteID string) error {
+		return d.deleteMeta(ctx, path, deleteID)
+	})
+}
+
+// DeleteMany deletes files stored at paths in a single transaction.
+// Directories are not deleted. Paths, which are absent or directories,
+// are returned as missing.
+func (d *Driver) DeleteMany(ctx context.Context, paths []string) ([]string, error) {
+	return d.drv.DeleteMany(ctx, paths)
+}
+
+func (d *driver) DeleteMany(ctx context.Context, paths []string) ([]string, error) {
+	defer deleteTimer.UpdateSince(time.Now())
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	defer d.wrote(paths...)
+
+	var deleted map[string]struct{}
+	err := d.deleteBy(ctx, func(deleteID string) error {
+		var err error
+		deleted, err = d.deleteManyMeta(ctx, paths, deleteID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, path := range paths {
+		if _, ok := deleted[path]; !ok {
+			missing = append(missing, path)
+		}
+	}
+	return missing, nil
+}
+
+// deleteManyMeta deletes metainformation of files and journals their keys
+// by deleteID. Deleted paths are returned.
+func (d *driver) deleteManyMeta(ctx context.Context, paths []string, deleteID string) (map[string]struct{}, error) {
+	tx, err := d.cluster.DB(pgcluster.MASTER).BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, d.q(`
+		WITH deleted AS (
+		    DELETE FROM {mfs} WHERE path = ANY($1::text[]) AND NOT dir RETURNING path, key
+		), journaled AS (
+		    INSERT INTO {mfs_delete_journal} (key, delete_id) SELECT DISTINCT key, $2 FROM deleted WHERE key IS NOT NULL
+		)
+		SELECT path FROM deleted`), textArray(paths), deleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[string]struct{}, len(paths))
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deleted[path] = struct{}{}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deleted, d.commitDelete(ctx, tx, deleteID)
+}
+
+// deleteBy runs deleteMeta-like fn, which deletes metainformation and
+// journals keys of deleted files by deleteID. Then keys are deleted
+// from KV storage according to the policy.
+func (d *driver) deleteBy(ctx context.Context, fn func(deleteID string) error) error {
+	// NOTE: keys of deleted files are journaled by deleteID
+	// to be deleted from KV storage after commit
+	deleteID := generateKey()
+	err := d.retry(ctx, func() error {
+		return fn(deleteID)
+	})
+	if err != nil || d.deletePolicy == deletePolicyStrict {
+		return err
+	}
 
-	var owner = ctx.Value(auth.UserNameKey)
+	if _, ok := d.storage.(deleteMarker); ok {
+		// NOTE: keys are marked deleted already,
+		// so objects are swept in background on the best-effort basis
+		select {
+		case d.backgroundSlots <- struct{}{}:
+			d.background.Add(1)
+			go func() {
+				defer func() {
+					<-d.backgroundSlots
+					d.background.Done()
+				}()
+				d.deleteJournaled(context.WithLogger(context.Background(), context.GetLogger(ctx)), deleteID)
+			}()
+			return nil
+		default:
+			// too many deletions are in background already
+		}
+	}
 
-	// Check that the dest is not a directory.
-	switch err := tx.QueryRow(checksFileExistsAndGetType, destPath).Scan(&isDir); err {
-	case sql.ErrNoRows:
-		parent := filepath.Dir(destPath)
-		var (
-			size int64
-			key  sql.NullString
-		)
+	d.deleteJournaled(ctx, deleteID)
+	return nil
+}
 
-		if err = tx.QueryRow(`DELETE FROM mfs WHERE path = $1 RETURNING size, key`, sourcePath).Scan(&size, &key); err != nil {
-			return err
+// deleteJournaled deletes keys journaled by deleteID from KV storage.
+// Keys are popped from the journal page by page, so memory is bounded
+// whatever the number of keys is. Failures are logged or journaled
+// according to the policy.
+func (d *driver) deleteJournaled(ctx context.Context, deleteID string) {
+	deleter := newKeyDeleter(ctx, d.storage, deleteWorkers, func(key string, err error) {
+		if d.deletePolicy == deletePolicyJournal {
+			d.journalFailedDelete(ctx, key)
 		}
+	})
 
-		_, err = tx.Exec(`INSERT INTO mfs (path, parent, dir, size, modtime, key, owner) VALUES ($1, $2, false, $3, now(), $4, $5)`, destPath, parent, size, key, owner)
+	for {
+		keys, err := d.popJournaled(ctx, d.cluster.DB(pgcluster.MASTER), deleteID, deletePageSize)
 		if err != nil {
-			return err
+			// NOTE: the rest of keys stays in the journal
+			context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"delete_id": deleteID, "error": err.Error()}).Error("unable to read journaled keys")
+			break
 		}
 
-	DIRECTORY_CREATION_LOOP:
-		for dir, filename := filepath.Dir(parent), filepath.Base(parent); !isRoot(filename) && filename != "."; dir, filename = filepath.Dir(dir), filepath.Base(dir) {
-			var (
-				fullpath = filepath.Join(dir, filename)
-				isDir    = false
-			)
-
-			switch err = tx.QueryRow(checksFileExistsAndGetType, fullpath).Scan(&isDir); err {
-			case nil:
-				if !isDir {
-					return fmt.Errorf("unable to rewrite file by directory: %s", destPath)
-				}
-				break DIRECTORY_CREATION_LOOP
-			case sql.ErrNoRows:
-				// pass
-			default:
-				return err
-			}
-
-			_, err = tx.Exec(insertMetaAboutFileOrDir, fullpath, dir, true, 0, nil, owner)
-			if err != nil {
-				return err
-			}
+		if len(keys) == 0 {
+			break
 		}
 
-	case nil:
-		if isDir {
-			return fmt.Errorf("destination `%s` is a directory. Moving directories is not supported", destPath)
+		for _, key := range keys {
+			deleter.add(key)
 		}
-		// TODO: looks ugly. Actually I can merge previous queries here by adding dir = true
-		// Delete source record and update dest record with some fields
-		_, err = tx.Exec(`
-			WITH t AS (DELETE FROM mfs WHERE path = $1 RETURNING size, key)
-			UPDATE mfs SET (size, modtime, key) = (t.size, now(), t.key)
-			FROM t WHERE mfs.path = $2;`, sourcePath, destPath)
-		if err != nil {
-			return err
+	}
+
+	deleter.wait()
+}
+
+// popJournaled removes at most limit keys journaled by deleteID and returns them
+func (d *driver) popJournaled(ctx context.Context, db querier, deleteID string, limit int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, d.q(`
+		DELETE FROM {mfs_delete_journal} WHERE ctid = ANY(ARRAY(
+			SELECT ctid FROM {mfs_delete_journal} WHERE delete_id = $1 LIMIT $2
+		)) RETURNING key`), deleteID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0, limit)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
 		}
-	default:
-		return err
+		keys = append(keys, key)
 	}
 
-	return tx.Commit()
+	return keys, rows.Err()
 }
 
-// Delete recursively deletes all objects stored at "path" and its subpaths.
-func (d *driver) Delete(ctx context.Context, path string) error {
-	tx, err := d.cluster.DB(pgcluster.MASTER).Begin()
+// deleteMeta deletes metainformation about "path" and its subpaths.
+// Keys of deleted files are journaled by deleteID unless other files still
+// refer to them. In strict mode journaled keys are deleted from KV storage
+// before commit instead.
+func (d *driver) deleteMeta(ctx context.Context, path string, deleteID string) error {
+	tx, err := d.cluster.DB(pgcluster.MASTER).BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	var (
-		// NOTE: intended to be used to mark files in MDS table
-		deleted []string
-
 		key   sql.NullString
 		isDir = false
 	)
 
 	if !isRoot(path) {
-		err = tx.QueryRow("DELETE FROM mfs WHERE mfs.path = $1 RETURNING mfs.key, mfs.dir", path).Scan(&key, &isDir)
-		switch err {
-		case nil:
-			if key.Valid {
-				deleted = append(deleted, key.String)
-			}
-		case sql.ErrNoRows:
-			return storagedriver.PathNotFoundError{Path: path}
-		default:
+		err = tx.QueryRowContext(ctx, d.q("DELETE FROM {mfs} WHERE {mfs}.path = $1 RETURNING {mfs}.key, {mfs}.dir"), path).Scan(&key, &isDir)
+		switch {
+		case err == sql.ErrNoRows:
+			return storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+		case err != nil:
 			return err
+		case key.Valid:
+			if _, err = tx.ExecContext(ctx, d.q(insertPendingDelete), key.String, deleteID); err != nil {
+				return err
+			}
 		}
 	}
 
 	// NOTE: scan for childs only if a directory is being deleted
 	if isDir {
 		// TODO: it's possible to add optimization for dir only RECURSIVE scanning
-		rows, err := tx.Query(`
+		_, err = tx.ExecContext(ctx, d.q(`
 			WITH RECURSIVE t(path) AS (
-			        SELECT path FROM mfs WHERE parent = $1
+			        SELECT path FROM {mfs} WHERE parent = $1
 			    UNION ALL
-			        SELECT mfs.path FROM t, mfs WHERE mfs.parent = t.path
+			        SELECT {mfs}.path FROM t, {mfs} WHERE {mfs}.parent = t.path
+			), deleted AS (
+			    DELETE FROM {mfs} USING t WHERE {mfs}.path = t.path RETURNING {mfs}.key
 			)
-			DELETE FROM mfs USING t WHERE mfs.path = t.path RETURNING mfs.key;
-		`, path)
+			INSERT INTO {mfs_delete_journal} (key, delete_id) SELECT DISTINCT key, $2 FROM deleted WHERE key IS NOT NULL;
+		`), path, deleteID)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
+	}
 
-		for rows.Next() {
-			if err := rows.Scan(&key); err != nil {
-				return err
+	return d.commitDelete(ctx, tx, deleteID)
+}
+
+// commitDelete commits deletion of files, which keys are journaled by deleteID
+func (d *driver) commitDelete(ctx context.Context, tx *sql.Tx, deleteID string) error {
+	// NOTE: files may share a KV object, which must be kept until the last
+	// of them is deleted. References are counted by a separate statement,
+	// so it sees files linked to the object by concurrently committed writers.
+	if _, err := tx.ExecContext(ctx, d.q(unjournalReferenced), deleteID); err != nil {
+		return err
+	}
+
+	if d.deletePolicy == deletePolicyStrict {
+		return d.commitStrict(ctx, tx, deleteID)
+	}
+
+	if marker, ok := d.storage.(deleteMarker); ok {
+		if err := marker.markDeleted(tx, deleteID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// commitStrict deletes keys journaled by deleteID from KV storage
+// and commits tx only if all of them have been deleted
+func (d *driver) commitStrict(ctx context.Context, tx *sql.Tx, deleteID string) error {
+	deleter := newKeyDeleter(ctx, d.storage, deleteWorkers, nil)
+	deleter.failFast = true
+	// NOTE: keys deleted before a failure are lost anyway
+	defer deleter.wait()
+
+	for {
+		keys, err := d.popJournaled(ctx, tx, deleteID, deletePageSize)
+		if err != nil {
+			if deleter.added() > 0 {
+				return permanentError{err}
 			}
+			return err
+		}
 
-			if key.Valid {
-				deleted = append(deleted, key.String)
+		if len(keys) == 0 {
+			break
+		}
+
+		for _, key := range keys {
+			if !deleter.add(key) {
+				// NOTE: strict deletion has failed already
+				_, err = deleter.wait()
+				return permanentError{err}
 			}
 		}
 	}
-	if err = tx.Commit(); err != nil {
-		return err
+
+	// Do not retry after KV storage has been touched.
+	if failures, err := deleter.wait(); failures > 0 {
+		return permanentError{err}
 	}
 
-	for _, key := range deleted {
-		if err := d.storage.Delete(ctx, key); err != nil {
-			context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"key": key, "error": err.Error()}).Error("KVStorage.Delete")
-		}
+	err := tx.Commit()
+	if err != nil && deleter.added() > 0 {
+		return permanentError{err}
 	}
+	return err
+}
 
-	// TODO: mark fields in MDS table before commit from `deleted` array
-	return nil
+// journalFailedDelete records a key which has not been deleted from KVStorage
+// to be retried later
+func (d *driver) journalFailedDelete(ctx context.Context, key string) {
+	if _, err := d.cluster.DB(pgcluster.MASTER).Exec(d.q(insertDeleteJournal), key); err != nil {
+		context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"key": key, "error": err.Error()}).Error("unable to journal failed delete")
+	}
 }
 
 // URLFor returns a URL which may be used to retrieve the content stored at
@@ -508,12 +1980,55 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 		return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
 	}
 
-	key, err := d.getKey(ctx, d.cluster.DB(pgcluster.MASTER), path)
+	expiry, err := parseURLForOptions(options)
 	if err != nil {
 		return "", err
 	}
 
-	return d.storage.URLFor(ctx, key, resolveRedirect)
+	var signer signedURLer
+	if !expiry.IsZero() {
+		var ok bool
+		if signer, ok = d.storage.(signedURLer); !ok {
+			return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+		}
+	}
+
+	key, err := d.getKey(ctx, d.hot(path), path)
+	switch err {
+	case nil:
+		if signer != nil {
+			return signer.SignedURLFor(ctx, key, expiry)
+		}
+		return d.storage.URLFor(ctx, key, resolveRedirect)
+	case errNoKVObject:
+		return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	default:
+		return "", err
+	}
+}
+
+// parseURLForOptions validates options of URLFor.
+// Non-zero expiry means that a signed URL is requested.
+func parseURLForOptions(options map[string]interface{}) (time.Time, error) {
+	var expiry time.Time
+	for name, value := range options {
+		switch name {
+		case "method":
+			if method, ok := value.(string); !ok || method != "GET" {
+				return expiry, storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+			}
+		case "expiry":
+			t, ok := value.(time.Time)
+			if !ok {
+				return expiry, fmt.Errorf("invalid expiry option %v", value)
+			}
+			expiry = t
+		default:
+			return expiry, fmt.Errorf("unsupported URLFor option %s", name)
+		}
+	}
+
+	return expiry, nil
 }
 
 // fileWriter provides an abstraction for an opened writable file-like object in
@@ -530,16 +2045,60 @@ type fileWriter struct {
 	path   string
 	key    string
 	append bool
+	// source is the KV object shared with other files in dedup mode.
+	// It's copied to key with appended data, as other files must not change.
+	source string
+	// digest is of the content before appending
+	digest sql.NullString
 
 	size int64
 
-	closed    bool
-	committed bool
-	cancelled bool
+	// NOTE: Write, Commit, Cancel and Close may be called concurrently,
+	// so the state is changed atomically
+	state  int32
+	closed int32
 
 	asyncWriterResult chan error
 }
 
+// states of a fileWriter. A writer is committed or cancelled once.
+const (
+	writerOpen int32 = iota
+	writerCommitted
+	writerCancelled
+)
+
+// checkOpen returns an error if the writer is closed, committed or cancelled
+func (fw *fileWriter) checkOpen() error {
+	if atomic.LoadInt32(&fw.closed) == 1 {
+		return fmt.Errorf("already closed")
+	}
+	return stateError(atomic.LoadInt32(&fw.state))
+}
+
+func stateError(state int32) error {
+	switch state {
+	case writerCommitted:
+		return fmt.Errorf("already committed")
+	case writerCancelled:
+		return fmt.Errorf("already cancelled")
+	default:
+		return nil
+	}
+}
+
+// finish moves an open writer to the state.
+// The error describes the state the writer has been moved to before.
+func (fw *fileWriter) finish(state int32) error {
+	if atomic.LoadInt32(&fw.closed) == 1 {
+		return fmt.Errorf("already closed")
+	}
+	if atomic.CompareAndSwapInt32(&fw.state, writerOpen, state) {
+		return nil
+	}
+	return stateError(atomic.LoadInt32(&fw.state))
+}
+
 func newFileWriter(ctx context.Context, driver *driver, path string, append bool) (storagedriver.FileWriter, error) {
 	rd, wr := io.Pipe()
 	fw := &fileWriter{
@@ -555,9 +2114,12 @@ func newFileWriter(ctx context.Context, driver *driver, path string, append bool
 	}
 
 	if append {
-		var key sql.NullString
+		var (
+			key   sql.NullString
+			isDir bool
+		)
 
-		err := fw.driver.cluster.DB(pgcluster.MASTER).QueryRow("SELECT size, key FROM mfs WHERE path=$1", path).Scan(&fw.size, &key)
+		err := fw.driver.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, fw.q("SELECT dir, size, key, digest FROM {mfs} WHERE path=$1"), path).Scan(&isDir, &fw.size, &key, &fw.digest)
 		switch err {
 		case sql.ErrNoRows:
 			fw.size = 0
@@ -565,16 +2127,38 @@ func newFileWriter(ctx context.Context, driver *driver, path string, append bool
 			// NOTE: distribution calls blob.Resume on non-created file
 			fw.append = false
 		case nil:
-			if !key.Valid {
+			if isDir {
 				return nil, fmt.Errorf("Trying to append to a directory file: %s", path)
 			}
+			if !key.Valid {
+				// NOTE: only zero-length files have no KV object,
+				// so there is nothing to append to
+				fw.key = generateKey()
+				fw.append = false
+				break
+			}
+			if driver.disableResumable {
+				// NOTE: the registry restarts the upload from scratch
+				return nil, storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+			}
 			fw.key = key.String
+			if driver.dedup {
+				shared, err := driver.claimAppend(ctx, path, fw.key)
+				if err != nil {
+					return nil, err
+				}
+				if shared {
+					fw.source, fw.key = fw.key, generateKey()
+				}
+			}
 		default:
 			return nil, err
 		}
 	} else {
 		fw.key = generateKey()
 	}
+
+	liveWriters.add(fw)
 	if fw.append {
 		go fw.handleAsyncWrite(fw.appendData)
 	} else {
@@ -590,23 +2174,43 @@ func newFileWriter(ctx context.Context, driver *driver, path string, append bool
 
 func (fw *fileWriter) handleAsyncWrite(fn func() error) {
 	err := fn()
+	liveWriters.remove(fw)
 	fw.asyncWriterResult <- err
 	close(fw.asyncWriterResult)
 }
 
 func (fw *fileWriter) Write(p []byte) (int, error) {
-	if fw.closed {
-		return 0, fmt.Errorf("already closed")
-	} else if fw.committed {
-		return 0, fmt.Errorf("already committed")
-	} else if fw.cancelled {
-		return 0, fmt.Errorf("already cancelled")
+	if err := fw.checkOpen(); err != nil {
+		return 0, err
 	}
 
 	context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
 		"path": fw.path, "append": fw.append,
 		"key": fw.key, "len": len(p)}).Debugf("Write")
 
+	if fw.driver.budget == nil {
+		return fw.write(p)
+	}
+
+	var written int
+	for len(p) > 0 {
+		n := fw.driver.budget.chunk(p)
+		if err := fw.driver.budget.acquire(fw.Context, n); err != nil {
+			return written, err
+		}
+		nn, err := fw.write(p[:n])
+		fw.driver.budget.release(n)
+		written += nn
+		if err != nil {
+			return written, err
+		}
+		p = p[nn:]
+	}
+
+	return written, nil
+}
+
+func (fw *fileWriter) write(p []byte) (int, error) {
 	nn, err := fw.wr.Write(p)
 	atomic.AddInt64(&fw.size, int64(nn))
 	bytesWrittenToStorage.Mark(int64(nn))
@@ -618,11 +2222,10 @@ func (fw *fileWriter) Write(p []byte) (int, error) {
 }
 
 func (fw *fileWriter) Close() error {
-	if fw.closed {
+	if !atomic.CompareAndSwapInt32(&fw.closed, 0, 1) {
 		return fmt.Errorf("already closed")
 	}
 
-	fw.closed = true
 	fw.wr.Close()
 	// the chan may be closed, but error is nil anyway in this case
 	if err := <-fw.asyncWriterResult; err != nil {
@@ -637,12 +2240,27 @@ func (fw *fileWriter) Size() int64 {
 }
 
 // Cancel removes any written content from this FileWriter.
+// Cancelling a cancelled writer is a no-op.
 func (fw *fileWriter) Cancel() error {
-	if fw.closed {
-		return fmt.Errorf("already closed")
+	if err := fw.finish(writerCancelled); err != nil {
+		if atomic.LoadInt32(&fw.state) == writerCancelled {
+			return nil
+		}
+		return err
 	}
-	fw.cancelled = true
 	fw.wr.CloseWithError(fmt.Errorf("cancelled"))
+	// wait for the async writer to abort.
+	// NOTE: the chan is closed then, so Close does not block
+	<-fw.asyncWriterResult
+
+	// NOTE: bytes streamed before cancellation may be kept by KV storage.
+	// The key of an appended file is in use, so it must be kept.
+	if !fw.append || fw.source != "" {
+		if err := fw.driver.storage.Delete(fw.Context, fw.key); err != nil {
+			context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
+				"key": fw.key, "error": err.Error()}).Warn("unable to delete KV object of a cancelled writer")
+		}
+	}
 
 	return nil
 }
@@ -651,13 +2269,61 @@ func (fw *fileWriter) appendData() error {
 	context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
 		"path": fw.path, "append": fw.append, "key": fw.key}).Debugf("appendData")
 
-	_, err := fw.driver.storage.Append(fw.Context, fw.key, fw.rd)
+	var (
+		appended int64
+		err      error
+	)
+	if fw.source != "" {
+		appended, err = fw.copyOnWrite()
+	} else {
+		appended, err = fw.driver.storage.Append(fw.Context, fw.key, fw.rd)
+	}
 	if err != nil {
 		fw.rd.CloseWithError(err)
 		return err
 	}
 
-	result, err := fw.driver.cluster.DB(pgcluster.MASTER).Exec("UPDATE mfs SET size = $1 WHERE (path = $2)", fw.Size(), fw.path)
+	// NOTE: the length of a stream may be unknown,
+	// so the backend is asked for the authoritative size
+	size, err := fw.driver.storage.Size(fw.Context, fw.key)
+	if err != nil {
+		context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
+			"path": fw.path, "key": fw.key, "error": err.Error()}).Warn("unable to get size from KVStorage")
+		size = fw.Size()
+	}
+
+	// NOTE: the digest is recomputed over the whole content only if it's
+	// needed right away, otherwise it's computed lazily by VerifyContent
+	var digest interface{}
+	switch {
+	case appended == 0:
+		digest = fw.digest
+	case fw.driver.dedup || fw.driver.verifyOnRead:
+		if d, err := fw.digestOf(fw.key); err == nil {
+			digest = d
+		} else {
+			context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
+				"path": fw.path, "key": fw.key, "error": err.Error()}).Warn("unable to compute digest of appended content")
+		}
+	}
+
+	// NOTE: data has been appended to KV storage already,
+	// so only the metainformation update is retried
+	var result sql.Result
+	err = fw.driver.retry(fw.Context, func() error {
+		tx, err := fw.driver.beginWrite(fw.Context)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// NOTE: the expiry is prolonged only if the TTL is set
+		if result, err = tx.ExecContext(fw.Context, fw.q("UPDATE {mfs} SET (size, digest, expires_at, key) = ($1, $2, COALESCE($4::timestamptz, expires_at), $5) WHERE (path = $3)"),
+			size, digest, fw.path, expiresAt(fw.Context), fw.key); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		return err
 	}
@@ -679,94 +2345,247 @@ func (fw *fileWriter) appendData() error {
 	return nil
 }
 
+// copyOnWrite stores the content of the shared KV object followed by
+// appended data under the own key of the file. It returns the number
+// of bytes appended.
+func (fw *fileWriter) copyOnWrite() (int64, error) {
+	current, err := fw.driver.storage.Get(fw.Context, fw.source, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer current.Close()
+
+	// NOTE: the declared size is of appended data only, so it's reset
+	ctx := context.WithValue(fw.Context, contentSize, int64(0))
+	copied := &countingReader{Reader: current}
+	stored, err := fw.driver.storage.Store(ctx, fw.key, io.MultiReader(copied, fw.rd))
+	return stored - copied.n, err
+}
+
+// countingReader counts bytes read
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// claimAppend prepares the file at path to be appended to in dedup mode.
+// It reports whether key is shared by other files, so it must be copied
+// on write. Otherwise the digest of the file is reset, so no file is linked
+// to key until the digest is set by the append.
+func (d *driver) claimAppend(ctx context.Context, path, key string) (bool, error) {
+	tx, err := d.beginWrite(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// NOTE: files being linked to the row lock it for share,
+	// so they are committed before other files of key are looked for
+	var ph interface{}
+	if err = tx.QueryRowContext(ctx, d.q("SELECT 1 FROM {mfs} WHERE path = $1 FOR UPDATE"), path).Scan(&ph); err != nil {
+		return false, err
+	}
+
+	var shared bool
+	if err = tx.QueryRowContext(ctx, d.q("SELECT EXISTS (SELECT 1 FROM {mfs} WHERE key = $1 AND path <> $2)"), key, path).Scan(&shared); err != nil {
+		return false, err
+	}
+	if !shared {
+		if _, err = tx.ExecContext(ctx, d.q("UPDATE {mfs} SET digest = NULL WHERE path = $1"), path); err != nil {
+			return false, err
+		}
+	}
+	return shared, tx.Commit()
+}
+
+// digestOf reads a KV object to compute the digest of its content
+func (fw *fileWriter) digestOf(key string) (string, error) {
+	reader, err := fw.driver.storage.Get(fw.Context, key, 0)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return contentDigest(hasher), nil
+}
+
 func (fw *fileWriter) storeData() error {
 	context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{"path": fw.path, "append": fw.append, "key": fw.key}).Debugf("storeData")
-	if _, err := fw.driver.storage.Store(fw.Context, fw.key, fw.rd); err != nil {
-		fw.rd.CloseWithError(err)
-		return err
+	var (
+		data         io.Reader = fw.rd
+		key, content interface{}
+		hasher       = sha256.New()
+	)
+
+	if fw.driver.zeroLengthBlobs != zeroLengthStore {
+		// read the first byte to find out if there is any content
+		var first [1]byte
+		switch _, err := io.ReadFull(fw.rd, first[:]); err {
+		case nil:
+			data = io.MultiReader(bytes.NewReader(first[:]), fw.rd)
+		case io.EOF:
+			data = nil
+		default:
+			fw.rd.CloseWithError(err)
+			return err
+		}
+	}
+
+	if data != nil {
+		if _, err := fw.driver.storage.Store(fw.Context, fw.key, io.TeeReader(data, hasher)); err != nil {
+			fw.rd.CloseWithError(err)
+			return err
+		}
+		key = fw.key
+	} else if fw.driver.zeroLengthBlobs == zeroLengthInline {
+		content = []byte{}
+	}
+
+	// NOTE: a truncated upload must not be visible as a complete file
+	if declared := getContentSize(fw.Context); declared > 0 && fw.Size() != declared {
+		if key != nil {
+			if err := fw.driver.storage.Delete(fw.Context, fw.key); err != nil {
+				context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
+					"key": fw.key, "error": err.Error()}).Warn("unable to delete a truncated KV object")
+			}
+		}
+		return fmt.Errorf("size mismatch for %s: %d bytes declared, %d written", fw.path, declared, fw.Size())
 	}
 
-	var owner = fw.Context.Value(auth.UserNameKey)
-	tx, err := fw.driver.cluster.DB(pgcluster.MASTER).Begin()
+	// NOTE: data has been stored to KV storage already,
+	// so only the metainformation update is retried
+	var (
+		digest = contentDigest(hasher)
+		linked bool
+	)
+	err := fw.driver.deleteBy(fw.Context, func(deleteID string) (err error) {
+		linked, err = fw.insertMeta(key, content, digest, deleteID)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+
+	if linked {
+		// NOTE: the file refers to a KV object with the same content,
+		// so the uploaded one is not needed
+		if err = fw.driver.storage.Delete(fw.Context, fw.key); err != nil {
+			context.GetLoggerWithFields(fw.Context, map[interface{}]interface{}{
+				"key": fw.key, "error": err.Error()}).Warn("unable to delete a duplicated KV object")
+		}
+	}
+
+	return nil
+}
+
+// insertMeta replaces metainformation about the file. In dedup mode the file
+// is linked to a KV object with the same content if there is any.
+// The key of the replaced file is journaled by deleteID.
+// It reports whether the file has been linked.
+func (fw *fileWriter) insertMeta(key, content interface{}, digest string, deleteID string) (bool, error) {
+	var owner = fw.driver.ownerOf(fw.Context)
+	tx, err := fw.driver.beginWrite(fw.Context)
+	if err != nil {
+		return false, err
+	}
 	defer tx.Rollback()
 
+	var linked bool
+	if fw.driver.dedup && key != nil {
+		// NOTE: the row is locked, so it can't be deleted until commit
+		var existing string
+		switch err = tx.QueryRowContext(fw.Context, fw.q(selectDuplicate), digest, fw.Size(), key).Scan(&existing); err {
+		case nil:
+			key, linked = existing, true
+		case sql.ErrNoRows:
+			// pass
+		default:
+			return false, err
+		}
+	}
+
 	// Check and insert file
 	var isDir = false
-	switch err = tx.QueryRow(checksFileExistsAndGetType, fw.path).Scan(&isDir); err {
+	switch err = tx.QueryRowContext(fw.Context, fw.q(checksFileExistsAndGetType), fw.path).Scan(&isDir); err {
 	case nil:
 		if isDir {
-			return fmt.Errorf("unable to rewrite directory by file: %s", fw.path)
+			return false, fmt.Errorf("unable to rewrite directory by file: %s", fw.path)
 		}
-		if _, err = tx.Exec("DELETE FROM mfs WHERE path=$1", fw.path); err != nil {
-			return err
+		var replaced sql.NullString
+		if err = tx.QueryRowContext(fw.Context, fw.q("DELETE FROM {mfs} WHERE path=$1 RETURNING key"), fw.path).Scan(&replaced); err != nil {
+			return false, err
+		}
+		if replaced.Valid {
+			if _, err = tx.ExecContext(fw.Context, fw.q(insertPendingDelete), replaced.String, deleteID); err != nil {
+				return false, err
+			}
 		}
 	case sql.ErrNoRows:
 		// pass
 	default:
-		return err
+		return false, err
 	}
 
 	// NOTE: may be update would be useful
 	// NOTE: calculate size properly
-	if _, err = tx.Exec(insertMetaAboutFileOrDir, fw.path, filepath.Dir(fw.path), false, fw.Size(), fw.key, owner); err != nil {
-		return err
+	if _, err = tx.ExecContext(fw.Context, fw.q(insertFile), fw.path, filepath.Dir(fw.path), fw.Size(), key, owner, content, digest, expiresAt(fw.Context)); err != nil {
+		return false, err
 	}
 
-	// TODO: wrap into a function
-	parent := filepath.Dir(fw.path)
-DIRECTORY_CREATION_LOOP:
-	for dir, filename := filepath.Dir(parent), filepath.Base(parent); filename != "/" && filename != "."; dir, filename = filepath.Dir(dir), filepath.Base(dir) {
-		var (
-			fullpath = filepath.Join(dir, filename)
-			isDir    = false
-		)
+	if err = fw.driver.createParentDirectories(fw.Context, tx, fw.path, owner); err != nil {
+		return false, err
+	}
 
-		switch err = tx.QueryRow(checksFileExistsAndGetType, fullpath).Scan(&isDir); err {
-		case nil:
-			if !isDir {
-				return fmt.Errorf("unable to rewrite file by directory: %s", fw.path)
-			}
-			break DIRECTORY_CREATION_LOOP
-		case sql.ErrNoRows:
-			// pass
-		default:
-			return err
-		}
+	if err = fw.driver.commitDelete(fw.Context, tx, deleteID); err != nil {
+		return false, err
+	}
 
-		_, err = tx.Exec(insertMetaAboutFileOrDir, fullpath, dir, true, 0, nil, owner)
-		if err != nil {
-			return err
-		}
+	return linked, nil
+}
+
+// beginWrite starts a transaction, which commit is acknowledged
+// according to the configured synchronous_commit level.
+// Commit of a FileWriter returns after that.
+func (d *driver) beginWrite(ctx context.Context) (*sql.Tx, error) {
+	tx, err := d.cluster.DB(pgcluster.MASTER).BeginTx(ctx, nil)
+	if err != nil || d.synchronousCommit == "" {
+		return tx, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return err
+	// NOTE: the level is validated on start, so it's safe to format it
+	if _, err = tx.ExecContext(ctx, "SET LOCAL synchronous_commit TO "+d.synchronousCommit); err != nil {
+		tx.Rollback()
+		return nil, err
 	}
 
-	return nil
+	return tx, nil
 }
 
 // Commit flushes all content written to this FileWriter and makes it
 // available for future calls to StorageDriver.GetContent and
 // StorageDriver.Reader.
 func (fw *fileWriter) Commit() error {
-	if fw.closed {
-		return fmt.Errorf("already closed")
-	} else if fw.committed {
-		return fmt.Errorf("already committed")
-	} else if fw.cancelled {
-		return fmt.Errorf("already cancelled")
+	if err := fw.finish(writerCommitted); err != nil {
+		return err
 	}
+	defer fw.wrote(fw.path)
 
-	fw.committed = true
 	fw.wr.Close()
 	// the chan may be closed, but error is nil anyway
 	if err := <-fw.asyncWriterResult; err != nil {
 		return err
 	}
 
+	blobSizes.Update(fw.Size())
 	return nil
 }
@@ -1,83 +1,2493 @@
 package pgdriver
 
 import (
+	"bytes"
+	stdcontext "context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"github.com/lib/pq"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
 	. "gopkg.in/check.v1"
 )
 
 // Hook up gocheck into the "go test" runner.
 func Test(t *testing.T) { TestingT(t) }
 
+func fromEnvOrDefault(envvar, defval string) string {
+	val := os.Getenv(envvar)
+	if val != "" {
+		return val
+	}
+	return defval
+}
+
+func testConfig() postgreDriverConfig {
+	URLs := fromEnvOrDefault("PG_URLS", "postgres://noxiouz@localhost:5432/distribution?sslmode=disable")
+
+	var idleConns = 5
+	return postgreDriverConfig{
+		MaxOpenConns: 10,
+		MaxIdleConns: &idleConns,
+		URLs:         strings.Split(URLs, " "),
+		Type:         "inmemory",
+	}
+}
+
+// dropTables drops tables used by the driver
+func dropTables(db *sql.DB, tables *sqlTables) error {
+	for _, table := range []string{tables.meta, tables.mds, tables.journal, tables.version, tables.routes, tables.blobs} {
+		if _, err := db.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetTables drops and creates tables used by the driver
+func resetTables(dataSource string) error {
+	return resetNamedTables(dataSource, "", "", "")
+}
+
+func resetNamedTables(dataSource, schema, metaTable, mdsTable string) error {
+	tables, err := newSQLTables(schema, metaTable, mdsTable)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open(driverSQLName, dataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = dropTables(db, tables); err != nil {
+		return err
+	}
+
+	return migrate(context.Background(), db, tables)
+}
+
 func init() {
 	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
-		fromEnvOrDefault := func(envvar, defval string) string {
-			val := os.Getenv(envvar)
-			if val != "" {
-				return val
-			}
-			return defval
+		cfg := testConfig()
+		if err := resetTables(cfg.URLs[0]); err != nil {
+			panic(err)
 		}
 
-		URLs := fromEnvOrDefault("PG_URLS", "postgres://noxiouz@localhost:5432/distribution?sslmode=disable")
+		return pgdriverNew(&cfg)
+	}, testsuites.NeverSkip)
 
-		var idleConns = 5
-		cfg := postgreDriverConfig{
-			MaxOpenConns: 10,
-			MaxIdleConns: &idleConns,
-			URLs:         strings.Split(URLs, " "),
-			Type:         "inmemory",
+	// the same suite against custom table names
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		cfg := testConfig()
+		cfg.MetaTable = "registry_mfs"
+		cfg.MDSTable = "registry_mds"
+		if err := resetNamedTables(cfg.URLs[0], "", cfg.MetaTable, cfg.MDSTable); err != nil {
+			panic(err)
 		}
 
-		db, err := sql.Open(driverSQLName, cfg.URLs[0])
-		if err != nil {
+		return pgdriverNew(&cfg)
+	}, testsuites.NeverSkip)
+
+	// the same suite against objects kept by PostgreSQL
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		cfg := testConfig()
+		cfg.Type = "postgres"
+		if err := resetTables(cfg.URLs[0]); err != nil {
 			panic(err)
 		}
-		defer db.Close()
 
-		clean := func() error {
-			if _, err := db.Exec(`DROP TABLE IF EXISTS mfs`); err != nil {
-				return err
+		return pgdriverNew(&cfg)
+	}, testsuites.NeverSkip)
+}
+
+// PGSuite tests driver specific features
+type PGSuite struct {
+	driver *Driver
+	ctx    context.Context
+}
+
+var _ = Suite(&PGSuite{})
+
+func (s *PGSuite) SetUpTest(c *C) {
+	cfg := testConfig()
+	c.Assert(resetTables(cfg.URLs[0]), IsNil)
+
+	var err error
+	s.driver, err = pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	s.ctx = context.Background()
+}
+
+func (s *PGSuite) TearDownTest(c *C) {
+	if s.driver != nil {
+		c.Assert(s.driver.Close(), IsNil)
+	}
+}
+
+func (s *PGSuite) TestOwner(c *C) {
+	ctx := context.WithValue(s.ctx, auth.UserNameKey, "noxiouz")
+	c.Assert(s.driver.PutContent(ctx, "/owner/file", []byte("data")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/owner/anonymous", []byte("data")), IsNil)
+
+	owner, err := s.driver.Owner(s.ctx, "/owner/file")
+	c.Assert(err, IsNil)
+	c.Assert(owner, Equals, "noxiouz")
+
+	owner, err = s.driver.Owner(s.ctx, "/owner/anonymous")
+	c.Assert(err, IsNil)
+	c.Assert(owner, Equals, "")
+
+	_, err = s.driver.Owner(s.ctx, "/owner/missing")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestOwnerFunc(c *C) {
+	type tenantKey struct{}
+	s.driver.SetOwnerFunc(func(ctx context.Context) string {
+		return context.GetStringValue(ctx, tenantKey{})
+	})
+	defer s.driver.SetOwnerFunc(nil)
+
+	ctx := context.WithValue(s.ctx, tenantKey{}, "tenant")
+	ctx = context.WithValue(ctx, auth.UserNameKey, "noxiouz")
+	c.Assert(s.driver.PutContent(ctx, "/ownerfunc/dir/file", []byte("data")), IsNil)
+
+	for _, path := range []string{"/ownerfunc/dir/file", "/ownerfunc/dir"} {
+		owner, err := s.driver.Owner(s.ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(owner, Equals, "tenant")
+	}
+}
+
+func (s *PGSuite) TestMoveDirectory(c *C) {
+	files := map[string]string{
+		"/src/a":       "a",
+		"/src/sub/b":   "b",
+		"/src/sub/c/d": "d",
+	}
+	for path, content := range files {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte(content)), IsNil)
+	}
+
+	keyBefore, err := s.driver.drv.getKey(s.ctx, s.driver.drv.cluster.DB(pgcluster.MASTER), "/src/sub/b")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.driver.Move(s.ctx, "/src", "/dst/moved"), IsNil)
+
+	for path, content := range files {
+		_, err := s.driver.Stat(s.ctx, path)
+		c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+
+		data, err := s.driver.GetContent(s.ctx, "/dst/moved"+strings.TrimPrefix(path, "/src"))
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, content)
+	}
+
+	keyAfter, err := s.driver.drv.getKey(s.ctx, s.driver.drv.cluster.DB(pgcluster.MASTER), "/dst/moved/sub/b")
+	c.Assert(err, IsNil)
+	c.Assert(keyAfter, Equals, keyBefore)
+
+	listing, err := s.driver.List(s.ctx, "/dst/moved/sub")
+	c.Assert(err, IsNil)
+	sort.Strings(listing)
+	c.Assert(listing, DeepEquals, []string{"/dst/moved/sub/b", "/dst/moved/sub/c"})
+
+	listing, err = s.driver.List(s.ctx, "/dst")
+	c.Assert(err, IsNil)
+	c.Assert(listing, DeepEquals, []string{"/dst/moved"})
+
+	c.Assert(s.driver.Move(s.ctx, "/dst/moved", "/dst/moved/inner"), NotNil)
+}
+
+func (s *PGSuite) TestMoveDirectorySubtree(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	paths := func() map[string]string {
+		rows, err := db.Query("SELECT path, parent FROM mfs")
+		c.Assert(err, IsNil)
+		defer rows.Close()
+		result := make(map[string]string)
+		for rows.Next() {
+			var path, parent string
+			c.Assert(rows.Scan(&path, &parent), IsNil)
+			result[path] = parent
+		}
+		c.Assert(rows.Err(), IsNil)
+		return result
+	}
+
+	// siblings sharing the prefix must stay
+	for _, path := range []string{"/tree/src/a", "/tree/src/x/y/z", "/tree/src_1/a", "/tree/srcb/a"} {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte("data")), IsNil)
+	}
+	before := paths()
+
+	c.Assert(s.driver.Move(s.ctx, "/tree/src", "/renamed/tree"), IsNil)
+	after := paths()
+
+	expected := make(map[string]string)
+	for path, parent := range before {
+		switch {
+		case path == "/tree/src":
+			expected["/renamed/tree"] = "/renamed"
+		case strings.HasPrefix(path, "/tree/src/"):
+			expected["/renamed/tree"+strings.TrimPrefix(path, "/tree/src")] = "/renamed/tree" + strings.TrimPrefix(parent, "/tree/src")
+		default:
+			expected[path] = parent
+		}
+	}
+	expected["/renamed"] = "/"
+	c.Assert(after, DeepEquals, expected)
+
+	// parents are consistent
+	for path, parent := range after {
+		if path == "/" {
+			continue
+		}
+		c.Assert(parent, Equals, filepath.Dir(path))
+		_, ok := after[parent]
+		c.Assert(ok || parent == "/", Equals, true, Commentf(path))
+	}
+
+	// the destination is a file
+	c.Assert(s.driver.Move(s.ctx, "/tree/srcb", "/tree/src_1/a"), ErrorMatches, "destination .* already exists.*")
+	c.Assert(paths(), DeepEquals, after)
+}
+
+// failingStorage wraps KVStorage to inject errors
+type failingStorage struct {
+	KVStorage
+	deleteErr error
+}
+
+func (f *failingStorage) Delete(ctx context.Context, key string) error {
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	return f.KVStorage.Delete(ctx, key)
+}
+
+func (s *PGSuite) testDeletePolicy(c *C, policy string) (int, error) {
+	s.driver.drv.deletePolicy = policy
+	s.driver.drv.storage = &failingStorage{
+		KVStorage: s.driver.drv.storage,
+		deleteErr: fmt.Errorf("injected failure"),
+	}
+
+	c.Assert(s.driver.PutContent(s.ctx, "/policy/file", []byte("data")), IsNil)
+	err := s.driver.Delete(s.ctx, "/policy")
+
+	var journaled int
+	c.Assert(s.driver.drv.cluster.DB(pgcluster.MASTER).QueryRow("SELECT count(*) FROM mfs_delete_journal").Scan(&journaled), IsNil)
+	return journaled, err
+}
+
+func (s *PGSuite) TestDeletePolicyBestEffort(c *C) {
+	journaled, err := s.testDeletePolicy(c, deletePolicyBestEffort)
+	c.Assert(err, IsNil)
+	c.Assert(journaled, Equals, 0)
+
+	_, err = s.driver.Stat(s.ctx, "/policy/file")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestDeletePolicyStrict(c *C) {
+	journaled, err := s.testDeletePolicy(c, deletePolicyStrict)
+	c.Assert(err, ErrorMatches, "injected failure")
+	c.Assert(journaled, Equals, 0)
+
+	data, err := s.driver.GetContent(s.ctx, "/policy/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+}
+
+func (s *PGSuite) TestDeletePolicyJournal(c *C) {
+	journaled, err := s.testDeletePolicy(c, deletePolicyJournal)
+	c.Assert(err, IsNil)
+	c.Assert(journaled, Equals, 1)
+
+	_, err = s.driver.Stat(s.ctx, "/policy/file")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestDirSizeAggregation(c *C) {
+	s.driver.drv.dirSizeAggregation = true
+
+	files := map[string]int{
+		"/sizes/a":       10,
+		"/sizes/sub/b":   100,
+		"/sizes/sub/c/d": 1000,
+		"/other/e":       10000,
+	}
+	for path, size := range files {
+		c.Assert(s.driver.PutContent(s.ctx, path, make([]byte, size)), IsNil)
+	}
+	c.Assert(s.driver.Delete(s.ctx, "/sizes/sub/c/d"), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/sizes/sub/c/f", make([]byte, 5)), IsNil)
+
+	for path, size := range map[string]int64{
+		"/sizes":       115,
+		"/sizes/sub":   105,
+		"/sizes/sub/c": 5,
+		"/sizes/a":     10,
+	} {
+		fi, err := s.driver.Stat(s.ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(fi.Size(), Equals, size)
+	}
+
+	c.Assert(s.driver.Delete(s.ctx, "/sizes/sub/c/f"), IsNil)
+	fi, err := s.driver.Stat(s.ctx, "/sizes/sub/c")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(0))
+
+	// sizes of nested and empty directories are summed up by a single query
+	infos, err := s.driver.StatMany(s.ctx, []string{"/sizes", "/sizes/sub", "/sizes/sub/c", "/other"})
+	c.Assert(err, IsNil)
+	for path, size := range map[string]int64{
+		"/sizes":       110,
+		"/sizes/sub":   100,
+		"/sizes/sub/c": 0,
+		"/other":       10000,
+	} {
+		c.Assert(infos[path].Size(), Equals, size, Commentf("%s", path))
+	}
+
+	// the root has no row, its size is of all files
+	fi, err = s.driver.Stat(s.ctx, "/")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+	c.Assert(fi.Size(), Equals, int64(10110))
+
+	// an empty directory has zero size
+	c.Assert(s.driver.PutContent(s.ctx, "/empty/file", []byte("data")), IsNil)
+	c.Assert(s.driver.Delete(s.ctx, "/empty/file"), IsNil)
+	fi, err = s.driver.Stat(s.ctx, "/empty")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+	c.Assert(fi.Size(), Equals, int64(0))
+
+	s.driver.drv.dirSizeAggregation = false
+	fi, err = s.driver.Stat(s.ctx, "/sizes")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(0))
+}
+
+func (s *PGSuite) listRecursive(c *C, path string) []string {
+	var result []string
+	children, err := s.driver.List(s.ctx, path)
+	c.Assert(err, IsNil)
+	for _, child := range children {
+		result = append(result, child)
+		fi, err := s.driver.Stat(s.ctx, child)
+		c.Assert(err, IsNil)
+		if fi.IsDir() {
+			result = append(result, s.listRecursive(c, child)...)
+		}
+	}
+	return result
+}
+
+func (s *PGSuite) TestWalk(c *C) {
+	for _, path := range []string{"/walk/a-b", "/walk/a/b/c", "/walk/a/d", "/walk/e/f", "/walk/g"} {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte(path)), IsNil)
+	}
+
+	var walked []string
+	err := s.driver.Walk(s.ctx, "/walk", func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			c.Assert(fi.Size(), Equals, int64(len(fi.Path())))
+		}
+		walked = append(walked, fi.Path())
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	expected := s.listRecursive(c, "/walk")
+	sort.Strings(expected)
+	sort.Strings(walked)
+	c.Assert(walked, DeepEquals, expected)
+
+	walked = nil
+	err = s.driver.Walk(s.ctx, "/walk", func(fi storagedriver.FileInfo) error {
+		walked = append(walked, fi.Path())
+		if fi.Path() == "/walk/a" {
+			return ErrSkipDir
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	sort.Strings(walked)
+	c.Assert(walked, DeepEquals, []string{"/walk/a", "/walk/a-b", "/walk/e", "/walk/e/f", "/walk/g"})
+
+	err = s.driver.Walk(s.ctx, "/missing", func(storagedriver.FileInfo) error { return nil })
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestBackendExpvar(c *C) {
+	backend := func() map[string]string {
+		var description map[string]string
+		v := expvar.Get("postgres_driver").(*expvar.Map).Get("backend")
+		c.Assert(json.Unmarshal([]byte(v.String()), &description), IsNil)
+		return description
+	}
+
+	c.Assert(backend(), DeepEquals, map[string]string{"type": "inmemory"})
+
+	cfg := testConfig()
+	cfg.Type = "mds"
+	cfg.Options = map[string]interface{}{
+		"host":       "mds.local",
+		"authheader": "Basic secret",
+		"namespace":  "registry",
+	}
+	d, err := pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	defer d.Close()
+
+	c.Assert(backend(), DeepEquals, map[string]string{
+		"type":      "mds",
+		"host":      "http://mds.local",
+		"namespace": "registry",
+	})
+}
+
+func (s *PGSuite) TestLazyDirectories(c *C) {
+	s.driver.drv.lazyDirectories = true
+
+	for _, path := range []string{"/lazy/a/b", "/lazy/a/c/d", "/lazy/e"} {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte(path)), IsNil)
+	}
+
+	var dirs int
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	c.Assert(db.QueryRow("SELECT count(*) FROM mfs WHERE dir").Scan(&dirs), IsNil)
+	c.Assert(dirs, Equals, 0)
+
+	fi, err := s.driver.Stat(s.ctx, "/lazy/a/c")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+
+	listing, err := s.driver.List(s.ctx, "/lazy")
+	c.Assert(err, IsNil)
+	sort.Strings(listing)
+	c.Assert(listing, DeepEquals, []string{"/lazy/a", "/lazy/e"})
+
+	listing, err = s.driver.List(s.ctx, "/lazy/a")
+	c.Assert(err, IsNil)
+	sort.Strings(listing)
+	c.Assert(listing, DeepEquals, []string{"/lazy/a/b", "/lazy/a/c"})
+
+	c.Assert(db.QueryRow("SELECT count(*) FROM mfs WHERE dir").Scan(&dirs), IsNil)
+	c.Assert(dirs, Equals, 3)
+
+	// directories are created by writers under materialized ones only
+	c.Assert(s.driver.PutContent(s.ctx, "/lazy/a/x/y/z", []byte("z")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/untouched/x/y", []byte("y")), IsNil)
+	c.Assert(db.QueryRow("SELECT count(*) FROM mfs WHERE dir").Scan(&dirs), IsNil)
+	c.Assert(dirs, Equals, 5)
+	listing, err = s.driver.List(s.ctx, "/lazy/a/x")
+	c.Assert(err, IsNil)
+	c.Assert(listing, DeepEquals, []string{"/lazy/a/x/y"})
+
+	// misses of files materialize nothing
+	_, err = s.driver.Stat(s.ctx, "/untouched/x/missing")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	c.Assert(db.QueryRow("SELECT count(*) FROM mfs WHERE dir").Scan(&dirs), IsNil)
+	c.Assert(dirs, Equals, 5)
+
+	// the root materializes all orphans once
+	materialized, err := s.driver.drv.materializeDirectories(s.ctx, "/")
+	c.Assert(err, IsNil)
+	c.Assert(materialized, Equals, true)
+	c.Assert(db.QueryRow("SELECT count(*) FROM mfs WHERE dir").Scan(&dirs), IsNil)
+	c.Assert(dirs, Equals, 7)
+	materialized, err = s.driver.drv.materializeDirectories(s.ctx, "/")
+	c.Assert(err, IsNil)
+	c.Assert(materialized, Equals, false)
+	listing, err = s.driver.List(s.ctx, "/")
+	c.Assert(err, IsNil)
+	sort.Strings(listing)
+	c.Assert(listing, DeepEquals, []string{"/lazy", "/untouched"})
+
+	// files and directories must not be overwritten by each other
+	c.Assert(s.driver.PutContent(s.ctx, "/lazy/e/f", []byte("f")), NotNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/lazy/new/g", []byte("g")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/lazy/new", []byte("new")), NotNil)
+
+	c.Assert(s.driver.Delete(s.ctx, "/lazy/new"), IsNil)
+	_, err = s.driver.Stat(s.ctx, "/lazy/new/g")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestAutoMigrate(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	c.Assert(dropTables(db, s.driver.drv.sqlTables), IsNil)
+
+	cfg := testConfig()
+	cfg.AutoMigrate = true
+	d, err := pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	defer d.Close()
+
+	c.Assert(d.PutContent(s.ctx, "/migrated/file", []byte("data")), IsNil)
+	data, err := d.GetContent(s.ctx, "/migrated/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+
+	// existing tables are kept
+	c.Assert(d.Migrate(s.ctx), IsNil)
+	_, err = d.Stat(s.ctx, "/migrated/file")
+	c.Assert(err, IsNil)
+
+	_, err = db.Exec("ALTER TABLE mfs DROP COLUMN owner")
+	c.Assert(err, IsNil)
+	c.Assert(d.Migrate(s.ctx), ErrorMatches, "incompatible schema: .*")
+}
+
+func (s *PGSuite) TestMigrateOldSchema(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	c.Assert(dropTables(db, s.driver.drv.sqlTables), IsNil)
+	// tables as they were created before versioning
+	for _, statement := range []string{
+		"CREATE TABLE mfs (path TEXT PRIMARY KEY, parent TEXT NOT NULL, dir BOOLEAN NOT NULL, size BIGINT NOT NULL, modtime TIME NOT NULL, key TEXT, owner TEXT)",
+		"CREATE TABLE mds (key TEXT PRIMARY KEY, mdsfileinfo TEXT NOT NULL, deleted BOOLEAN NOT NULL DEFAULT FALSE)",
+		"CREATE TABLE mfs_delete_journal (key TEXT NOT NULL, failed_at TIMESTAMP NOT NULL DEFAULT now())",
+		"INSERT INTO mfs VALUES ('/', '', true, 0, now(), NULL, NULL), ('/old', '/', false, 0, now(), NULL, NULL)",
+		// written in lazy mode
+		"INSERT INTO mfs VALUES ('/lazy/a/b', '/lazy/a', false, 0, now(), NULL, 'owner')",
+	} {
+		_, err := db.Exec(statement)
+		c.Assert(err, IsNil)
+	}
+
+	cfg := testConfig()
+	_, err := pgdriverNew(&cfg)
+	c.Assert(err, ErrorMatches, "schema version 0 does not match version .*: enable AutoMigrate .*")
+
+	// replicas start at once, but only one of them migrates
+	cfg.AutoMigrate = true
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			d, err := pgdriverNew(&cfg)
+			if err == nil {
+				d.Close()
 			}
-			if _, err := db.Exec(`DROP TABLE IF EXISTS mds`); err != nil {
-				return err
+			errs <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+
+	var versions, latest int
+	c.Assert(db.QueryRow("SELECT count(*), max(version) FROM mfs_schema_version").Scan(&versions, &latest), IsNil)
+	c.Assert(versions, Equals, schemaVersion)
+	c.Assert(latest, Equals, schemaVersion)
+
+	cfg.AutoMigrate = false
+	d, err := pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	defer d.Close()
+	fi, err := d.Stat(s.ctx, "/old")
+	c.Assert(err, IsNil)
+
+	// the date of migration is assumed for modtime of TIME
+	var modtimeType string
+	c.Assert(db.QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = 'mfs' AND column_name = 'modtime'").Scan(&modtimeType), IsNil)
+	c.Assert(modtimeType, Equals, "timestamp with time zone")
+	c.Assert(time.Since(fi.ModTime()) < 24*time.Hour, Equals, true, Commentf("%v", fi.ModTime()))
+
+	// parents of lazily written files are materialized
+	var parents []string
+	rows, err := db.Query("SELECT parent FROM mfs WHERE path IN ('/lazy', '/lazy/a') AND dir AND owner = 'owner' ORDER BY path")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	for rows.Next() {
+		var parent string
+		c.Assert(rows.Scan(&parent), IsNil)
+		parents = append(parents, parent)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(parents, DeepEquals, []string{"/", "/lazy"})
+}
+
+func (s *PGSuite) TestSchema(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	_, err := db.Exec("DROP SCHEMA IF EXISTS tenant CASCADE")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("CREATE SCHEMA tenant")
+	c.Assert(err, IsNil)
+
+	cfg := testConfig()
+	cfg.Schema = "tenant"
+	cfg.AutoMigrate = true
+	d, err := pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	defer d.Close()
+
+	c.Assert(d.PutContent(s.ctx, "/tenant/file", []byte("data")), IsNil)
+	data, err := d.GetContent(s.ctx, "/tenant/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+
+	listing, err := d.List(s.ctx, "/tenant")
+	c.Assert(err, IsNil)
+	c.Assert(listing, DeepEquals, []string{"/tenant/file"})
+
+	// public tables are not touched
+	_, err = s.driver.Stat(s.ctx, "/tenant/file")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	c.Assert(d.Delete(s.ctx, "/tenant"), IsNil)
+	var count int
+	c.Assert(db.QueryRow("SELECT count(*) FROM tenant.mfs").Scan(&count), IsNil)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *PGSuite) TestSkipIdenticalContent(c *C) {
+	s.driver.drv.skipIdentical = true
+	storage := s.driver.drv.storage.(*inmemory)
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+
+	c.Assert(s.driver.PutContent(s.ctx, "/identical/file", []byte("data")), IsNil)
+	keyBefore, err := s.driver.drv.getKey(s.ctx, db, "/identical/file")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("UPDATE mfs SET modtime = now() - interval '1 hour' WHERE path = '/identical/file'")
+	c.Assert(err, IsNil)
+	fi, err := s.driver.Stat(s.ctx, "/identical/file")
+	c.Assert(err, IsNil)
+	modtime := fi.ModTime()
+
+	storage.Lock()
+	objects := len(storage.data)
+	storage.Unlock()
+
+	c.Assert(s.driver.PutContent(s.ctx, "/identical/file", []byte("data")), IsNil)
+
+	storage.Lock()
+	c.Assert(storage.data, HasLen, objects)
+	storage.Unlock()
+	keyAfter, err := s.driver.drv.getKey(s.ctx, db, "/identical/file")
+	c.Assert(err, IsNil)
+	c.Assert(keyAfter, Equals, keyBefore)
+	fi, err = s.driver.Stat(s.ctx, "/identical/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.ModTime() != modtime, Equals, true)
+
+	// different content is rewritten
+	c.Assert(s.driver.PutContent(s.ctx, "/identical/file", []byte("other")), IsNil)
+	keyAfter, err = s.driver.drv.getKey(s.ctx, db, "/identical/file")
+	c.Assert(err, IsNil)
+	c.Assert(keyAfter, Not(Equals), keyBefore)
+	data, err := s.driver.GetContent(s.ctx, "/identical/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "other")
+}
+
+func (s *PGSuite) TestSharedKeySurvivesDelete(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+
+	for _, policy := range []string{deletePolicyBestEffort, deletePolicyStrict, deletePolicyJournal} {
+		s.driver.drv.deletePolicy = policy
+		root := "/shared-" + policy
+
+		c.Assert(s.driver.PutContent(s.ctx, root+"/a", []byte("data")), IsNil)
+		key, err := s.driver.drv.getKey(s.ctx, db, root+"/a")
+		c.Assert(err, IsNil)
+		// another reference to the same key, e.g. left by Move
+		_, err = db.Exec("INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES ($1, $2, false, 4, now(), $3)",
+			root+"/dir/b", root+"/dir", key)
+		c.Assert(err, IsNil)
+		c.Assert(s.driver.PutContent(s.ctx, root+"/dir/c", []byte("other")), IsNil)
+
+		exists := func() bool {
+			storage.Lock()
+			defer storage.Unlock()
+			_, ok := storage.data[key]
+			return ok
+		}
+
+		c.Assert(s.driver.Delete(s.ctx, root+"/a"), IsNil)
+		c.Assert(exists(), Equals, true, Commentf(policy))
+		data, err := s.driver.GetContent(s.ctx, root+"/dir/b")
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "data")
+
+		c.Assert(s.driver.Delete(s.ctx, root+"/dir"), IsNil)
+		c.Assert(exists(), Equals, false, Commentf(policy))
+	}
+}
+
+func (s *PGSuite) TestDedup(c *C) {
+	s.driver.drv.dedup = true
+	storage := s.driver.drv.storage.(*inmemory)
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+
+	c.Assert(s.driver.PutContent(s.ctx, "/dedup/a", []byte("layer")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/dedup/b", []byte("layer")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/dedup/c", []byte("other")), IsNil)
+
+	keyA, err := s.driver.drv.getKey(s.ctx, db, "/dedup/a")
+	c.Assert(err, IsNil)
+	keyB, err := s.driver.drv.getKey(s.ctx, db, "/dedup/b")
+	c.Assert(err, IsNil)
+	c.Assert(keyB, Equals, keyA)
+
+	storage.Lock()
+	c.Assert(storage.data, HasLen, 2)
+	storage.Unlock()
+
+	// the shared object survives until the last file is deleted
+	c.Assert(s.driver.Delete(s.ctx, "/dedup/a"), IsNil)
+	data, err := s.driver.GetContent(s.ctx, "/dedup/b")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "layer")
+
+	c.Assert(s.driver.Delete(s.ctx, "/dedup"), IsNil)
+	storage.Lock()
+	c.Assert(storage.data, HasLen, 0)
+	storage.Unlock()
+}
+
+func (s *PGSuite) TestOverwriteDeletesReplacedKey(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	objects := func() int {
+		storage.Lock()
+		defer storage.Unlock()
+		return len(storage.data)
+	}
+
+	c.Assert(s.driver.PutContent(s.ctx, "/overwrite/a", []byte("a")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/overwrite/a", []byte("aa")), IsNil)
+	c.Assert(objects(), Equals, 1)
+
+	c.Assert(s.driver.PutContent(s.ctx, "/overwrite/b", []byte("b")), IsNil)
+	c.Assert(s.driver.Move(s.ctx, "/overwrite/b", "/overwrite/a"), IsNil)
+	c.Assert(objects(), Equals, 1)
+	data, err := s.driver.GetContent(s.ctx, "/overwrite/a")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "b")
+
+	// a replaced object shared with other files is kept
+	s.driver.drv.dedup = true
+	c.Assert(s.driver.PutContent(s.ctx, "/overwrite/c", []byte("b")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/overwrite/a", []byte("new")), IsNil)
+	c.Assert(objects(), Equals, 2)
+	data, err = s.driver.GetContent(s.ctx, "/overwrite/c")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "b")
+
+	var journaled int
+	c.Assert(s.driver.drv.cluster.DB(pgcluster.MASTER).QueryRow("SELECT count(*) FROM mfs_delete_journal").Scan(&journaled), IsNil)
+	c.Assert(journaled, Equals, 0)
+}
+
+func (s *PGSuite) TestDedupAppend(c *C) {
+	s.driver.drv.dedup = true
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+
+	appendTo := func(path, data string) {
+		fw, err := s.driver.Writer(s.ctx, path, true)
+		c.Assert(err, IsNil)
+		_, err = fw.Write([]byte(data))
+		c.Assert(err, IsNil)
+		c.Assert(fw.Commit(), IsNil)
+		c.Assert(fw.Close(), IsNil)
+	}
+	content := func(path string) string {
+		data, err := s.driver.GetContent(s.ctx, path)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	c.Assert(s.driver.PutContent(s.ctx, "/dedup/a", []byte("layer")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/dedup/b", []byte("layer")), IsNil)
+	keyA, err := s.driver.drv.getKey(s.ctx, db, "/dedup/a")
+	c.Assert(err, IsNil)
+
+	// the shared object is copied on write, the other file is unchanged
+	appendTo("/dedup/b", "more")
+	c.Assert(content("/dedup/a"), Equals, "layer")
+	c.Assert(content("/dedup/b"), Equals, "layermore")
+	keyB, err := s.driver.drv.getKey(s.ctx, db, "/dedup/b")
+	c.Assert(err, IsNil)
+	c.Assert(keyB, Not(Equals), keyA)
+
+	// an object of a single file is appended in place
+	appendTo("/dedup/b", "!")
+	c.Assert(content("/dedup/b"), Equals, "layermore!")
+	key, err := s.driver.drv.getKey(s.ctx, db, "/dedup/b")
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, keyB)
+
+	// no file is linked to an object being appended to
+	fw, err := s.driver.Writer(s.ctx, "/dedup/b", true)
+	c.Assert(err, IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/dedup/c", []byte("layermore!")), IsNil)
+	keyC, err := s.driver.drv.getKey(s.ctx, db, "/dedup/c")
+	c.Assert(err, IsNil)
+	c.Assert(keyC, Not(Equals), keyB)
+	_, err = fw.Write([]byte("?"))
+	c.Assert(err, IsNil)
+	c.Assert(fw.Commit(), IsNil)
+	c.Assert(fw.Close(), IsNil)
+	c.Assert(content("/dedup/c"), Equals, "layermore!")
+	c.Assert(content("/dedup/a"), Equals, "layer")
+}
+
+func (s *PGSuite) TestInlineRange(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	_, err := db.Exec("INSERT INTO mfs (path, parent, dir, size, modtime, inline) VALUES ('/inline/file', '/inline', false, 10, now(), $1)", []byte("0123456789"))
+	c.Assert(err, IsNil)
+
+	// any access to KV storage panics
+	storage := s.driver.drv.storage
+	s.driver.drv.storage = struct{ KVStorage }{}
+	defer func() { s.driver.drv.storage = storage }()
+
+	rd, err := s.driver.Reader(s.ctx, "/inline/file", 4)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rd)
+	rd.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "456789")
+
+	data, err = s.driver.drv.getInline(s.ctx, "/inline/file", 2, 3)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "234")
+
+	data, err = s.driver.drv.getInline(s.ctx, "/inline/file", 8, 5)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "89")
+
+	_, err = s.driver.Reader(s.ctx, "/inline/file", 11)
+	c.Assert(err, FitsTypeOf, storagedriver.InvalidOffsetError{})
+}
+
+func (s *PGSuite) TestZeroLengthBlobs(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	storage := s.driver.drv.storage.(*inmemory)
+
+	for _, mode := range []string{zeroLengthStore, zeroLengthInline, zeroLengthFlag} {
+		s.driver.drv.zeroLengthBlobs = mode
+		path := "/zero/" + mode
+
+		storage.Lock()
+		objects := len(storage.data)
+		storage.Unlock()
+
+		c.Assert(s.driver.PutContent(s.ctx, path, nil), IsNil)
+
+		data, err := s.driver.GetContent(s.ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(data, HasLen, 0)
+
+		rd, err := s.driver.Reader(s.ctx, path, 0)
+		c.Assert(err, IsNil)
+		data, err = ioutil.ReadAll(rd)
+		rd.Close()
+		c.Assert(err, IsNil)
+		c.Assert(data, HasLen, 0)
+
+		fi, err := s.driver.Stat(s.ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(fi.Size(), Equals, int64(0))
+
+		var (
+			key    sql.NullString
+			inline []byte
+		)
+		c.Assert(db.QueryRow("SELECT key, inline FROM mfs WHERE path=$1", path).Scan(&key, &inline), IsNil)
+
+		storage.Lock()
+		created := len(storage.data) - objects
+		storage.Unlock()
+
+		switch mode {
+		case zeroLengthStore:
+			c.Assert(key.Valid, Equals, true)
+			c.Assert(created, Equals, 1)
+		case zeroLengthInline:
+			c.Assert(key.Valid, Equals, false)
+			c.Assert(inline, NotNil)
+			c.Assert(created, Equals, 0)
+		case zeroLengthFlag:
+			c.Assert(key.Valid, Equals, false)
+			c.Assert(inline, IsNil)
+			c.Assert(created, Equals, 0)
+		}
+
+		// non-empty content still goes to KV storage
+		c.Assert(s.driver.PutContent(s.ctx, path+"-data", []byte("data")), IsNil)
+		data, err = s.driver.GetContent(s.ctx, path+"-data")
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "data")
+	}
+}
+
+func (s *PGSuite) TestCheckConsistency(c *C) {
+	for _, path := range []string{"/consistency/a", "/consistency/b", "/consistency/c"} {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte(path)), IsNil)
+	}
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	keyOf := func(path string) string {
+		var key string
+		c.Assert(db.QueryRow("SELECT key FROM mfs WHERE path = $1", path).Scan(&key), IsNil)
+		return key
+	}
+
+	// a is consistent, b refers to a deleted row and c has no row at all
+	_, err := db.Exec("INSERT INTO mds (key, mdsfileinfo) VALUES ($1, '{}')", keyOf("/consistency/a"))
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO mds (key, mdsfileinfo, deleted) VALUES ($1, '{}', true)", keyOf("/consistency/b"))
+	c.Assert(err, IsNil)
+	// orphans and a deleted row, which is not an orphan
+	_, err = db.Exec("INSERT INTO mds (key, mdsfileinfo, deleted) VALUES ('orphan1', '{}', false), ('orphan2', '{}', false), ('gone', '{}', true)")
+	c.Assert(err, IsNil)
+
+	report, err := s.driver.CheckConsistency(s.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(report.DanglingFiles, Equals, int64(2))
+	sort.Strings(report.DanglingFileKeys)
+	expected := []string{keyOf("/consistency/b"), keyOf("/consistency/c")}
+	sort.Strings(expected)
+	c.Assert(report.DanglingFileKeys, DeepEquals, expected)
+
+	c.Assert(report.OrphanedMDS, Equals, int64(2))
+	sort.Strings(report.OrphanedMDSKeys)
+	c.Assert(report.OrphanedMDSKeys, DeepEquals, []string{"orphan1", "orphan2"})
+}
+
+// useFakeMDS replaces KV storage of the driver by MDS backend served by handler
+func (s *PGSuite) useFakeMDS(c *C, handler http.HandlerFunc) *httptest.Server {
+	ts := httptest.NewServer(handler)
+
+	u, err := url.Parse(ts.URL)
+	c.Assert(err, IsNil)
+	port, err := strconv.Atoi(u.Port())
+	c.Assert(err, IsNil)
+
+	st, err := newMDSBinStorage(s.driver.drv.cluster, s.driver.drv.sqlTables, map[string]interface{}{
+		"host":       "http://" + u.Hostname(),
+		"uploadport": port,
+		"readport":   port,
+		"namespace":  "registry",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.driver.drv.storage.Close(), IsNil)
+	s.driver.drv.storage = st
+
+	return ts
+}
+
+func (s *PGSuite) TestDeleteMarksMDSRows(c *C) {
+	// MDS is unavailable, so HTTP deletes fail
+	var requests int32
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer ts.Close()
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	for _, path := range []string{"/marked/a", "/marked/dir/b"} {
+		key := generateKey()
+		_, err := db.Exec("INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES ($1, $2, false, 4, now(), $3)", path, filepath.Dir(path), key)
+		c.Assert(err, IsNil)
+		_, err = db.Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ($1, '{"key": "registry/1"}')`, key)
+		c.Assert(err, IsNil)
+	}
+	_, err := db.Exec("INSERT INTO mfs (path, parent, dir, size, modtime) VALUES ('/marked', '/', true, 0, now()), ('/marked/dir', '/marked', true, 0, now())")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.driver.Delete(s.ctx, "/marked"), IsNil)
+
+	var alive int
+	c.Assert(db.QueryRow("SELECT count(*) FROM mds WHERE NOT deleted").Scan(&alive), IsNil)
+	c.Assert(alive, Equals, 0)
+
+	// objects are deleted in background, which is waited for by Close
+	s.driver.drv.background.Wait()
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+	c.Assert(s.driver.drv.backgroundSlots, HasLen, 0)
+}
+
+func (s *PGSuite) TestAppendProxyErrors(c *C) {
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer ts.Close()
+
+	_, err := s.driver.drv.cluster.DB(pgcluster.MASTER).Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ('proxied', '{"key": "1/proxied", "size": 4}')`)
+	c.Assert(err, IsNil)
+
+	before := mdsAppendProxyErrors.Get("registry")
+	_, err = s.driver.drv.storage.Append(s.ctx, "proxied", strings.NewReader("data"))
+	c.Assert(err, NotNil)
+
+	after := mdsAppendProxyErrors.Get("registry").(*expvar.Int).Value()
+	if before != nil {
+		after -= before.(*expvar.Int).Value()
+	}
+	c.Assert(after, Equals, int64(1))
+}
+
+func (s *PGSuite) TestSweepDeleted(c *C) {
+	var requests int32
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.Contains(r.URL.Path, "bad") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	defer ts.Close()
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	for _, key := range []string{"good1", "good2", "good3", "bad1", "bad2"} {
+		_, err := db.Exec(`INSERT INTO mds (key, mdsfileinfo, deleted) VALUES ($1, $2, true)`, key, fmt.Sprintf(`{"key": "1/%s"}`, key))
+		c.Assert(err, IsNil)
+	}
+	_, err := db.Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ('alive', '{"key": "1/alive"}')`)
+	c.Assert(err, IsNil)
+
+	swept, failed, err := s.driver.SweepDeleted(s.ctx, 2)
+	c.Assert(err, IsNil)
+	c.Assert(swept, Equals, 3)
+	c.Assert(failed, Equals, 2)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(5))
+
+	rows, err := db.Query("SELECT key FROM mds ORDER BY key")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		c.Assert(rows.Scan(&key), IsNil)
+		keys = append(keys, key)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(keys, DeepEquals, []string{"alive", "bad1", "bad2"})
+}
+
+func (s *PGSuite) TestPurgeNamespace(c *C) {
+	var requests int32
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.Contains(r.URL.Path, "bad") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+	defer ts.Close()
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	keys := []string{"bad1"}
+	for i := 0; i < deletePageSize+10; i++ {
+		keys = append(keys, fmt.Sprintf("good%05d", i))
+	}
+	for _, key := range keys {
+		_, err := db.Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ($1, $2)`, key, fmt.Sprintf(`{"key": "1/%s"}`, key))
+		c.Assert(err, IsNil)
+	}
+	_, err := db.Exec(`INSERT INTO mds (key, mdsfileinfo, deleted, purged) VALUES ('purged', '{"key": "1/purged"}', true, true)`)
+	c.Assert(err, IsNil)
+
+	_, err = s.driver.PurgeNamespace(s.ctx, 0, nil)
+	c.Assert(err, NotNil)
+
+	var reports []PurgeProgress
+	progress, err := s.driver.PurgeNamespace(s.ctx, 4, func(p PurgeProgress) {
+		reports = append(reports, p)
+	})
+	c.Assert(err, FitsTypeOf, PurgeError{})
+	c.Assert(err.(PurgeError).Errors, HasLen, 1)
+	c.Assert(err.(PurgeError).Errors["bad1"], NotNil)
+	c.Assert(progress, Equals, PurgeProgress{Deleted: int64(len(keys) - 1), Failed: 1})
+	c.Assert(reports, HasLen, 2)
+	c.Assert(reports[1], Equals, progress)
+	// purged rows are skipped
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(len(keys)))
+
+	var left []string
+	rows, err := db.Query("SELECT key FROM mds WHERE NOT purged")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		c.Assert(rows.Scan(&key), IsNil)
+		left = append(left, key)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(left, DeepEquals, []string{"bad1"})
+}
+
+func (s *PGSuite) TestBlobSizesExpvar(c *C) {
+	blobSizes.Clear()
+	for i, size := range []int{1, 10, 100, 1000, 10000} {
+		c.Assert(s.driver.PutContent(s.ctx, fmt.Sprintf("/sizes/%d", i), make([]byte, size)), IsNil)
+	}
+
+	var stats struct {
+		Count      int64
+		Min        int64
+		Max        int64
+		Percentile map[string]float64
+	}
+	v := expvar.Get("postgres_driver").(*expvar.Map).Get("blob_sizes")
+	c.Assert(json.Unmarshal([]byte(v.String()), &stats), IsNil)
+
+	c.Assert(stats.Count, Equals, int64(5))
+	c.Assert(stats.Min, Equals, int64(1))
+	c.Assert(stats.Max, Equals, int64(10000))
+	c.Assert(stats.Percentile["50%"], Equals, float64(100))
+	c.Assert(stats.Percentile["99%"], Equals, float64(10000))
+}
+
+func (s *PGSuite) TestLatencyExpvar(c *C) {
+	count := func(name string) int64 {
+		var stats struct {
+			Count int64
+		}
+		v := expvar.Get("postgres_driver").(*expvar.Map).Get(name)
+		c.Assert(json.Unmarshal([]byte(v.String()), &stats), IsNil)
+		return stats.Count
+	}
+
+	put, get := count("put_content_latency"), count("get_content_latency")
+	c.Assert(s.driver.PutContent(s.ctx, "/latency/file", []byte("data")), IsNil)
+	_, err := s.driver.GetContent(s.ctx, "/latency/file")
+	c.Assert(err, IsNil)
+	c.Assert(count("put_content_latency"), Equals, put+1)
+	c.Assert(count("get_content_latency"), Equals, get+1)
+
+	// failed calls are timed too
+	_, err = s.driver.GetContent(s.ctx, "/latency/missing")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	c.Assert(count("get_content_latency"), Equals, get+2)
+}
+
+func (s *PGSuite) TestInFlightWritersExpvar(c *C) {
+	before := inFlightWriters.Value()
+
+	fw, err := s.driver.Writer(s.ctx, "/inflight/file", false)
+	c.Assert(err, IsNil)
+	_, err = fw.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	c.Assert(inFlightWriters.Value(), Equals, before+1)
+
+	c.Assert(fw.Commit(), IsNil)
+	c.Assert(fw.Close(), IsNil)
+	c.Assert(inFlightWriters.Value(), Equals, before)
+}
+
+func (s *PGSuite) TestMetricsSnapshot(c *C) {
+	before := s.driver.MetricsSnapshot()
+
+	c.Assert(s.driver.PutContent(s.ctx, "/snapshot/file", []byte("data")), IsNil)
+	_, err := s.driver.Stat(s.ctx, "/snapshot/file")
+	c.Assert(err, IsNil)
+	_, err = s.driver.Stat(s.ctx, "/snapshot/missing")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	after := s.driver.MetricsSnapshot()
+	c.Assert(after.BytesWritten-before.BytesWritten, Equals, int64(4))
+	c.Assert(after.InFlightWriters, Equals, before.InFlightWriters)
+	c.Assert(after.Latencies["PutContent"].Count-before.Latencies["PutContent"].Count, Equals, int64(1))
+	c.Assert(after.Latencies["Stat"].Count-before.Latencies["Stat"].Count, Equals, int64(2))
+	c.Assert(after.Latencies["Stat"].P99 > 0, Equals, true)
+	c.Assert(after.KVErrors, HasLen, 4)
+}
+
+func (s *PGSuite) TestOldestWriterExpvar(c *C) {
+	fw, err := s.driver.Writer(s.ctx, "/oldest/file", false)
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+
+	var age float64
+	v := expvar.Get("postgres_driver").(*expvar.Map).Get("oldest_writer_age_seconds")
+	c.Assert(json.Unmarshal([]byte(v.String()), &age), IsNil)
+	c.Assert(age >= 0.1, Equals, true)
+
+	c.Assert(fw.Commit(), IsNil)
+	c.Assert(fw.Close(), IsNil)
+	c.Assert(s.driver.MetricsSnapshot().OldestWriterAge, Equals, time.Duration(0))
+}
+
+func (s *PGSuite) TestURLForOptions(c *C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/urlfor/file", []byte("data")), IsNil)
+
+	_, err := s.driver.URLFor(s.ctx, "/urlfor/file", map[string]interface{}{"method": "GET"})
+	c.Assert(err, IsNil)
+
+	_, err = s.driver.URLFor(s.ctx, "/urlfor/file", map[string]interface{}{"method": "POST"})
+	c.Assert(err, FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+
+	_, err = s.driver.URLFor(s.ctx, "/urlfor/file", map[string]interface{}{"unknown": true})
+	c.Assert(err, ErrorMatches, "unsupported URLFor option unknown")
+
+	_, err = s.driver.URLFor(s.ctx, "/urlfor/file", map[string]interface{}{"expiry": "tomorrow"})
+	c.Assert(err, ErrorMatches, "invalid expiry option .*")
+
+	// inmemory storage can not sign URLs
+	_, err = s.driver.URLFor(s.ctx, "/urlfor/file", map[string]interface{}{"expiry": time.Now().Add(time.Minute)})
+	c.Assert(err, FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+}
+
+func (s *PGSuite) TestSignedURLFor(c *C) {
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/downloadinfo-registry/1/blob")
+		fmt.Fprint(w, `<download-info><host>storage01.mds</host><path>/rdisk/blob</path><ts>5a1b2c3d</ts><region>1</region><s>signature</s></download-info>`)
+	})
+	defer ts.Close()
+	s.driver.drv.storage.(*mdsBinStorage).SignedURLTTL = time.Hour
+
+	key := generateKey()
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	_, err := db.Exec("INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES ('/signed', '/', false, 4, now(), $1)", key)
+	c.Assert(err, IsNil)
+	_, err = db.Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ($1, '{"key": "1/blob"}')`, key)
+	c.Assert(err, IsNil)
+
+	u, err := s.driver.URLFor(s.ctx, "/signed", map[string]interface{}{"method": "GET", "expiry": time.Now().Add(time.Minute)})
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, "http://storage01.mds/rdisk/blob?ts=5a1b2c3d&sign=signature")
+
+	_, err = s.driver.URLFor(s.ctx, "/signed", map[string]interface{}{"expiry": time.Now().Add(2 * time.Hour)})
+	c.Assert(err, ErrorMatches, "expiry .* exceeds lifetime of signed URLs .*")
+}
+
+// sizedStorage wraps KVStorage to report a fixed size of objects
+type sizedStorage struct {
+	KVStorage
+	size int64
+}
+
+func (s *sizedStorage) Size(ctx context.Context, key string) (int64, error) {
+	return s.size, nil
+}
+
+func (s *PGSuite) TestAppendAuthoritativeSize(c *C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/append/file", []byte("data")), IsNil)
+	s.driver.drv.storage = &sizedStorage{KVStorage: s.driver.drv.storage, size: 42}
+
+	fw, err := s.driver.Writer(s.ctx, "/append/file", true)
+	c.Assert(err, IsNil)
+	_, err = fw.Write([]byte("more"))
+	c.Assert(err, IsNil)
+	c.Assert(fw.Commit(), IsNil)
+	c.Assert(fw.Close(), IsNil)
+
+	fi, err := s.driver.Stat(s.ctx, "/append/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(42))
+}
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) TestValidateConns(c *C) {
+	intPtr := func(n int) *int { return &n }
+
+	for _, t := range []struct {
+		maxOpen int
+		maxIdle *int
+		err     string
+	}{
+		{0, nil, ""},
+		{10, nil, ""},
+		{10, intPtr(5), ""},
+		{10, intPtr(10), ""},
+		{0, intPtr(100), ""},
+		{10, intPtr(0), ""},
+		{5, intPtr(10), `MaxIdleConns \(10\) must not exceed MaxOpenConns \(5\)`},
+		{-1, nil, "MaxOpenConns must not be negative: -1"},
+		{10, intPtr(-1), "MaxIdleConns must not be negative: -1"},
+	} {
+		cfg := postgreDriverConfig{MaxOpenConns: t.maxOpen, MaxIdleConns: t.maxIdle}
+		err := cfg.validate()
+		if t.err == "" {
+			c.Check(err, IsNil, Commentf("%d %v", t.maxOpen, t.maxIdle))
+		} else {
+			c.Check(err, ErrorMatches, t.err)
+		}
+	}
+}
+
+func (s *ConfigSuite) TestConnectTimeout(c *C) {
+	cfg := postgreDriverConfig{
+		// unroutable address
+		URLs:           []string{"postgres://noxiouz@10.255.255.1:5432/distribution?sslmode=disable"},
+		ConnectTimeout: 200 * time.Millisecond,
+		Type:           "inmemory",
+	}
+
+	start := time.Now()
+	_, err := pgdriverNew(&cfg)
+	c.Assert(err, NotNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true, Commentf("took %v", time.Since(start)))
+}
+
+func (s *ConfigSuite) TestUnavailableBackends(c *C) {
+	_, err := newKVStorage(nil, nil, "elliptics", nil)
+	c.Assert(err, Equals, errEllipticsUnavailable)
+
+	_, err = newKVStorage(nil, nil, "unknown", nil)
+	c.Assert(err, ErrorMatches, "Unsupported binary storage backend unknown")
+}
+
+func (s *PGSuite) TestCompactMDS(c *C) {
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	_, err := db.Exec(`INSERT INTO mds (key, mdsfileinfo, deleted, purged) VALUES
+		('reclaimable1', '{}', true, true),
+		('reclaimable2', '{}', true, true),
+		('referred', '{}', true, true),
+		('unswept', '{}', true, false),
+		('alive', '{}', false, false)`)
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES ('/referred', '/', false, 0, now(), 'referred')")
+	c.Assert(err, IsNil)
+
+	// another process is compacting
+	tx, err := db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('compact:mds'))")
+	c.Assert(err, IsNil)
+	_, err = s.driver.CompactMDS(s.ctx, false)
+	c.Assert(err, Equals, ErrCompactionInProgress)
+	c.Assert(tx.Rollback(), IsNil)
+
+	removed, err := s.driver.CompactMDS(s.ctx, true)
+	c.Assert(err, IsNil)
+	c.Assert(removed, Equals, int64(2))
+
+	rows, err := db.Query("SELECT key FROM mds ORDER BY key")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		c.Assert(rows.Scan(&key), IsNil)
+		keys = append(keys, key)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(keys, DeepEquals, []string{"alive", "referred", "unswept"})
+}
+
+func (s *PGSuite) TestSynchronousCommit(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	setStandbyNames := func(names string) {
+		_, err := db.Exec(fmt.Sprintf("ALTER SYSTEM SET synchronous_standby_names TO '%s'", names))
+		c.Assert(err, IsNil)
+		_, err = db.Exec("SELECT pg_reload_conf()")
+		c.Assert(err, IsNil)
+		// NOTE: configuration is reloaded asynchronously
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// the standby never acknowledges anything
+	setStandbyNames("mock_standby")
+	defer setStandbyNames("")
+
+	s.driver.drv.synchronousCommit = "local"
+	c.Assert(s.driver.PutContent(s.ctx, "/sync/local", []byte("data")), IsNil)
+
+	s.driver.drv.synchronousCommit = "remote_apply"
+	committed := make(chan error, 1)
+	go func() {
+		committed <- s.driver.PutContent(s.ctx, "/sync/remote", []byte("data"))
+	}()
+
+	select {
+	case err := <-committed:
+		c.Fatalf("Commit must wait for the standby: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// NOTE: waiting transactions are released once no synchronous standby is configured
+	setStandbyNames("")
+	select {
+	case err := <-committed:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Commit must be released")
+	}
+}
+
+func (s *PGSuite) TestDeleteLargeTree(c *C) {
+	const files = 20000
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	for _, policy := range []string{deletePolicyBestEffort, deletePolicyStrict} {
+		root := "/large-" + policy
+		_, err := db.Exec(`INSERT INTO mfs (path, parent, dir, size, modtime) VALUES
+			($1, '/', true, 0, now()), ($1 || '/dir', $1, true, 0, now())`, root)
+		c.Assert(err, IsNil)
+		_, err = db.Exec(`INSERT INTO mfs (path, parent, dir, size, modtime, key)
+			SELECT $1 || '/dir/' || i, $1 || '/dir', false, 0, now(), $1 || i FROM generate_series(1, $2) AS i`, root, files)
+		c.Assert(err, IsNil)
+
+		// keys are streamed to workers, so only a bounded number of them is in flight
+		st := &countingStorage{KVStorage: s.driver.drv.storage}
+		s.driver.drv.storage = st
+		s.driver.drv.deletePolicy = policy
+
+		c.Assert(s.driver.Delete(s.ctx, root), IsNil)
+		c.Assert(st.deleted, Equals, int64(files), Commentf(policy))
+		c.Assert(st.peak <= deleteWorkers, Equals, true, Commentf(policy))
+
+		var pending int
+		c.Assert(db.QueryRow("SELECT count(*) FROM mfs_delete_journal").Scan(&pending), IsNil)
+		c.Assert(pending, Equals, 0, Commentf(policy))
+
+		s.driver.drv.storage = st.KVStorage
+	}
+}
+
+func (s *PGSuite) TestResolvePath(c *C) {
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+	m := s.driver.drv.storage.(*mdsBinStorage)
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	_, err := db.Exec(`INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES
+		('/resolve', '/', true, 0, now(), NULL),
+		('/resolve/file', '/resolve', false, 4, now(), 'alive'),
+		('/resolve/deleted', '/resolve', false, 4, now(), 'deleted'),
+		('/resolve/orphan', '/resolve', false, 4, now(), 'missing'),
+		('/resolve/inline', '/resolve', false, 0, now(), NULL)`)
+	c.Assert(err, IsNil)
+	_, err = db.Exec(`INSERT INTO mds (key, mdsfileinfo, deleted) VALUES
+		('alive', '{"key": "1/alive", "size": 4}', false), ('deleted', '{"key": "1/deleted", "size": 4}', true)`)
+	c.Assert(err, IsNil)
+
+	meta, err := m.resolvePath(s.ctx, "/resolve/file")
+	c.Assert(err, IsNil)
+	c.Assert(*meta, Equals, metaInfo{Key: "1/alive", Size: 4})
+
+	for _, path := range []string{"/resolve", "/resolve/missing", "/resolve/deleted", "/resolve/orphan"} {
+		_, err = m.resolvePath(s.ctx, path)
+		c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{}, Commentf(path))
+	}
+
+	_, err = m.resolvePath(s.ctx, "/resolve/inline")
+	c.Assert(err, Equals, errNoKVObject)
+}
+
+// benchmarkResolve compares resolving a file to MDS metainformation
+// by one joined query and by two queries
+func benchmarkResolve(b *testing.B, joined bool) {
+	cfg := testConfig()
+	if err := resetTables(cfg.URLs[0]); err != nil {
+		b.Fatal(err)
+	}
+
+	d, err := pgdriverNew(&cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	st, err := newMDSBinStorage(d.drv.cluster, d.drv.sqlTables, map[string]interface{}{"host": "localhost"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	m := st.(*mdsBinStorage)
+
+	db := d.drv.cluster.DB(pgcluster.MASTER)
+	if _, err = db.Exec(`INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES ('/bench', '/', false, 4, now(), 'bench')`); err != nil {
+		b.Fatal(err)
+	}
+	if _, err = db.Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ('bench', '{"key": "1/bench", "size": 4}')`); err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if joined {
+			_, err = m.resolvePath(ctx, "/bench")
+		} else {
+			var key string
+			if key, err = d.drv.getKey(ctx, db, "/bench"); err == nil {
+				_, err = m.getMDSMetaInfo(ctx, key)
 			}
-			return nil
 		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
 
-		if err := clean(); err != nil {
-			panic(err)
+func BenchmarkResolveJoined(b *testing.B) { benchmarkResolve(b, true) }
+
+func BenchmarkResolveTwoQueries(b *testing.B) { benchmarkResolve(b, false) }
+
+func (s *PGSuite) TestTruncatedUpload(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	storage.Lock()
+	objects := len(storage.data)
+	storage.Unlock()
+
+	ctx := setContentSize(s.ctx, 10)
+	w, err := s.driver.Writer(ctx, "/truncated/file", false)
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Commit(), ErrorMatches, "size mismatch.*10 bytes declared, 4 written")
+
+	_, err = s.driver.Stat(s.ctx, "/truncated/file")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	storage.Lock()
+	c.Assert(storage.data, HasLen, objects)
+	storage.Unlock()
+}
+
+func (s *PGSuite) TestVerifyContent(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+
+	c.Assert(s.driver.PutContent(s.ctx, "/verify/file", []byte("data")), IsNil)
+	c.Assert(s.driver.VerifyContent(s.ctx, "/verify/file"), IsNil)
+
+	// the digest of appended content is computed lazily over the whole content
+	w, err := s.driver.Writer(s.ctx, "/verify/file", true)
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("more"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Commit(), IsNil)
+	var unknown sql.NullString
+	c.Assert(db.QueryRow("SELECT digest FROM mfs WHERE path = '/verify/file'").Scan(&unknown), IsNil)
+	c.Assert(unknown.Valid, Equals, false)
+	c.Assert(s.driver.VerifyContent(s.ctx, "/verify/file"), IsNil)
+	var digest string
+	c.Assert(db.QueryRow("SELECT digest FROM mfs WHERE path = '/verify/file'").Scan(&digest), IsNil)
+	c.Assert(digest, Equals, "sha256:39046213b04423ced40ff162cefd811ffd4a4f939083b1bf151ca47f7f864705")
+
+	// nothing appended keeps the digest
+	w, err = s.driver.Writer(s.ctx, "/verify/file", true)
+	c.Assert(err, IsNil)
+	c.Assert(w.Commit(), IsNil)
+	c.Assert(db.QueryRow("SELECT digest FROM mfs WHERE path = '/verify/file'").Scan(&digest), IsNil)
+	c.Assert(digest, Equals, "sha256:39046213b04423ced40ff162cefd811ffd4a4f939083b1bf151ca47f7f864705")
+
+	key, err := s.driver.drv.getKey(s.ctx, db, "/verify/file")
+	c.Assert(err, IsNil)
+	storage.Lock()
+	storage.data[key] = []byte("datamorx")
+	storage.Unlock()
+
+	err = s.driver.VerifyContent(s.ctx, "/verify/file")
+	c.Assert(err, FitsTypeOf, ContentMismatchError{})
+	c.Assert(err.(ContentMismatchError).Expected, Equals, digest)
+
+	// corrupted content is served unless VerifyOnRead is set
+	data, err := s.driver.GetContent(s.ctx, "/verify/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "datamorx")
+
+	s.driver.drv.verifyOnRead = true
+	_, err = s.driver.GetContent(s.ctx, "/verify/file")
+	c.Assert(err, FitsTypeOf, ContentMismatchError{})
+
+	reader, err := s.driver.Reader(s.ctx, "/verify/file", 0)
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(reader)
+	reader.Close()
+	c.Assert(err, FitsTypeOf, ContentMismatchError{})
+
+	// a part of content can't be verified
+	reader, err = s.driver.Reader(s.ctx, "/verify/file", 4)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadAll(reader)
+	reader.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "morx")
+
+	// an unknown digest is computed lazily unless in dedup mode
+	_, err = db.Exec("UPDATE mfs SET digest = NULL WHERE path = '/verify/file'")
+	c.Assert(err, IsNil)
+	s.driver.drv.dedup = true
+	c.Assert(s.driver.VerifyContent(s.ctx, "/verify/file"), Equals, ErrUnknownDigest)
+	s.driver.drv.dedup = false
+	_, err = s.driver.GetContent(s.ctx, "/verify/file")
+	c.Assert(err, IsNil)
+	c.Assert(s.driver.VerifyContent(s.ctx, "/verify/file"), IsNil)
+	c.Assert(db.QueryRow("SELECT digest FROM mfs WHERE path = '/verify/file'").Scan(&digest), IsNil)
+	c.Assert(digest, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("datamorx"))))
+
+	c.Assert(s.driver.VerifyContent(s.ctx, "/verify/missing"), FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestGetContentRange(c *C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/range/file", []byte("0123456789")), IsNil)
+
+	for _, t := range []struct {
+		offset, length int64
+		content        string
+	}{
+		{0, 4, "0123"},
+		{3, 4, "3456"},
+		{0, 10, "0123456789"},
+		// partial tails
+		{8, 4, "89"},
+		{0, 100, "0123456789"},
+		{10, 4, ""},
+		{5, 0, ""},
+	} {
+		data, err := s.driver.GetContentRange(s.ctx, "/range/file", t.offset, t.length)
+		c.Assert(err, IsNil, Commentf("%d:%d", t.offset, t.length))
+		c.Assert(string(data), Equals, t.content, Commentf("%d:%d", t.offset, t.length))
+	}
+
+	_, err := s.driver.GetContentRange(s.ctx, "/range/file", 11, 1)
+	c.Assert(err, FitsTypeOf, storagedriver.InvalidOffsetError{})
+	_, err = s.driver.GetContentRange(s.ctx, "/range/file", -1, 1)
+	c.Assert(err, FitsTypeOf, storagedriver.InvalidOffsetError{})
+	_, err = s.driver.GetContentRange(s.ctx, "/range/file", 0, -1)
+	c.Assert(err, ErrorMatches, "length must not be negative.*")
+	_, err = s.driver.GetContentRange(s.ctx, "/range", 0, 1)
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	_, err = s.driver.GetContentRange(s.ctx, "/range/missing", 0, 1)
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+// leakyStorage keeps bytes stored before a failure of data like a remote backend
+type leakyStorage struct {
+	*inmemory
+}
+
+func (l leakyStorage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	buff := new(bytes.Buffer)
+	_, err := io.Copy(buff, data)
+	l.Lock()
+	l.data[key] = buff.Bytes()
+	l.Unlock()
+	return int64(buff.Len()), err
+}
+
+func (s *PGSuite) TestCancelDeletesKey(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	s.driver.drv.storage = leakyStorage{storage}
+
+	c.Assert(s.driver.PutContent(s.ctx, "/cancel/appended", []byte("data")), IsNil)
+	storage.Lock()
+	objects := len(storage.data)
+	storage.Unlock()
+
+	w, err := s.driver.Writer(s.ctx, "/cancel/file", false)
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("partial"))
+	c.Assert(err, IsNil)
+	key := w.(*fileWriter).key
+	c.Assert(w.Cancel(), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	storage.Lock()
+	_, ok := storage.data[key]
+	c.Assert(ok, Equals, false)
+	c.Assert(storage.data, HasLen, objects)
+	storage.Unlock()
+
+	// the existing object of an appended file is kept
+	w, err = s.driver.Writer(s.ctx, "/cancel/appended", true)
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("more"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Cancel(), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	data, err := s.driver.GetContent(s.ctx, "/cancel/appended")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+}
+
+// NOTE: the test is meaningful with -race
+func (s *PGSuite) TestConcurrentWriteCommit(c *C) {
+	w, err := s.driver.Writer(s.ctx, "/race/file", false)
+	c.Assert(err, IsNil)
+
+	var (
+		wg      sync.WaitGroup
+		written int64
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n, err := w.Write([]byte("data"))
+				atomic.AddInt64(&written, int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(w.Commit(), IsNil)
+	wg.Wait()
+
+	_, err = w.Write([]byte("data"))
+	c.Assert(err, ErrorMatches, "already committed")
+	c.Assert(w.Commit(), ErrorMatches, "already committed")
+	c.Assert(w.Cancel(), ErrorMatches, "already committed")
+	c.Assert(w.Close(), IsNil)
+	c.Assert(w.Close(), ErrorMatches, "already closed")
+
+	fi, err := s.driver.Stat(s.ctx, "/race/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, atomic.LoadInt64(&written))
+	c.Assert(w.Size(), Equals, fi.Size())
+
+	// cancellation is idempotent
+	w, err = s.driver.Writer(s.ctx, "/race/cancelled", false)
+	c.Assert(err, IsNil)
+	c.Assert(w.Cancel(), IsNil)
+	c.Assert(w.Cancel(), IsNil)
+	c.Assert(w.Commit(), ErrorMatches, "already cancelled")
+	c.Assert(w.Close(), IsNil)
+}
+
+func (s *PGSuite) TestExists(c *C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/exists/dir/file", []byte("data")), IsNil)
+
+	for path, expected := range map[string]bool{
+		"/":                 true,
+		"/exists/dir/file":  true,
+		"/exists/dir":       true,
+		"/exists":           true,
+		"/exists/missing":   false,
+		"/exists/dir/file/": false,
+	} {
+		found, err := s.driver.Exists(s.ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(found, Equals, expected, Commentf(path))
+	}
+}
+
+func (s *PGSuite) TestParentDirectories(c *C) {
+	deep := "/deep"
+	for i := 0; i < 20; i++ {
+		deep += fmt.Sprintf("/%d", i)
+	}
+	c.Assert(s.driver.PutContent(s.ctx, deep+"/file", []byte("data")), IsNil)
+
+	for dir := deep; dir != "/"; dir = filepath.Dir(dir) {
+		fi, err := s.driver.Stat(s.ctx, dir)
+		c.Assert(err, IsNil, Commentf(dir))
+		c.Assert(fi.IsDir(), Equals, true)
+		listing, err := s.driver.List(s.ctx, filepath.Dir(dir))
+		c.Assert(err, IsNil)
+		c.Assert(listing, DeepEquals, []string{dir})
+	}
+
+	// existing directories are kept
+	c.Assert(s.driver.PutContent(s.ctx, deep+"/a/b/file", []byte("data")), IsNil)
+	listing, err := s.driver.List(s.ctx, deep)
+	c.Assert(err, IsNil)
+	sort.Strings(listing)
+	c.Assert(listing, DeepEquals, []string{deep + "/a", deep + "/file"})
+
+	// an ancestor is a file
+	err = s.driver.PutContent(s.ctx, deep+"/file/a/b", []byte("data"))
+	c.Assert(err, ErrorMatches, "unable to rewrite file by directory: .*")
+	_, err = s.driver.Stat(s.ctx, deep+"/file/a")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	c.Assert(s.driver.Move(s.ctx, deep+"/a/b/file", deep+"/file/c"), ErrorMatches, "unable to rewrite file by directory: .*")
+}
+
+func (s *PGSuite) TestConcurrentParentDirectories(c *C) {
+	const uploads = 32
+	errs := make(chan error)
+	for i := 0; i < uploads; i++ {
+		go func(i int) {
+			errs <- s.driver.PutContent(s.ctx, fmt.Sprintf("/shared/new/prefix/file%d", i), []byte("data"))
+		}(i)
+	}
+	for i := 0; i < uploads; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+
+	listing, err := s.driver.List(s.ctx, "/shared/new/prefix")
+	c.Assert(err, IsNil)
+	c.Assert(listing, HasLen, uploads)
+
+	var dirs int
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	c.Assert(db.QueryRow("SELECT count(*) FROM mfs WHERE path IN ('/shared', '/shared/new', '/shared/new/prefix') AND dir").Scan(&dirs), IsNil)
+	c.Assert(dirs, Equals, 3)
+}
+
+func (s *PGSuite) TestListPage(c *C) {
+	var expected []string
+	for i := 0; i < 7; i++ {
+		path := fmt.Sprintf("/page/file%d", i)
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte("data")), IsNil)
+		expected = append(expected, path)
+	}
+
+	var (
+		listing []string
+		cursor  string
+		pages   int
+	)
+	for {
+		page, next, err := s.driver.ListPage(s.ctx, "/page", cursor, 3)
+		c.Assert(err, IsNil)
+		c.Assert(len(page) <= 3, Equals, true)
+		listing = append(listing, page...)
+		pages++
+		if next == "" {
+			break
 		}
+		cursor = next
+	}
+	c.Assert(pages, Equals, 3)
+	c.Assert(listing, DeepEquals, expected)
 
-		// create tables
-		if _, err := db.Exec(`CREATE TABLE mds (
-					KEY 	TEXT PRIMARY KEY,
-					MDSFILEINFO TEXT NOT NULL,
-					DELETED BOOLEAN NOT NULL DEFAULT FALSE
-			    );`); err != nil {
-			panic(err)
+	// the last page is full
+	page, next, err := s.driver.ListPage(s.ctx, "/page", expected[3], 3)
+	c.Assert(err, IsNil)
+	c.Assert(page, DeepEquals, expected[4:])
+	c.Assert(next, Equals, "")
+
+	page, next, err = s.driver.ListPage(s.ctx, "/page", expected[6], 3)
+	c.Assert(err, IsNil)
+	c.Assert(page, HasLen, 0)
+	c.Assert(next, Equals, "")
+
+	_, _, err = s.driver.ListPage(s.ctx, "/page", "", 0)
+	c.Assert(err, ErrorMatches, "limit must be positive.*")
+	_, _, err = s.driver.ListPage(s.ctx, "/missing", "", 3)
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	all, err := s.driver.List(s.ctx, "/page")
+	c.Assert(err, IsNil)
+	c.Assert(all, DeepEquals, expected)
+}
+
+func (s *PGSuite) TestListFunc(c *C) {
+	for i := 0; i < 5; i++ {
+		c.Assert(s.driver.PutContent(s.ctx, fmt.Sprintf("/listfunc/file%d", i), []byte("data")), IsNil)
+	}
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+
+	var listing []string
+	c.Assert(s.driver.ListFunc(s.ctx, "/listfunc", func(path string) error {
+		listing = append(listing, path)
+		return nil
+	}), IsNil)
+	c.Assert(listing, HasLen, 5)
+
+	// early termination
+	listing = nil
+	c.Assert(s.driver.ListFunc(s.ctx, "/listfunc", func(path string) error {
+		listing = append(listing, path)
+		if len(listing) == 2 {
+			return ErrStopList
 		}
+		return nil
+	}), IsNil)
+	c.Assert(listing, DeepEquals, []string{"/listfunc/file0", "/listfunc/file1"})
+	c.Assert(db.Stats().InUse, Equals, 0)
 
-		if _, err := db.Exec(`CREATE TABLE mfs (
-						PATH 	TEXT PRIMARY KEY UNIQUE,
-						PARENT	TEXT NOT NULL,
-						DIR		BOOLEAN NOT NULL,
-						SIZE 	INTEGER NOT NULL,
-						MODTIME TIME NOT NULL,
-						KEY   TEXT,
-						OWNER   TEXT
-					);`); err != nil {
-			panic(err)
+	// errors are propagated
+	failure := fmt.Errorf("failure")
+	var calls int
+	c.Assert(s.driver.ListFunc(s.ctx, "/listfunc", func(path string) error {
+		calls++
+		return failure
+	}), Equals, failure)
+	c.Assert(calls, Equals, 1)
+	c.Assert(db.Stats().InUse, Equals, 0)
+
+	c.Assert(s.driver.ListFunc(s.ctx, "/missing", func(string) error { return nil }), FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestCreateDir(c *C) {
+	c.Assert(s.driver.CreateDir(s.ctx, "/mkdir/a/b/c"), IsNil)
+	for _, dir := range []string{"/mkdir", "/mkdir/a", "/mkdir/a/b", "/mkdir/a/b/c"} {
+		fi, err := s.driver.Stat(s.ctx, dir)
+		c.Assert(err, IsNil, Commentf(dir))
+		c.Assert(fi.IsDir(), Equals, true)
+	}
+	listing, err := s.driver.List(s.ctx, "/mkdir/a/b/c")
+	c.Assert(err, IsNil)
+	c.Assert(listing, HasLen, 0)
+
+	// existing directories are kept
+	c.Assert(s.driver.PutContent(s.ctx, "/mkdir/a/file", []byte("data")), IsNil)
+	c.Assert(s.driver.CreateDir(s.ctx, "/mkdir/a"), IsNil)
+	c.Assert(s.driver.CreateDir(s.ctx, "/mkdir/a/b/d"), IsNil)
+	listing, err = s.driver.List(s.ctx, "/mkdir/a")
+	c.Assert(err, IsNil)
+	c.Assert(listing, DeepEquals, []string{"/mkdir/a/b", "/mkdir/a/file"})
+
+	// files are not rewritten
+	c.Assert(s.driver.CreateDir(s.ctx, "/mkdir/a/file"), ErrorMatches, "unable to rewrite file by directory: .*")
+	c.Assert(s.driver.CreateDir(s.ctx, "/mkdir/a/file/x"), ErrorMatches, "unable to rewrite file by directory: .*")
+	fi, err := s.driver.Stat(s.ctx, "/mkdir/a/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, false)
+	_, err = s.driver.Stat(s.ctx, "/mkdir/a/file/x")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	c.Assert(s.driver.CreateDir(s.ctx, "/"), IsNil)
+}
+
+func (s *PGSuite) TestCompactMetadata(c *C) {
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	_, err := db.Exec(`INSERT INTO mds (key, mdsfileinfo, deleted, purged) VALUES
+		('removed1', '{}', false, false),
+		('removed2', '{}', false, false),
+		('referred', '{}', false, false),
+		('unswept', '{}', true, false)`)
+	c.Assert(err, IsNil)
+	_, err = db.Exec(`INSERT INTO mfs (path, parent, dir, size, modtime, key) VALUES
+		('/removed1', '/', false, 0, now(), 'removed1'),
+		('/removed2', '/', false, 0, now(), 'removed2'),
+		('/referred', '/', false, 0, now(), 'referred'),
+		('/referrer', '/', false, 0, now(), 'referred')`)
+	c.Assert(err, IsNil)
+
+	// objects are deleted, but a row is still referred to
+	_, err = db.Exec(`UPDATE mds SET (deleted, purged) = (true, true) WHERE key IN ('removed1', 'removed2', 'referred')`)
+	c.Assert(err, IsNil)
+	_, err = db.Exec(`DELETE FROM mfs WHERE path IN ('/removed1', '/removed2', '/referred')`)
+	c.Assert(err, IsNil)
+
+	removed, err := s.driver.CompactMetadata(s.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(removed, Equals, int64(2))
+
+	var keys []string
+	rows, err := db.Query("SELECT key FROM mds ORDER BY key")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		c.Assert(rows.Scan(&key), IsNil)
+		keys = append(keys, key)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(keys, DeepEquals, []string{"referred", "unswept"})
+}
+
+func (s *PGSuite) TestListByOwner(c *C) {
+	c.Assert(s.driver.CreateDir(context.WithValue(s.ctx, auth.UserNameKey, "bob"), "/owners"), IsNil)
+	for path, owner := range map[string]string{
+		"/owners/alice/a":     "alice",
+		"/owners/alice/sub/b": "alice",
+		"/owners/bob/c":       "bob",
+		"/owners/anonymous/d": "",
+		"/elsewhere/e":        "alice",
+	} {
+		ctx := s.ctx
+		if owner != "" {
+			ctx = context.WithValue(ctx, auth.UserNameKey, owner)
 		}
-		if _, err := db.Exec(`CREATE INDEX parent_idx ON mfs (parent);`); err != nil {
-			panic(err)
+		c.Assert(s.driver.PutContent(ctx, path, []byte("data")), IsNil)
+	}
+
+	paths, err := s.driver.ListByOwner(s.ctx, "alice", "/owners")
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"/owners/alice", "/owners/alice/a", "/owners/alice/sub", "/owners/alice/sub/b"})
+
+	paths, err = s.driver.ListByOwner(s.ctx, "bob", "/owners/alice")
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 0)
+
+	// the owner of dirs created by an anonymous writer is unknown as well
+	paths, err = s.driver.ListByOwner(s.ctx, "", "/owners")
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"/owners/anonymous", "/owners/anonymous/d"})
+
+	paths, err = s.driver.ListByOwner(s.ctx, "alice", "/")
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 6)
+
+	_, err = s.driver.ListByOwner(s.ctx, "alice", "/missing")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestListModifiedSince(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	for path, age := range map[string]string{
+		"/mirror/old":     "3 days",
+		"/mirror/sub/old": "2 days",
+		"/mirror/sub/new": "1 hour",
+		"/mirror/new":     "0 hours",
+		"/other/new":      "0 hours",
+	} {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte("data")), IsNil)
+		_, err := db.Exec("UPDATE mfs SET modtime = now() - $2::interval WHERE path = $1", path, age)
+		c.Assert(err, IsNil)
+	}
+
+	files, err := s.driver.ListModifiedSince(s.ctx, "/mirror", time.Now().Add(-24*time.Hour))
+	c.Assert(err, IsNil)
+	var paths []string
+	for _, fi := range files {
+		c.Assert(fi.IsDir(), Equals, false)
+		c.Assert(fi.Size(), Equals, int64(4))
+		paths = append(paths, fi.Path())
+	}
+	c.Assert(paths, DeepEquals, []string{"/mirror/new", "/mirror/sub/new"})
+
+	files, err = s.driver.ListModifiedSince(s.ctx, "/mirror", time.Now().Add(-72*time.Hour-time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 4)
+
+	files, err = s.driver.ListModifiedSince(s.ctx, "/mirror", time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+
+	_, err = s.driver.ListModifiedSince(s.ctx, "/missing", time.Now())
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *PGSuite) TestModtimeRoundTrip(c *C) {
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	before := time.Now().Add(-time.Second)
+	c.Assert(s.driver.PutContent(s.ctx, "/modtime/file", []byte("data")), IsNil)
+
+	fi, err := s.driver.Stat(s.ctx, "/modtime/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.ModTime().After(before), Equals, true, Commentf("%v", fi.ModTime()))
+	c.Assert(fi.ModTime().Before(time.Now().Add(time.Second)), Equals, true, Commentf("%v", fi.ModTime()))
+
+	_, err = db.Exec("UPDATE mfs SET modtime = '2001-02-03 04:05:06.789+03' WHERE path = '/modtime/file'")
+	c.Assert(err, IsNil)
+	fi, err = s.driver.Stat(s.ctx, "/modtime/file")
+	c.Assert(err, IsNil)
+	expected := time.Date(2001, 2, 3, 1, 5, 6, 789*int(time.Millisecond), time.UTC)
+	c.Assert(fi.ModTime().Equal(expected), Equals, true, Commentf("%v", fi.ModTime()))
+
+	// a column of the old type is reported
+	_, err = db.Exec("ALTER TABLE mfs ALTER COLUMN modtime TYPE TIME")
+	c.Assert(err, IsNil)
+	c.Assert(s.driver.Migrate(s.ctx), ErrorMatches, "incompatible schema: column modtime of table mfs is time without time zone .*")
+}
+
+func (s *PGSuite) TestExpireSweep(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	db := s.driver.drv.cluster.DB(pgcluster.MASTER)
+	temporary := WithTTL(s.ctx, time.Hour)
+
+	c.Assert(s.driver.PutContent(temporary, "/ttl/live", []byte("data")), IsNil)
+	c.Assert(s.driver.PutContent(temporary, "/ttl/expired", []byte("data")), IsNil)
+	c.Assert(s.driver.PutContent(temporary, "/ttl/appended", []byte("data")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/ttl/permanent", []byte("data")), IsNil)
+	_, err := db.Exec("UPDATE mfs SET expires_at = now() - interval '1 minute' WHERE path IN ('/ttl/expired', '/ttl/appended')")
+	c.Assert(err, IsNil)
+
+	expiredKey, err := s.driver.drv.getKey(s.ctx, db, "/ttl/expired")
+	c.Assert(err, IsNil)
+
+	// an expired file being appended is kept
+	w, err := s.driver.Writer(temporary, "/ttl/appended", true)
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("more"))
+	c.Assert(err, IsNil)
+
+	swept, err := s.driver.ExpireSweep(s.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(swept, Equals, 1)
+
+	_, err = s.driver.Stat(s.ctx, "/ttl/expired")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	storage.Lock()
+	_, ok := storage.data[expiredKey]
+	storage.Unlock()
+	c.Assert(ok, Equals, false)
+
+	// the append prolongs the expiry
+	c.Assert(w.Commit(), IsNil)
+	swept, err = s.driver.ExpireSweep(s.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(swept, Equals, 0)
+	data, err := s.driver.GetContent(s.ctx, "/ttl/appended")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "datamore")
+
+	for _, path := range []string{"/ttl/live", "/ttl/permanent"} {
+		_, err = s.driver.Stat(s.ctx, path)
+		c.Assert(err, IsNil)
+	}
+
+	// a moved file is permanent unless the TTL is set again
+	c.Assert(s.driver.Move(s.ctx, "/ttl/live", "/ttl/moved"), IsNil)
+	var expires pq.NullTime
+	c.Assert(db.QueryRow("SELECT expires_at FROM mfs WHERE path = '/ttl/moved'").Scan(&expires), IsNil)
+	c.Assert(expires.Valid, Equals, false)
+}
+
+func (s *PGSuite) TestPreparedStatementsFailover(c *C) {
+	s.driver.drv.stmts = newStmtCache()
+	defer s.driver.drv.stmts.Close()
+
+	c.Assert(s.driver.PutContent(s.ctx, "/prepared/file", []byte("data")), IsNil)
+	fi, err := s.driver.Stat(s.ctx, "/prepared/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(4))
+
+	cluster := s.driver.drv.cluster
+	master := cluster.DB(pgcluster.MASTER)
+	c.Assert(s.driver.drv.stmts.db, Equals, master)
+	stmt := s.driver.drv.stmts.set.stmts[s.driver.drv.q("SELECT dir, size, modtime FROM {mfs} WHERE path=$1")]
+	c.Assert(stmt, NotNil)
+
+	// the same server is added as another node, then the master is removed
+	URL := testConfig().URLs[0]
+	other := URL + "&application_name=failover"
+	if !strings.Contains(URL, "?") {
+		other = URL + "?application_name=failover"
+	}
+	c.Assert(cluster.AddNode(other), IsNil)
+	c.Assert(cluster.RemoveNode(URL), IsNil)
+	c.Assert(cluster.DB(pgcluster.MASTER), Not(Equals), master)
+
+	fi, err = s.driver.Stat(s.ctx, "/prepared/file")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(4))
+	data, err := s.driver.GetContent(s.ctx, "/prepared/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	found, err := s.driver.Exists(s.ctx, "/prepared/missing")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	// statements of the old master are closed
+	c.Assert(s.driver.drv.stmts.db, Equals, cluster.DB(pgcluster.MASTER))
+	c.Assert(stmt.QueryRow("/prepared/file").Scan(new(bool), new(int64), new(time.Time)), NotNil)
+}
+
+// benchmarkStat compares Stat by prepared statements and by ad-hoc queries
+func benchmarkStat(b *testing.B, prepared bool) {
+	cfg := testConfig()
+	cfg.PreparedStatements = prepared
+	if err := resetTables(cfg.URLs[0]); err != nil {
+		b.Fatal(err)
+	}
+
+	d, err := pgdriverNew(&cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if err = d.PutContent(ctx, "/bench", []byte("data")); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = d.Stat(ctx, "/bench"); err != nil {
+			b.Fatal(err)
 		}
+	}
+}
 
-		return pgdriverNew(&cfg)
-	}, testsuites.NeverSkip)
+func BenchmarkStatPrepared(b *testing.B) { benchmarkStat(b, true) }
+
+func BenchmarkStatAdHoc(b *testing.B) { benchmarkStat(b, false) }
+
+func (s *PGSuite) TestStatMany(c *C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/many/a", []byte("a")), IsNil)
+	c.Assert(s.driver.PutContent(s.ctx, "/many/sub/b", []byte("bb")), IsNil)
+
+	infos, err := s.driver.StatMany(s.ctx, []string{"/many/a", "/many/missing", "/many/sub", "/many/sub/b", "/many/a"})
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 3)
+
+	c.Assert(infos["/many/a"].Size(), Equals, int64(1))
+	c.Assert(infos["/many/a"].IsDir(), Equals, false)
+	c.Assert(infos["/many/sub"].IsDir(), Equals, true)
+	c.Assert(infos["/many/sub/b"].Size(), Equals, int64(2))
+	_, ok := infos["/many/missing"]
+	c.Assert(ok, Equals, false)
+
+	fi, err := s.driver.Stat(s.ctx, "/many/sub/b")
+	c.Assert(err, IsNil)
+	c.Assert(infos["/many/sub/b"].ModTime().Equal(fi.ModTime()), Equals, true)
+
+	infos, err = s.driver.StatMany(s.ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+}
+
+func (s *PGSuite) TestDeleteMany(c *C) {
+	storage := s.driver.drv.storage.(*inmemory)
+	for _, path := range []string{"/many/a", "/many/b", "/many/sub/c"} {
+		c.Assert(s.driver.PutContent(s.ctx, path, []byte(path)), IsNil)
+	}
+	keyA, err := s.driver.drv.getKey(s.ctx, s.driver.drv.cluster.DB(pgcluster.MASTER), "/many/a")
+	c.Assert(err, IsNil)
+
+	missing, err := s.driver.DeleteMany(s.ctx, []string{"/many/a", "/many/missing", "/many/sub", "/many/sub/c"})
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []string{"/many/missing", "/many/sub"})
+
+	for _, path := range []string{"/many/a", "/many/sub/c"} {
+		_, err = s.driver.Stat(s.ctx, path)
+		c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	}
+	for _, path := range []string{"/many/b", "/many/sub"} {
+		_, err = s.driver.Stat(s.ctx, path)
+		c.Assert(err, IsNil)
+	}
+
+	storage.Lock()
+	_, ok := storage.data[keyA]
+	storage.Unlock()
+	c.Assert(ok, Equals, false)
+
+	var journaled int
+	c.Assert(s.driver.drv.cluster.DB(pgcluster.MASTER).QueryRow("SELECT count(*) FROM mfs_delete_journal").Scan(&journaled), IsNil)
+	c.Assert(journaled, Equals, 0)
+
+	missing, err = s.driver.DeleteMany(s.ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(missing, HasLen, 0)
+}
+
+func (s *PGSuite) TestContextCancellation(c *C) {
+	cfg := testConfig()
+	cfg.MaxOpenConns = 1
+	d, err := pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	defer d.Close()
+	c.Assert(d.PutContent(s.ctx, "/ctx/file", []byte("data")), IsNil)
+
+	// a slow query holds the only connection
+	slow := make(chan error, 1)
+	go func() {
+		_, err := d.drv.cluster.DB(pgcluster.MASTER).Exec("SELECT pg_sleep(2)")
+		slow <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := stdcontext.WithTimeout(s.ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = d.Stat(ctx, "/ctx/file")
+	c.Assert(err, Equals, stdcontext.DeadlineExceeded)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	cancelled, cancel := stdcontext.WithCancel(s.ctx)
+	cancel()
+	c.Assert(d.PutContent(cancelled, "/ctx/cancelled", []byte("data")), NotNil)
+	c.Assert(d.Delete(cancelled, "/ctx/file"), NotNil)
+
+	c.Assert(<-slow, IsNil)
+	_, err = d.Stat(s.ctx, "/ctx/cancelled")
+	c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{})
+	_, err = d.Stat(s.ctx, "/ctx/file")
+	c.Assert(err, IsNil)
+}
+
+func (s *PGSuite) TestPathNotFoundDriverName(c *C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/notfound/file", []byte("data")), IsNil)
+
+	for name, op := range map[string]func() error{
+		"GetContent": func() error {
+			_, err := s.driver.GetContent(s.ctx, "/notfound/missing")
+			return err
+		},
+		"Reader": func() error {
+			_, err := s.driver.Reader(s.ctx, "/notfound/missing", 0)
+			return err
+		},
+		"Stat": func() error {
+			_, err := s.driver.Stat(s.ctx, "/notfound/missing")
+			return err
+		},
+		"List": func() error {
+			_, err := s.driver.List(s.ctx, "/notfound/missing")
+			return err
+		},
+		"Move source": func() error {
+			return s.driver.Move(s.ctx, "/notfound/missing", "/notfound/dest")
+		},
+		"Delete": func() error {
+			return s.driver.Delete(s.ctx, "/notfound/missing")
+		},
+	} {
+		err := op()
+		c.Assert(err, FitsTypeOf, storagedriver.PathNotFoundError{}, Commentf(name))
+		c.Assert(err.(storagedriver.PathNotFoundError).DriverName, Equals, driverName, Commentf(name))
+		c.Assert(err.(storagedriver.PathNotFoundError).Path, Equals, "/notfound/missing", Commentf(name))
+	}
+
+	// the destination of a failed move is left untouched
+	_, err := s.driver.Stat(s.ctx, "/notfound/dest")
+	c.Assert(err, DeepEquals, storagedriver.PathNotFoundError{Path: "/notfound/dest", DriverName: driverName})
+}
+
+func (s *PGSuite) TestMDSAppendUploadedBytes(c *C) {
+	var requests, uploaded int64
+	ts := s.useFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		switch {
+		case strings.Contains(r.URL.Path, "upload-"):
+			n, _ := io.Copy(ioutil.Discard, r.Body)
+			atomic.AddInt64(&uploaded, n)
+			fmt.Fprintf(w, `<post obj="registry.appended" id="1" key="1/appended" size="%d" groups="1"><written>1</written></post>`, n)
+		case r.Method == "GET":
+			io.WriteString(w, "data")
+		}
+	})
+	defer ts.Close()
+
+	_, err := s.driver.drv.cluster.DB(pgcluster.MASTER).Exec(`INSERT INTO mds (key, mdsfileinfo) VALUES ('proxied', '{"key": "1/proxied", "size": 4}')`)
+	c.Assert(err, IsNil)
+
+	// nothing is proxied if there is nothing to append
+	size, err := s.driver.drv.storage.Append(s.ctx, "proxied", strings.NewReader(""))
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(4))
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(0))
+
+	// otherwise the existing object is uploaded along with appended bytes
+	proxied, proxyings := proxiedBytesMeter("registry").Count(), appendProxyTimer("registry").Count()
+	size, err = s.driver.drv.storage.Append(s.ctx, "proxied", strings.NewReader("more"))
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(8))
+	c.Assert(atomic.LoadInt64(&uploaded), Equals, int64(8))
+	c.Assert(proxiedBytesMeter("registry").Count()-proxied, Equals, int64(4))
+	c.Assert(appendProxyTimer("registry").Count()-proxyings, Equals, int64(1))
+}
+
+func (s *PGSuite) TestDisableResumableUploads(c *C) {
+	s.driver.drv.disableResumable = true
+
+	// nothing is stored yet, so the first chunk is accepted
+	w, err := s.driver.Writer(s.ctx, "/resumable/file", true)
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Commit(), IsNil)
+
+	_, err = s.driver.Writer(s.ctx, "/resumable/file", true)
+	c.Assert(err, FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+
+	c.Assert(s.driver.PutContent(s.ctx, "/resumable/file", []byte("new data")), IsNil)
+	data, err := s.driver.GetContent(s.ctx, "/resumable/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "new data")
+}
+
+func (s *PGSuite) TestRoutes(c *C) {
+	cfg := testConfig()
+	cfg.Routes = []routeConfig{
+		{Match: "size<=4", Backend: "small"},
+		{Match: "prefix:/routes/large/", Backend: "large"},
+	}
+	cfg.Backends = map[string]backendConfig{
+		"small": {Type: "inmemory"},
+		"large": {Type: "inmemory"},
+	}
+	d, err := pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+	defer d.Close()
+
+	routed := d.drv.storage.(*routedStorage)
+	c.Assert(d.PutContent(s.ctx, "/routes/small", []byte("data")), IsNil)
+	c.Assert(d.PutContent(s.ctx, "/routes/large/file", []byte("large data")), IsNil)
+	c.Assert(d.PutContent(s.ctx, "/routes/other", []byte("other data")), IsNil)
+
+	for path, backend := range map[string]string{
+		"/routes/small":      "small",
+		"/routes/large/file": "large",
+		"/routes/other":      defaultBackend,
+	} {
+		key, err := d.drv.getKey(s.ctx, d.drv.cluster.DB(pgcluster.MASTER), path)
+		c.Assert(err, IsNil)
+		for name, st := range routed.backends {
+			_, err = st.Size(s.ctx, key)
+			c.Assert(err == nil, Equals, name == backend, Commentf("%s in %s", path, name))
+		}
+
+		data, err := d.GetContent(s.ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(len(data) > 0, Equals, true)
+	}
+
+	// routes of deleted keys are dropped along with their objects
+	c.Assert(d.Delete(s.ctx, "/routes"), IsNil)
+	var routes int
+	c.Assert(d.drv.cluster.DB(pgcluster.MASTER).QueryRow(d.drv.q("SELECT count(*) FROM {kv_routes}")).Scan(&routes), IsNil)
+	c.Assert(routes, Equals, 0)
+}
+
+func (s *PGSuite) TestPGBlobStorage(c *C) {
+	st, err := newPGBlobStorage(s.driver.drv.cluster, s.driver.drv.sqlTables)
+	c.Assert(err, IsNil)
+
+	_, err = st.Append(s.ctx, "blob", strings.NewReader("more"))
+	c.Assert(err, NotNil)
+
+	n, err := st.Store(s.ctx, "blob", strings.NewReader("data"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(4))
+	n, err = st.Append(s.ctx, "blob", strings.NewReader("more"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(4))
+
+	size, err := st.Size(s.ctx, "blob")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(8))
+
+	for offset, expected := range map[int64]string{0: "datamore", 2: "tamore", 8: ""} {
+		rd, err := st.Get(s.ctx, "blob", offset)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(rd)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+	_, err = st.Get(s.ctx, "blob", 9)
+	c.Assert(err, NotNil)
+
+	_, err = st.URLFor(s.ctx, "blob", false)
+	c.Assert(err, FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+
+	c.Assert(st.Delete(s.ctx, "blob"), IsNil)
+	_, err = st.Get(s.ctx, "blob", 0)
+	c.Assert(err, NotNil)
 }
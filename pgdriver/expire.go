@@ -0,0 +1,109 @@
+package pgdriver
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+const ttlKey = "pgdriver_ttl"
+
+// WithTTL makes files written with the returned context temporary.
+// They are deleted by ExpireSweep after ttl. 0 means never expire.
+// Appending with a TTL prolongs the expiry, moving sets it anew.
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey, ttl)
+}
+
+// expiresAt returns the expiry of a file written with ctx or nil
+func expiresAt(ctx context.Context) interface{} {
+	if ttl, ok := ctx.Value(ttlKey).(time.Duration); ok && ttl > 0 {
+		return time.Now().Add(ttl)
+	}
+	return nil
+}
+
+// errNotExpired means that an expired file has been rewritten
+// or its expiry has been prolonged before it's swept
+var errNotExpired = errors.New("file is not expired")
+
+// ExpireSweep deletes expired files and their KV objects.
+// It returns the number of deleted files.
+func (d *Driver) ExpireSweep(ctx context.Context) (int, error) {
+	return d.drv.ExpireSweep(ctx)
+}
+
+func (d *driver) ExpireSweep(ctx context.Context) (int, error) {
+	rows, err := d.cluster.DB(pgcluster.MASTER).QueryContext(ctx, d.q("SELECT path FROM {mfs} WHERE expires_at < now() AND NOT dir"))
+	if err != nil {
+		return 0, err
+	}
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var swept int
+	for _, path := range paths {
+		// NOTE: an append to an expired file is let to finish
+		if liveWriters.writing(path) {
+			continue
+		}
+
+		err = d.deleteBy(ctx, func(deleteID string) error {
+			return d.deleteExpired(ctx, path, deleteID)
+		})
+		switch err {
+		case nil:
+			swept++
+		case errNotExpired:
+			// pass
+		default:
+			return swept, err
+		}
+	}
+
+	context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"swept": swept}).Debug("expired files are swept")
+	return swept, nil
+}
+
+// deleteExpired deletes the file if it's still expired. The expiry is checked
+// by DELETE, so a concurrent append prolonging it wins.
+func (d *driver) deleteExpired(ctx context.Context, path string, deleteID string) error {
+	tx, err := d.cluster.DB(pgcluster.MASTER).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key sql.NullString
+	switch err = tx.QueryRowContext(ctx, d.q("DELETE FROM {mfs} WHERE path = $1 AND NOT dir AND expires_at < now() RETURNING key"), path).Scan(&key); err {
+	case nil:
+		// pass
+	case sql.ErrNoRows:
+		return errNotExpired
+	default:
+		return err
+	}
+
+	if key.Valid {
+		if _, err = tx.ExecContext(ctx, d.q(insertPendingDelete), key.String, deleteID); err != nil {
+			return err
+		}
+	}
+
+	return d.commitDelete(ctx, tx, deleteID)
+}
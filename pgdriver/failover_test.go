@@ -0,0 +1,74 @@
+//go:build integration
+// +build integration
+
+package pgdriver
+
+import (
+	"expvar"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+	. "gopkg.in/check.v1"
+)
+
+// FailoverSuite requires two PostgreSQL nodes passed via PG_FAILOVER_URLS.
+// The first one must be a read-only node (a hot standby), the second one is
+// the primary. The driver must elect the second node and keep working.
+// Failover itself is covered by TestWritesSurviveFailover of ClusterSuite.
+type FailoverSuite struct {
+	driver *Driver
+}
+
+var _ = Suite(&FailoverSuite{})
+
+func (s *FailoverSuite) SetUpSuite(c *C) {
+	URLs := strings.Split(fromEnvOrDefault("PG_FAILOVER_URLS", ""), " ")
+	if len(URLs) != 2 {
+		c.Skip("PG_FAILOVER_URLS must contain a standby and a primary")
+	}
+
+	// tables are created on the primary and replicated to the standby
+	c.Assert(resetTables(URLs[1]), IsNil)
+
+	cfg := testConfig()
+	cfg.URLs = URLs
+
+	var err error
+	s.driver, err = pgdriverNew(&cfg)
+	c.Assert(err, IsNil)
+}
+
+func (s *FailoverSuite) TearDownSuite(c *C) {
+	if s.driver != nil {
+		s.driver.Close()
+	}
+}
+
+func (s *FailoverSuite) TestPrimaryIsElected(c *C) {
+	ctx := context.Background()
+
+	c.Assert(s.driver.PutContent(ctx, "/failover/a", []byte("a")), IsNil)
+
+	stats := expvar.Get("pgcluster_stats").(*expvar.Map)
+	c.Assert(stats.Get("master").String(), Equals, "1")
+	c.Assert(stats.Get("last_election").String(), Not(Equals), `""`)
+
+	// the elected master must be kept after re-election
+	s.driver.drv.cluster.ReElect()
+	c.Assert(stats.Get("master").String(), Equals, "1")
+
+	c.Assert(s.driver.PutContent(ctx, "/failover/b", []byte("b")), IsNil)
+
+	// SLAVE requests are routed to the master
+	var isInRecovery bool
+	err := s.driver.drv.cluster.DB(pgcluster.SLAVE).QueryRow("SELECT pg_is_in_recovery()").Scan(&isInRecovery)
+	c.Assert(err, IsNil)
+	c.Assert(isInRecovery, Equals, false)
+
+	for _, path := range []string{"/failover/a", "/failover/b"} {
+		content, err := s.driver.GetContent(ctx, path)
+		c.Assert(err, IsNil)
+		c.Assert(string(content), Equals, path[len(path)-1:])
+	}
+}
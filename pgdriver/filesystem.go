@@ -0,0 +1,177 @@
+package pgdriver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// defaultFilesystemShardDepth keeps up to 65536 directories of objects
+const defaultFilesystemShardDepth = 2
+
+// filesystem keeps each object as a file under the root directory
+type filesystem struct {
+	root string
+}
+
+func newFilesystem(parameters map[string]interface{}) (KVStorage, error) {
+	var config struct {
+		RootDirectory string
+		// ShardDepth is the number of directory levels objects are spread over
+		ShardDepth int
+	}
+
+	config.ShardDepth = defaultFilesystemShardDepth
+	if err := decodeConfig(parameters, &config); err != nil {
+		return nil, err
+	}
+
+	if config.RootDirectory == "" {
+		return nil, fmt.Errorf("rootdirectory of filesystem backend is not specified")
+	}
+
+	layout, err := newKeyLayout(config.ShardDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.Abs(config.RootDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return newShardedStorage(&filesystem{root: root}, layout), nil
+}
+
+// path returns the file of key, which must not escape the root
+func (f *filesystem) path(key string) (string, error) {
+	path := filepath.Join(f.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, f.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key: %s", key)
+	}
+	return path, nil
+}
+
+// Store writes data to a temporary file renamed to the file of key,
+// so readers never see partially written objects
+func (f *filesystem) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	nn, err := io.Copy(tmp, data)
+	if err != nil {
+		tmp.Close()
+		return nn, err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return nn, err
+	}
+
+	return nn, os.Rename(tmp.Name(), path)
+}
+
+func (f *filesystem) Append(ctx context.Context, key string, data io.Reader) (int64, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	nn, err := io.Copy(file, data)
+	if err != nil {
+		file.Close()
+		return nn, err
+	}
+	return nn, file.Close()
+}
+
+func (f *filesystem) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() < offset {
+		file.Close()
+		return nil, fmt.Errorf("invalid offset")
+	}
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *filesystem) Delete(ctx context.Context, key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *filesystem) Size(ctx context.Context, key string) (int64, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// URLFor is not supported, as files are not served by anyone
+func (f *filesystem) URLFor(ctx context.Context, key string, resolveRedirect bool) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+}
+
+// Close does nothing, as files are closed by each call
+func (f *filesystem) Close() error {
+	return nil
+}
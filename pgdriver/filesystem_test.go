@@ -0,0 +1,106 @@
+package pgdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	. "gopkg.in/check.v1"
+)
+
+type FilesystemSuite struct {
+	root string
+	st   KVStorage
+	ctx  context.Context
+}
+
+var _ = Suite(&FilesystemSuite{})
+
+func (s *FilesystemSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	var err error
+	s.st, err = newFilesystem(map[string]interface{}{"rootdirectory": s.root})
+	c.Assert(err, IsNil)
+	s.ctx = context.Background()
+}
+
+func (s *FilesystemSuite) read(c *C, key string, offset int64) string {
+	rd, err := s.st.Get(s.ctx, key, offset)
+	c.Assert(err, IsNil)
+	defer rd.Close()
+	data, err := ioutil.ReadAll(rd)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *FilesystemSuite) TestOffsetReads(c *C) {
+	key := generateKey()
+	n, err := s.st.Store(s.ctx, key, strings.NewReader("data"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(4))
+
+	// objects are spread over directories by the first characters of keys
+	_, err = os.Stat(filepath.Join(s.root, key[:2], key[2:4], key))
+	c.Assert(err, IsNil)
+
+	c.Assert(s.read(c, key, 0), Equals, "data")
+	c.Assert(s.read(c, key, 2), Equals, "ta")
+	c.Assert(s.read(c, key, 4), Equals, "")
+	_, err = s.st.Get(s.ctx, key, 5)
+	c.Assert(err, NotNil)
+
+	_, err = s.st.Get(s.ctx, generateKey(), 0)
+	c.Assert(err, NotNil)
+}
+
+func (s *FilesystemSuite) TestAppend(c *C) {
+	key := generateKey()
+	_, err := s.st.Append(s.ctx, key, strings.NewReader("more"))
+	c.Assert(err, NotNil)
+
+	_, err = s.st.Store(s.ctx, key, strings.NewReader("data"))
+	c.Assert(err, IsNil)
+	n, err := s.st.Append(s.ctx, key, strings.NewReader("more"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(4))
+
+	size, err := s.st.Size(s.ctx, key)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(8))
+	c.Assert(s.read(c, key, 4), Equals, "more")
+
+	// Store replaces the content
+	_, err = s.st.Store(s.ctx, key, strings.NewReader("new"))
+	c.Assert(err, IsNil)
+	c.Assert(s.read(c, key, 0), Equals, "new")
+}
+
+func (s *FilesystemSuite) TestDelete(c *C) {
+	key := generateKey()
+	_, err := s.st.Store(s.ctx, key, strings.NewReader("data"))
+	c.Assert(err, IsNil)
+
+	c.Assert(s.st.Delete(s.ctx, key), IsNil)
+	_, err = s.st.Size(s.ctx, key)
+	c.Assert(err, NotNil)
+	// deleting a missing key is not an error
+	c.Assert(s.st.Delete(s.ctx, key), IsNil)
+
+	_, err = s.st.URLFor(s.ctx, key, false)
+	c.Assert(err, FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+}
+
+func (s *FilesystemSuite) TestConfig(c *C) {
+	_, err := newFilesystem(map[string]interface{}{})
+	c.Assert(err, NotNil)
+	_, err = newFilesystem(map[string]interface{}{"rootdirectory": s.root, "sharddepth": maxShardDepth + 1})
+	c.Assert(err, NotNil)
+
+	st, err := newFilesystem(map[string]interface{}{"rootdirectory": s.root, "sharddepth": 0})
+	c.Assert(err, IsNil)
+	_, err = st.Store(s.ctx, "../escaped", strings.NewReader("data"))
+	c.Assert(err, NotNil)
+}
@@ -13,21 +13,57 @@ import (
 	"github.com/docker/distribution/context"
 )
 
+// ErrStorageFull is returned by the inmemory backend,
+// if storing data would exceed MaxBytes
+type ErrStorageFull struct {
+	MaxBytes int64
+}
+
+func (e ErrStorageFull) Error() string {
+	return fmt.Sprintf("inmemory storage is full: %d bytes at most", e.MaxBytes)
+}
+
 type inmemory struct {
 	sync.Mutex
+	ts      *httptest.Server
 	baseURL string
 	data    map[string][]byte
+
+	// size is the total length of stored content.
+	// It must not exceed maxBytes unless maxBytes is 0.
+	size     int64
+	maxBytes int64
+}
+
+func newInMemoryBinStorage(parameters map[string]interface{}) (KVStorage, error) {
+	var config struct {
+		// MaxBytes bounds the total length of stored content. 0 means no limit.
+		MaxBytes int64
+	}
+
+	if err := decodeConfig(parameters, &config); err != nil {
+		return nil, err
+	}
+
+	if config.MaxBytes < 0 {
+		return nil, fmt.Errorf("MaxBytes must not be negative: %d", config.MaxBytes)
+	}
+
+	st, err := newInMemory()
+	if err != nil {
+		return nil, err
+	}
+	st.(*inmemory).maxBytes = config.MaxBytes
+	return st, nil
 }
 
 func newInMemory() (KVStorage, error) {
-	// NOTE: distribution does not require any kind of Close method,
-	// so there is no possibility to prevent resourse leak
 	driver := &inmemory{
 		data: make(map[string][]byte),
 	}
-	ts := httptest.NewServer(http.HandlerFunc(driver.serve))
+	driver.ts = httptest.NewServer(http.HandlerFunc(driver.serve))
 
-	driver.baseURL = ts.URL
+	driver.baseURL = driver.ts.URL
 
 	return driver, nil
 }
@@ -46,16 +82,61 @@ func (i *inmemory) serve(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// appendFrom appends data to body. Readers knowing their length, like
+// *bytes.Reader, are written at once into a slice grown in advance,
+// so content is copied only once.
+func appendFrom(body []byte, data io.Reader) ([]byte, int64, error) {
+	buff := bytes.NewBuffer(body)
+	if l, ok := data.(interface {
+		Len() int
+	}); ok {
+		buff.Grow(l.Len())
+	}
+
+	var (
+		nn  int64
+		err error
+	)
+	// NOTE: ReadFrom reserves spare room for each read,
+	// which would grow an exactly sized slice once again
+	if w, ok := data.(io.WriterTo); ok {
+		nn, err = w.WriteTo(buff)
+	} else {
+		nn, err = buff.ReadFrom(data)
+	}
+	return buff.Bytes(), nn, err
+}
+
+// limit stops reading data right after it exceeds the room left by used bytes
+func (i *inmemory) limit(data io.Reader, used int64) io.Reader {
+	if i.maxBytes == 0 {
+		return data
+	}
+	return io.LimitReader(data, i.maxBytes-used+1)
+}
+
+func (i *inmemory) full(size int64) bool {
+	return i.maxBytes != 0 && size > i.maxBytes
+}
+
 func (i *inmemory) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
 	i.Lock()
 	defer i.Unlock()
 
-	buff := new(bytes.Buffer)
-	if _, err := io.Copy(buff, data); err != nil {
+	// NOTE: the replaced content is freed
+	used := i.size - int64(len(i.data[key]))
+	body, nn, err := appendFrom(nil, i.limit(data, used))
+	if err != nil {
 		return 0, err
 	}
-	i.data[key] = buff.Bytes()
-	return int64(buff.Len()), nil
+
+	if i.full(used + nn) {
+		return 0, ErrStorageFull{MaxBytes: i.maxBytes}
+	}
+
+	i.data[key] = body
+	i.size = used + nn
+	return nn, nil
 }
 
 func (i *inmemory) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
@@ -78,20 +159,21 @@ func (i *inmemory) Get(ctx context.Context, key string, offset int64) (io.ReadCl
 	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
-// func (i *inmemory) Size(ctx context.Context, key string) (int64, error) {
-// 	i.Lock()
-// 	defer i.Unlock()
-//
-// 	data, ok := i.data[key]
-// 	if !ok {
-// 		return 0, fmt.Errorf("no such key: %s", key)
-// 	}
-// 	return int64(len(data)), nil
-// }
+func (i *inmemory) Size(ctx context.Context, key string) (int64, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	data, ok := i.data[key]
+	if !ok {
+		return 0, fmt.Errorf("no such key: %s", key)
+	}
+	return int64(len(data)), nil
+}
 
 func (i *inmemory) Delete(ctx context.Context, key string) error {
 	i.Lock()
 	defer i.Unlock()
+	i.size -= int64(len(i.data[key]))
 	delete(i.data, key)
 	return nil
 }
@@ -105,13 +187,19 @@ func (i *inmemory) Append(ctx context.Context, key string, data io.Reader) (int6
 		return 0, fmt.Errorf("EINVAL OFFSET. NO SUCH FILE %s", key)
 	}
 
-	buff := new(bytes.Buffer)
-	nn, err := io.Copy(buff, data)
+	// NOTE: readers of the stored content keep its length,
+	// so appending into spare capacity is not visible to them
+	body, nn, err := appendFrom(body, i.limit(data, i.size))
 	if err != nil {
 		return nn, err
 	}
 
-	i.data[key] = append(body, buff.Bytes()...)
+	if i.full(i.size + nn) {
+		return 0, ErrStorageFull{MaxBytes: i.maxBytes}
+	}
+
+	i.data[key] = body
+	i.size += nn
 	return nn, nil
 }
 
@@ -125,3 +213,9 @@ func (i *inmemory) URLFor(ctx context.Context, key string, _ bool) (string, erro
 	u.RawQuery = q.Encode()
 	return u.String(), nil
 }
+
+// Close shuts down the http server used to serve URLFor requests
+func (i *inmemory) Close() error {
+	i.ts.Close()
+	return nil
+}
@@ -0,0 +1,161 @@
+package pgdriver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	. "gopkg.in/check.v1"
+)
+
+type InMemorySuite struct{}
+
+var _ = Suite(&InMemorySuite{})
+
+func (s *InMemorySuite) TestCloseStopsServer(c *C) {
+	ctx := context.Background()
+
+	st, err := newInMemory()
+	c.Assert(err, IsNil)
+
+	_, err = st.Store(ctx, "key", strings.NewReader("data"))
+	c.Assert(err, IsNil)
+
+	u, err := st.URLFor(ctx, "key", false)
+	c.Assert(err, IsNil)
+
+	resp, err := http.Get(u)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	c.Assert(st.Close(), IsNil)
+
+	_, err = http.Get(u)
+	c.Assert(err, NotNil)
+}
+
+func (s *InMemorySuite) TestSize(c *C) {
+	ctx := context.Background()
+
+	st, err := newInMemory()
+	c.Assert(err, IsNil)
+	defer st.Close()
+
+	_, err = st.Store(ctx, "key", strings.NewReader("data"))
+	c.Assert(err, IsNil)
+	_, err = st.Append(ctx, "key", strings.NewReader("more"))
+	c.Assert(err, IsNil)
+
+	size, err := st.Size(ctx, "key")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(8))
+
+	_, err = st.Size(ctx, "missing")
+	c.Assert(err, NotNil)
+}
+
+func (s *InMemorySuite) TestLargeContent(c *C) {
+	ctx := context.Background()
+
+	st, err := newInMemory()
+	c.Assert(err, IsNil)
+	defer st.Close()
+
+	content := make([]byte, 8<<20)
+	_, err = rand.Read(content)
+	c.Assert(err, IsNil)
+	half := len(content) / 2
+
+	// a reader of known length and a plain one
+	n, err := st.Store(ctx, "key", bytes.NewReader(content[:half]))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(half))
+	n, err = st.Append(ctx, "key", io.LimitReader(bytes.NewReader(content[half:]), int64(len(content)-half)))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(len(content)-half))
+
+	rd, err := st.Get(ctx, "key", 0)
+	c.Assert(err, IsNil)
+	stored, err := ioutil.ReadAll(rd)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(stored, content), Equals, true)
+}
+
+func (s *InMemorySuite) TestMaxBytes(c *C) {
+	ctx := context.Background()
+
+	_, err := newInMemoryBinStorage(map[string]interface{}{"maxbytes": -1})
+	c.Assert(err, NotNil)
+
+	st, err := newInMemoryBinStorage(map[string]interface{}{"maxbytes": 8})
+	c.Assert(err, IsNil)
+	defer st.Close()
+
+	_, err = st.Store(ctx, "a", strings.NewReader("data"))
+	c.Assert(err, IsNil)
+	_, err = st.Append(ctx, "a", strings.NewReader("more"))
+	c.Assert(err, IsNil)
+
+	_, err = st.Store(ctx, "b", strings.NewReader("x"))
+	c.Assert(err, Equals, ErrStorageFull{MaxBytes: 8})
+	_, err = st.Append(ctx, "a", strings.NewReader("x"))
+	c.Assert(err, Equals, ErrStorageFull{MaxBytes: 8})
+	// failed writes leave content intact
+	size, err := st.Size(ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(8))
+	_, err = st.Size(ctx, "b")
+	c.Assert(err, NotNil)
+
+	// replaced content is freed
+	_, err = st.Store(ctx, "a", strings.NewReader("new data"))
+	c.Assert(err, IsNil)
+
+	// so is deleted one
+	c.Assert(st.Delete(ctx, "a"), IsNil)
+	_, err = st.Store(ctx, "b", strings.NewReader("new data"))
+	c.Assert(err, IsNil)
+}
+
+func benchmarkInMemory(b *testing.B, op func(st KVStorage, data io.Reader) error) {
+	ctx := context.Background()
+	st, err := newInMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Close()
+
+	if _, err = st.Store(ctx, "key", strings.NewReader("")); err != nil {
+		b.Fatal(err)
+	}
+
+	content := make([]byte, 1<<20)
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = op(st, bytes.NewReader(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInMemoryStore(b *testing.B) {
+	benchmarkInMemory(b, func(st KVStorage, data io.Reader) error {
+		_, err := st.Store(context.Background(), "key", data)
+		return err
+	})
+}
+
+func BenchmarkInMemoryAppend(b *testing.B) {
+	benchmarkInMemory(b, func(st KVStorage, data io.Reader) error {
+		_, err := st.Append(context.Background(), "key", data)
+		return err
+	})
+}
@@ -0,0 +1,108 @@
+package pgdriver
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/distribution/context"
+)
+
+const (
+	// deleteWorkers is the number of parallel deletes from KV storage
+	deleteWorkers = 8
+	// deletePageSize is the number of journaled keys read at once
+	deletePageSize = 1000
+	// backgroundDeletes is the number of deletions left running by Delete.
+	// Others are done before Delete returns.
+	backgroundDeletes = 4
+)
+
+// keyDeleter deletes keys from KV storage by a pool of workers.
+// Keys are passed through a bounded channel, so add blocks
+// while workers are busy and memory is bounded whatever the number of keys is.
+type keyDeleter struct {
+	ctx       context.Context
+	storage   KVStorage
+	onFailure func(key string, err error)
+	// failFast stops scheduling after the first failure
+	failFast bool
+
+	keys chan string
+	wg   sync.WaitGroup
+	once sync.Once
+
+	total    int64
+	failures int64
+
+	mu  sync.Mutex
+	err error
+}
+
+// newKeyDeleter starts workers. onFailure is called for each failed key if it's set.
+func newKeyDeleter(ctx context.Context, storage KVStorage, workers int, onFailure func(key string, err error)) *keyDeleter {
+	k := &keyDeleter{
+		ctx:       ctx,
+		storage:   storage,
+		onFailure: onFailure,
+		keys:      make(chan string, workers),
+	}
+
+	k.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go k.work()
+	}
+
+	return k
+}
+
+func (k *keyDeleter) work() {
+	defer k.wg.Done()
+	for key := range k.keys {
+		err := k.storage.Delete(k.ctx, key)
+		if err == nil {
+			continue
+		}
+
+		context.GetLoggerWithFields(k.ctx, map[interface{}]interface{}{"key": key, "error": err.Error()}).Error("KVStorage.Delete")
+		atomic.AddInt64(&k.failures, 1)
+		k.mu.Lock()
+		if k.err == nil {
+			k.err = err
+		}
+		k.mu.Unlock()
+
+		if k.onFailure != nil {
+			k.onFailure(key, err)
+		}
+	}
+}
+
+// add schedules deletion of key. In failFast mode it returns false
+// without scheduling if any deletion has failed already.
+func (k *keyDeleter) add(key string) bool {
+	if k.failFast && atomic.LoadInt64(&k.failures) > 0 {
+		return false
+	}
+
+	atomic.AddInt64(&k.total, 1)
+	k.keys <- key
+	return true
+}
+
+// added returns the number of scheduled keys
+func (k *keyDeleter) added() int64 {
+	return atomic.LoadInt64(&k.total)
+}
+
+// wait waits for all scheduled deletions and returns the number of failures
+// and the first error. No keys can be added after that.
+func (k *keyDeleter) wait() (int64, error) {
+	k.once.Do(func() {
+		close(k.keys)
+		k.wg.Wait()
+	})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return atomic.LoadInt64(&k.failures), k.err
+}
@@ -0,0 +1,122 @@
+package pgdriver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/distribution/context"
+	. "gopkg.in/check.v1"
+)
+
+type KeyDeleterSuite struct{}
+
+var _ = Suite(&KeyDeleterSuite{})
+
+// countingStorage counts deletes and tracks their peak concurrency.
+// Deletes block until release is closed if it's set.
+type countingStorage struct {
+	KVStorage
+	release chan struct{}
+	fail    map[string]bool
+
+	deleted  int64
+	inFlight int64
+	peak     int64
+}
+
+func (s *countingStorage) Delete(ctx context.Context, key string) error {
+	n := atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	for {
+		peak := atomic.LoadInt64(&s.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&s.peak, peak, n) {
+			break
+		}
+	}
+
+	if s.release != nil {
+		<-s.release
+	}
+
+	if s.fail[key] {
+		return fmt.Errorf("injected failure")
+	}
+	atomic.AddInt64(&s.deleted, 1)
+	return nil
+}
+
+func (s *KeyDeleterSuite) TestAddBlocksWhileWorkersAreBusy(c *C) {
+	st := &countingStorage{release: make(chan struct{})}
+	k := newKeyDeleter(context.Background(), st, 2, nil)
+
+	// 2 keys are taken by workers and 2 are buffered
+	for i := 0; i < 4; i++ {
+		c.Assert(k.add(fmt.Sprintf("key%d", i)), Equals, true)
+	}
+
+	added := make(chan struct{})
+	go func() {
+		k.add("key4")
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		c.Fatal("add must block while workers are busy")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(st.release)
+	<-added
+
+	failures, err := k.wait()
+	c.Assert(failures, Equals, int64(0))
+	c.Assert(err, IsNil)
+	c.Assert(st.deleted, Equals, int64(5))
+	c.Assert(st.peak <= 2, Equals, true)
+}
+
+func (s *KeyDeleterSuite) TestFailures(c *C) {
+	st := &countingStorage{fail: map[string]bool{"key1": true}}
+
+	var (
+		mu     sync.Mutex
+		failed []string
+	)
+	k := newKeyDeleter(context.Background(), st, 4, func(key string, err error) {
+		mu.Lock()
+		failed = append(failed, key)
+		mu.Unlock()
+	})
+	for i := 0; i < 10; i++ {
+		c.Assert(k.add(fmt.Sprintf("key%d", i)), Equals, true)
+	}
+
+	failures, err := k.wait()
+	c.Assert(failures, Equals, int64(1))
+	c.Assert(err, ErrorMatches, "injected failure")
+	c.Assert(failed, DeepEquals, []string{"key1"})
+	c.Assert(st.deleted, Equals, int64(9))
+
+	// wait is idempotent
+	failures, _ = k.wait()
+	c.Assert(failures, Equals, int64(1))
+}
+
+func (s *KeyDeleterSuite) TestFailFast(c *C) {
+	st := &countingStorage{fail: map[string]bool{"key0": true}}
+	k := newKeyDeleter(context.Background(), st, 1, nil)
+	k.failFast = true
+
+	c.Assert(k.add("key0"), Equals, true)
+	for atomic.LoadInt64(&k.failures) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(k.add("key1"), Equals, false)
+
+	failures, _ := k.wait()
+	c.Assert(failures, Equals, int64(1))
+	c.Assert(k.added(), Equals, int64(1))
+}
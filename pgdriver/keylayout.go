@@ -0,0 +1,81 @@
+package pgdriver
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/context"
+)
+
+const (
+	// shardWidth is the number of key characters per shard level
+	shardWidth = 2
+	// maxShardDepth keeps shards within the first group of hex digits of a key
+	maxShardDepth = 4
+)
+
+// keyLayout maps keys to paths of filesystem-like backends.
+// The first characters of a key are split into directory levels
+// like in the object store of Git: ab/cd/abcdef...
+type keyLayout struct {
+	depth int
+}
+
+func newKeyLayout(depth int) (keyLayout, error) {
+	if depth < 0 || depth > maxShardDepth {
+		return keyLayout{}, fmt.Errorf("shard depth must be in [0, %d]: %d", maxShardDepth, depth)
+	}
+	return keyLayout{depth: depth}, nil
+}
+
+// path returns the path of key. Keys too short to be sharded are kept flat.
+func (l keyLayout) path(key string) string {
+	if len(key) < l.depth*shardWidth {
+		return key
+	}
+
+	parts := make([]string, 0, l.depth+1)
+	for i := 0; i < l.depth; i++ {
+		parts = append(parts, strings.ToLower(key[i*shardWidth:(i+1)*shardWidth]))
+	}
+	return path.Join(append(parts, key)...)
+}
+
+// shardedStorage applies a key layout to each key passed to a backend
+type shardedStorage struct {
+	KVStorage
+	layout keyLayout
+}
+
+func newShardedStorage(storage KVStorage, layout keyLayout) KVStorage {
+	if layout.depth == 0 {
+		return storage
+	}
+	return &shardedStorage{KVStorage: storage, layout: layout}
+}
+
+func (s *shardedStorage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	return s.KVStorage.Store(ctx, s.layout.path(key), data)
+}
+
+func (s *shardedStorage) Append(ctx context.Context, key string, data io.Reader) (int64, error) {
+	return s.KVStorage.Append(ctx, s.layout.path(key), data)
+}
+
+func (s *shardedStorage) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	return s.KVStorage.Get(ctx, s.layout.path(key), offset)
+}
+
+func (s *shardedStorage) Delete(ctx context.Context, key string) error {
+	return s.KVStorage.Delete(ctx, s.layout.path(key))
+}
+
+func (s *shardedStorage) Size(ctx context.Context, key string) (int64, error) {
+	return s.KVStorage.Size(ctx, s.layout.path(key))
+}
+
+func (s *shardedStorage) URLFor(ctx context.Context, key string, resolveRedirect bool) (string, error) {
+	return s.KVStorage.URLFor(ctx, s.layout.path(key), resolveRedirect)
+}
@@ -0,0 +1,69 @@
+package pgdriver
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	. "gopkg.in/check.v1"
+)
+
+type KeyLayoutSuite struct{}
+
+var _ = Suite(&KeyLayoutSuite{})
+
+func (s *KeyLayoutSuite) TestPath(c *C) {
+	const key = "AB12cd34-0000-4000-8000-000000000000"
+	for depth, expected := range []string{
+		key,
+		"ab/" + key,
+		"ab/12/" + key,
+		"ab/12/cd/" + key,
+		"ab/12/cd/34/" + key,
+	} {
+		layout, err := newKeyLayout(depth)
+		c.Assert(err, IsNil)
+		c.Assert(layout.path(key), Equals, expected)
+	}
+
+	layout, err := newKeyLayout(2)
+	c.Assert(err, IsNil)
+	c.Assert(layout.path("abc"), Equals, "abc")
+
+	for _, depth := range []int{-1, maxShardDepth + 1} {
+		_, err = newKeyLayout(depth)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *KeyLayoutSuite) TestRoundTrip(c *C) {
+	ctx := context.Background()
+	st, err := newInMemory()
+	c.Assert(err, IsNil)
+	defer st.Close()
+
+	layout, err := newKeyLayout(2)
+	c.Assert(err, IsNil)
+	sharded := newShardedStorage(st, layout)
+
+	key := generateKey()
+	_, err = sharded.Store(ctx, key, strings.NewReader("data"))
+	c.Assert(err, IsNil)
+
+	mem := st.(*inmemory)
+	mem.Lock()
+	_, ok := mem.data[key[:2]+"/"+key[2:4]+"/"+key]
+	mem.Unlock()
+	c.Assert(ok, Equals, true)
+
+	rd, err := sharded.Get(ctx, key, 1)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rd)
+	rd.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "ata")
+
+	c.Assert(sharded.Delete(ctx, key), IsNil)
+	_, err = sharded.Size(ctx, key)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,197 @@
+package pgdriver
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// NOTE: In lazy mode directories are not created by writers.
+// Rows for them are derived from paths of existing files
+// when a directory is accessed for the first time.
+// Afterwards writers create missing directories under it,
+// so a directory row implies rows of all directories under it.
+
+// textArray encodes items as a PostgreSQL text array literal
+func textArray(items []string) string {
+	quoted := make([]string, 0, len(items))
+	for _, item := range items {
+		item = strings.Replace(item, `\`, `\\`, -1)
+		item = strings.Replace(item, `"`, `\"`, -1)
+		quoted = append(quoted, `"`+item+`"`)
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// likeChildren returns LIKE pattern matching all descendants of "path"
+func likeChildren(path string) string {
+	if isRoot(path) {
+		return "/%"
+	}
+	// NOTE: `_` is a wildcard for LIKE, but it's allowed in paths
+	return strings.Replace(path, "_", `\_`, -1) + "/%"
+}
+
+// parentDirectories returns all parent directories of "path" except the root
+func parentDirectories(path string) []string {
+	var parents []string
+	for dir := filepath.Dir(path); !isRoot(dir) && dir != "."; dir = filepath.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	return parents
+}
+
+// materializeDirectories creates missing directory rows for all files under "path".
+// Nothing is done if "path" is stored already or there's nothing under it,
+// so misses of files and accesses of materialized directories cost two index lookups.
+// For the root nothing is done unless any file misses its parent.
+// It reports whether any directory has been created.
+func (d *driver) materializeDirectories(ctx context.Context, path string) (bool, error) {
+	if !isRoot(path) {
+		var stored, implicit bool
+		err := d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q(`SELECT EXISTS (SELECT 1 FROM {mfs} WHERE path = $1),
+			EXISTS (SELECT 1 FROM {mfs} WHERE path LIKE $2)`), path, likeChildren(path)).Scan(&stored, &implicit)
+		if err != nil {
+			return false, err
+		}
+		if stored || !implicit {
+			return false, nil
+		}
+	} else {
+		// NOTE: the root is never stored, so it's checked for any orphan file
+		var ph interface{}
+		switch err := d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q(`SELECT 1 FROM {mfs} f
+			WHERE f.parent <> '/' AND NOT EXISTS (SELECT 1 FROM {mfs} p WHERE p.path = f.parent) LIMIT 1`)).Scan(&ph); err {
+		case sql.ErrNoRows:
+			return false, nil
+		case nil:
+			// pass
+		default:
+			return false, err
+		}
+	}
+
+	tx, err := d.cluster.DB(pgcluster.MASTER).BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, d.q(`
+		SELECT f.path, f.owner FROM {mfs} f
+		WHERE f.path LIKE $1 AND f.parent <> '/' AND NOT EXISTS (SELECT 1 FROM {mfs} p WHERE p.path = f.parent)
+	`), likeChildren(path))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	type orphan struct {
+		path  string
+		owner sql.NullString
+	}
+
+	var orphans []orphan
+	for rows.Next() {
+		var item orphan
+		if err = rows.Scan(&item.path, &item.owner); err != nil {
+			return false, err
+		}
+		orphans = append(orphans, item)
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	if len(orphans) == 0 {
+		return false, nil
+	}
+
+	context.GetLoggerWithField(ctx, "path", path).Debugf("materialize directories for %d files", len(orphans))
+	for _, item := range orphans {
+		var owner interface{}
+		if item.owner.Valid {
+			owner = item.owner.String
+		}
+
+		if err = d.insertParentDirectories(ctx, tx, item.path, owner); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// checkLazyParentDirectories verifies that no parent of "path" is a file
+// and "path" is not an implicit directory. Parents missing under
+// a materialized directory are created.
+func (d *driver) checkLazyParentDirectories(ctx context.Context, tx *sql.Tx, path string, owner interface{}) error {
+	if parents := parentDirectories(path); len(parents) != 0 {
+		missing, err := d.missingLazyParents(ctx, tx, path, parents)
+		if err != nil {
+			return err
+		}
+
+		if err = d.insertDirectories(ctx, tx, path, missing, owner); err != nil {
+			return err
+		}
+	}
+
+	var ph interface{}
+	switch err := tx.QueryRowContext(ctx, d.q("SELECT 1 FROM {mfs} WHERE path LIKE $1 LIMIT 1"), likeChildren(path)).Scan(&ph); err {
+	case nil:
+		return fmt.Errorf("unable to rewrite directory by file: %s", path)
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+// missingLazyParents returns parents of "path" missing under the topmost
+// existing one. Parents are ordered from the deepest one like by parentDirectories.
+// It fails if any of parents is a file.
+func (d *driver) missingLazyParents(ctx context.Context, tx *sql.Tx, path string, parents []string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, d.q("SELECT path, dir FROM {mfs} WHERE path = ANY($1::text[])"), textArray(parents))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool, len(parents))
+	for rows.Next() {
+		var (
+			parent string
+			dir    bool
+		)
+		if err = rows.Scan(&parent, &dir); err != nil {
+			return nil, err
+		}
+		if !dir {
+			return nil, fmt.Errorf("unable to rewrite file by directory: %s", path)
+		}
+		existing[parent] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for top := len(parents) - 1; top >= 0; top-- {
+		if !existing[parents[top]] {
+			continue
+		}
+
+		var missing []string
+		for _, parent := range parents[:top] {
+			if !existing[parent] {
+				missing = append(missing, parent)
+			}
+		}
+		return missing, nil
+	}
+	return nil, nil
+}
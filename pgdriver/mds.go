@@ -1,16 +1,21 @@
 package pgdriver
 
 import (
+	"bufio"
 	"bytes"
 	"database/sql"
 	sqldriver "database/sql/driver"
-	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"reflect"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/distribution/context"
@@ -18,60 +23,102 @@ import (
 	"github.com/noxiouz/expvarmetrics"
 	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
 	"github.com/noxiouz/mds"
+	netcontext "golang.org/x/net/context"
 
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 )
 
 const (
-	tableMDS = "mds"
+	defaultMDSDialTimeout         = 3 * time.Second
+	defaultMDSMaxIdleConnsPerHost = 10
+	defaultMDSGetAttempts         = 3
+	defaultMDSGetRetryDelay       = 50 * time.Millisecond
 )
 
-type metaInfo struct {
-	Key  string `json:"key"`
-	Size int64  `json:"size"`
-	ID   string `json:"id"`
-}
-
-func (m *metaInfo) Value() (sqldriver.Value, error) {
-	return json.Marshal(m)
-}
-
-func (m *metaInfo) Scan(src interface{}) error {
-	switch body := src.(type) {
-	case []byte:
-		return json.Unmarshal(body, m)
-	default:
-		return fmt.Errorf("can not Scan from non []byte type: %v", reflect.TypeOf(body))
-	}
-}
-
 type mdsBinStorage struct {
 	*pgcluster.Cluster
+	*sqlTables
 	Storage   *mds.Client
 	Namespace string
+
+	// RedirectHost and RedirectScheme replace host and scheme
+	// of URLs returned by URLFor
+	RedirectHost   string
+	RedirectScheme string
+	// SignedURLTTL is the lifetime of signed links.
+	// Signed links are not supported if it is not set.
+	SignedURLTTL time.Duration
+
+	// requestTimeout bounds uploads and deletes as a whole
+	requestTimeout time.Duration
+	// serializer encodes metainformation stored in mds table
+	serializer metaSerializer
+
+	dialer    *net.Dialer
+	transport *http.Transport
 }
 
-func newMDSBinStorage(cluster *pgcluster.Cluster, parameters map[string]interface{}) (KVStorage, error) {
+func newMDSBinStorage(cluster *pgcluster.Cluster, tables *sqlTables, parameters map[string]interface{}) (KVStorage, error) {
 	var config struct {
 		mds.Config `mapstructure:",squash"`
 		Namespace  string
+
+		RedirectHost   string
+		RedirectScheme string
+		SignedURLTTL   time.Duration
+
+		DialTimeout           time.Duration
+		TLSHandshakeTimeout   time.Duration
+		ResponseHeaderTimeout time.Duration
+		MaxIdleConnsPerHost   int
+		// RequestTimeout bounds uploads and deletes as a whole
+		RequestTimeout time.Duration
+		// MetaEncoding is json (default) or compact
+		MetaEncoding string
+		// AuthHeaderFile keeps the Authorization header instead of AuthHeader.
+		// It's re-read once modified, so rotated tokens work without restart.
+		AuthHeaderFile string
 	}
 
+	config.DialTimeout = defaultMDSDialTimeout
+	// This value is set according to the current amount of DB Idle conns
+	config.MaxIdleConnsPerHost = defaultMDSMaxIdleConnsPerHost
+	config.GetAttempts = defaultMDSGetAttempts
+	config.GetRetryDelay = defaultMDSGetRetryDelay
 	if err := decodeConfig(parameters, &config); err != nil {
 		return nil, err
 	}
 
+	serializer, ok := metaSerializers[config.MetaEncoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding of metainformation %s", config.MetaEncoding)
+	}
+
+	if config.MaxIdleConnsPerHost <= 0 {
+		return nil, fmt.Errorf("MaxIdleConnsPerHost must be positive: %d", config.MaxIdleConnsPerHost)
+	}
+
+	dialer := &net.Dialer{
+		DualStack: true,
+		Timeout:   config.DialTimeout,
+	}
+
 	tr := &http.Transport{
-		// TODO: make it configurable
-		Dial: func(network, addr string) (net.Conn, error) {
-			d := net.Dialer{
-				DualStack: true,
-				Timeout:   time.Second * 3,
-			}
-			return d.Dial(network, addr)
-		},
-		// This value is set according to the current amount of DB Idle conns
-		MaxIdleConnsPerHost: 10,
+		Dial:                  dialer.Dial,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+	}
+
+	if config.AuthHeaderFile != "" {
+		if config.AuthHeader != "" {
+			return nil, fmt.Errorf("AuthHeader and AuthHeaderFile are mutually exclusive")
+		}
+		auth := &fileAuthHeader{path: config.AuthHeaderFile}
+		if _, err := auth.get(context.Background()); err != nil {
+			return nil, err
+		}
+		config.AuthProvider = auth.get
 	}
 
 	mdsClient, err := mds.NewClient(config.Config, &http.Client{Transport: tr})
@@ -81,17 +128,133 @@ func newMDSBinStorage(cluster *pgcluster.Cluster, parameters map[string]interfac
 
 	return &mdsBinStorage{
 		Cluster:   cluster,
+		sqlTables: tables,
 		Storage:   mdsClient,
 		Namespace: config.Namespace,
+
+		RedirectHost:   config.RedirectHost,
+		RedirectScheme: config.RedirectScheme,
+		SignedURLTTL:   config.SignedURLTTL,
+
+		requestTimeout: config.RequestTimeout,
+		serializer:     serializer,
+
+		dialer:    dialer,
+		transport: tr,
 	}, nil
 }
 
+// fileAuthHeader reads the Authorization header from a file.
+// The file is re-read only if its modification time has changed.
+type fileAuthHeader struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	header  string
+}
+
+func (f *fileAuthHeader) get(netcontext.Context) (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !info.ModTime().Equal(f.modTime) {
+		content, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return "", err
+		}
+		f.header = strings.TrimSpace(string(content))
+		f.modTime = info.ModTime()
+	}
+	return f.header, nil
+}
+
+// encode encodes metainformation with the configured serializer
+func (m *mdsBinStorage) encode(meta *metaInfo) sqldriver.Valuer {
+	return encodedMetaInfo{metaInfo: meta, serializer: m.serializer}
+}
+
+// timeoutError means that a request to MDS has timed out.
+// Unlike 5xx replies it is worth retrying, so it's reported as net.Error.
+type timeoutError struct {
+	op  string
+	err error
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("MDS %s timed out: %v", e.op, e.err)
+}
+
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// asTimeout wraps err into timeoutError if a request has timed out
+func asTimeout(ctx context.Context, op string, err error) error {
+	if nerr, ok := err.(net.Error); (ok && nerr.Timeout()) || ctx.Err() == netcontext.DeadlineExceeded {
+		return timeoutError{op: op, err: err}
+	}
+	return err
+}
+
+// withTimeout bounds a request by requestTimeout if it is set
+func (m *mdsBinStorage) withTimeout(ctx context.Context) (context.Context, func()) {
+	if m.requestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return netcontext.WithTimeout(ctx, m.requestTimeout)
+}
+
+func (m *mdsBinStorage) upload(ctx context.Context, key string, size int64, data io.Reader) (*mds.UploadInfo, error) {
+	tctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	uinfo, err := m.Storage.Upload(tctx, m.Namespace, key, size, data)
+	if err != nil {
+		mdsUploadErrors.Add(m.Namespace, 1)
+		return nil, asTimeout(tctx, "upload", err)
+	}
+	return uinfo, nil
+}
+
+func (m *mdsBinStorage) deleteObject(ctx context.Context, mdsKey string) error {
+	tctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	err := m.Storage.Delete(tctx, m.Namespace, mdsKey)
+	if merr, ok := err.(mds.MethodError); ok && merr.IsNotFound() {
+		// NOTE: the object is gone already, e.g. by a retried delete
+		return nil
+	}
+
+	if err != nil {
+		mdsDeleteErrors.Add(m.Namespace, 1)
+		return asTimeout(tctx, "delete", err)
+	}
+	return nil
+}
+
+func (m *mdsBinStorage) getObject(ctx context.Context, mdsKey string, offset ...uint64) (io.ReadCloser, error) {
+	body, err := m.Storage.Get(ctx, m.Namespace, mdsKey, offset...)
+	switch err.(type) {
+	case nil:
+		return body, nil
+	case mds.ErrRangeNotSatisfiable:
+		// NOTE: it's a reply of a healthy MDS, so it's not counted
+		return nil, err
+	default:
+		mdsGetErrors.Add(m.Namespace, 1)
+		return nil, err
+	}
+}
+
 func (m *mdsBinStorage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
 	return m.store(ctx, key, data, getContentSize(ctx))
 }
 
 func (m *mdsBinStorage) store(ctx context.Context, key string, data io.Reader, size int64) (int64, error) {
-	uinfo, err := m.Storage.Upload(ctx, m.Namespace, key, size, data)
+	uinfo, err := m.upload(ctx, key, size, data)
 	if err != nil {
 		return 0, err
 	}
@@ -102,9 +265,9 @@ func (m *mdsBinStorage) store(ctx context.Context, key string, data io.Reader, s
 		ID:   uinfo.ID,
 	}
 
-	_, err = m.DB(pgcluster.MASTER).Exec("INSERT INTO mds (key, mdsfileinfo) VALUES ($1, $2)", key, meta)
+	_, err = m.DB(pgcluster.MASTER).Exec(m.q("INSERT INTO {mds} (key, mdsfileinfo) VALUES ($1, $2)"), key, m.encode(meta))
 	if err != nil {
-		if mdserr := m.Storage.Delete(ctx, m.Namespace, uinfo.Key); mdserr != nil {
+		if mdserr := m.deleteObject(ctx, uinfo.Key); mdserr != nil {
 			context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"error": mdserr, "key": uinfo.Key}).Error("can not clean MDS after DB error")
 		}
 		return 0, err
@@ -119,25 +282,87 @@ func (m *mdsBinStorage) Get(ctx context.Context, key string, offset int64) (io.R
 		return nil, err
 	}
 
+	return m.read(ctx, metainfo, offset)
+}
+
+// getByPath reads the object of the file stored at path
+func (m *mdsBinStorage) getByPath(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	metainfo, err := m.resolvePath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.read(ctx, metainfo, offset)
+}
+
+func (m *mdsBinStorage) read(ctx context.Context, metainfo *metaInfo, offset int64) (io.ReadCloser, error) {
 	if offset >= metainfo.Size {
 		return ioutil.NopCloser(bytes.NewReader(make([]byte, 0))), nil
 	}
 
-	return m.Storage.Get(ctx, m.Namespace, metainfo.Key, uint64(offset))
+	body, err := m.getObject(ctx, metainfo.Key, uint64(offset))
+	// NOTE: the object may be shorter than recorded, e.g. if an append
+	// has not been recorded yet. Reading at its end is not an error.
+	if rerr, ok := err.(mds.ErrRangeNotSatisfiable); ok && rerr.Size >= 0 && offset >= rerr.Size {
+		return ioutil.NopCloser(bytes.NewReader(make([]byte, 0))), nil
+	}
+	return body, err
 }
 
-func (m *mdsBinStorage) Delete(ctx context.Context, key string) error {
+// resolvePath returns metainformation about the object of the file stored at path.
+// The file and its object are resolved by a single query.
+func (m *mdsBinStorage) resolvePath(ctx context.Context, path string) (*metaInfo, error) {
+	var (
+		isDir   bool
+		key     sql.NullString
+		info    []byte
+		deleted sql.NullBool
+	)
+
+	err := m.DB(pgcluster.MASTER).QueryRow(m.q(`SELECT {mfs}.dir, {mfs}.key, {mds}.mdsfileinfo, {mds}.deleted
+		FROM {mfs} LEFT JOIN {mds} ON {mfs}.key = {mds}.key WHERE {mfs}.path = $1`), path).Scan(&isDir, &key, &info, &deleted)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case err != nil:
+		return nil, err
+	case isDir:
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case !key.Valid:
+		return nil, errNoKVObject
+	case info == nil || deleted.Bool:
+		// NOTE: the object is missing or deleted, like in getMDSMetaInfo
+		return nil, storagedriver.PathNotFoundError{Path: key.String, DriverName: driverName}
+	}
+
+	var metainfo metaInfo
+	if err = metainfo.Scan(info); err != nil {
+		return nil, err
+	}
+	return &metainfo, nil
+}
+
+func (m *mdsBinStorage) Size(ctx context.Context, key string) (int64, error) {
 	metainfo, err := m.getMDSMetaInfo(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return metainfo.Size, nil
+}
+
+// Delete deletes an object from MDS. The key may be marked deleted already.
+func (m *mdsBinStorage) Delete(ctx context.Context, key string) error {
+	metainfo, err := m.queryMDSMetaInfo(ctx, "SELECT mdsfileinfo FROM {mds} WHERE (key = $1)", key)
 	if err != nil {
 		return err
 	}
 
-	if err = m.Storage.Delete(ctx, m.Namespace, metainfo.Key); err != nil {
+	if err = m.deleteObject(ctx, metainfo.Key); err != nil {
 		return err
 	}
 
-	// Mark deleted
-	_, err = m.DB(pgcluster.MASTER).Exec("UPDATE mds SET deleted = true WHERE (key = $1)", key)
+	// Mark deleted and confirm that the object is gone
+	_, err = m.DB(pgcluster.MASTER).Exec(m.q("UPDATE {mds} SET (deleted, purged) = (true, true) WHERE (key = $1)"), key)
 	if err != nil {
 		context.GetLogger(ctx).Errorf("update metainfo about deleted key %s error: %v", key, err)
 		return err
@@ -146,19 +371,207 @@ func (m *mdsBinStorage) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+func (m *mdsBinStorage) markDeleted(tx *sql.Tx, deleteID string) error {
+	_, err := tx.Exec(m.q(`UPDATE {mds} SET deleted = true FROM {mfs_delete_journal}
+		WHERE {mfs_delete_journal}.delete_id = $1 AND {mds}.key = {mfs_delete_journal}.key`), deleteID)
+	return err
+}
+
+// SweepDeleted physically deletes objects marked deleted from MDS
+// and removes their rows. It processes batchSize keys per transaction.
+// Locked rows are skipped, so it is safe to run several sweepers
+// along with the registry. Rows of failed keys are left intact.
+func (m *mdsBinStorage) SweepDeleted(ctx context.Context, batchSize int) (swept int, failed int, err error) {
+	if batchSize <= 0 {
+		return 0, 0, fmt.Errorf("invalid batch size %d", batchSize)
+	}
+
+	var failedKeys []string
+	for {
+		n, keys, err := m.sweepBatch(ctx, batchSize, failedKeys)
+		swept += n
+		failedKeys = append(failedKeys, keys...)
+		if err != nil || n+len(keys) == 0 {
+			return swept, len(failedKeys), err
+		}
+	}
+}
+
+// ErrCompactionInProgress means that mds table is being compacted by another process
+var ErrCompactionInProgress = errors.New("mds compaction is in progress")
+
+// CompactMDS physically removes rows of mds table, whose objects are gone
+// and no file refers to. VACUUM is run afterwards if vacuum is set.
+// Compaction is serialized between processes by an advisory lock.
+func (d *Driver) CompactMDS(ctx context.Context, vacuum bool) (int64, error) {
+	m, ok := d.drv.storage.(*mdsBinStorage)
+	if !ok {
+		return 0, fmt.Errorf("compaction is supported by MDS backend only")
+	}
+	return m.CompactMDS(ctx, vacuum)
+}
+
+// CompactMDS physically removes rows of purged objects
+func (m *mdsBinStorage) CompactMDS(ctx context.Context, vacuum bool) (int64, error) {
+	db := m.DB(pgcluster.MASTER)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// NOTE: the lock is released on commit
+	var locked bool
+	if err = tx.QueryRow("SELECT pg_try_advisory_xact_lock(hashtext($1))", "compact:"+m.mds).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, ErrCompactionInProgress
+	}
+
+	result, err := tx.Exec(m.q(`DELETE FROM {mds} WHERE deleted AND purged
+		AND NOT EXISTS (SELECT 1 FROM {mfs} WHERE {mfs}.key = {mds}.key)`))
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"removed": removed}).Info("mds table compacted")
+	if vacuum {
+		// NOTE: VACUUM can not be run inside a transaction
+		if _, err = db.Exec(m.q("VACUUM {mds}")); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// CompactMetadata reclaims space of metadata tables. Rows of mds table
+// are removed like by CompactMDS, then VACUUM (ANALYZE) is run on mfs and mds.
+// NOTE: rows of objects marked deleted, but not swept yet are kept,
+// as SweepDeleted needs them to delete objects from MDS.
+// It returns the number of removed rows.
+func (d *Driver) CompactMetadata(ctx context.Context) (int64, error) {
+	var removed int64
+	tables := []string{d.drv.meta}
+	if m, ok := d.drv.storage.(*mdsBinStorage); ok {
+		var err error
+		if removed, err = m.CompactMDS(ctx, false); err != nil {
+			return 0, err
+		}
+		tables = append(tables, d.drv.mds)
+	}
+
+	// NOTE: VACUUM can not be run inside a transaction. A statement
+	// without arguments is sent as a simple query, which runs outside of it.
+	db := d.drv.cluster.DB(pgcluster.MASTER)
+	for _, table := range tables {
+		if _, err := db.ExecContext(ctx, "VACUUM (ANALYZE) "+table); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// SweepDeleted physically deletes objects marked deleted from MDS backend.
+// It returns counts of swept and failed keys.
+func (d *Driver) SweepDeleted(ctx context.Context, batchSize int) (swept int, failed int, err error) {
+	m, ok := d.drv.storage.(*mdsBinStorage)
+	if !ok {
+		return 0, 0, fmt.Errorf("sweeping is supported by MDS backend only")
+	}
+	return m.SweepDeleted(ctx, batchSize)
+}
+
+// sweepBatch sweeps one batch of deleted keys skipping the failed ones
+func (m *mdsBinStorage) sweepBatch(ctx context.Context, batchSize int, skip []string) (int, []string, error) {
+	tx, err := m.DB(pgcluster.MASTER).Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(m.q(`SELECT key, mdsfileinfo FROM {mds} WHERE deleted AND NOT purged AND NOT (key = ANY($1::text[]))
+		LIMIT $2 FOR UPDATE SKIP LOCKED`), textArray(skip), batchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		keys  []string
+		metas []metaInfo
+	)
+	for rows.Next() {
+		var (
+			key  string
+			meta metaInfo
+		)
+		if err = rows.Scan(&key, &meta); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		keys = append(keys, key)
+		metas = append(metas, meta)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		swept  int
+		failed []string
+	)
+	for i, key := range keys {
+		if err = m.deleteObject(ctx, metas[i].Key); err != nil {
+			context.GetLoggerWithFields(ctx, map[interface{}]interface{}{"key": key, "error": err.Error()}).Error("unable to sweep MDS object")
+			failed = append(failed, key)
+			continue
+		}
+
+		if _, err = tx.Exec(m.q("DELETE FROM {mds} WHERE key = $1"), key); err != nil {
+			return 0, nil, err
+		}
+		swept++
+	}
+
+	return swept, failed, tx.Commit()
+}
+
 func (m *mdsBinStorage) Append(ctx context.Context, key string, data io.Reader) (int64, error) {
 	metainfo, err := m.getMDSMetaInfo(ctx, key)
 	switch err.(type) {
 	case storagedriver.PathNotFoundError:
 		return m.Store(ctx, key, data)
 	case nil:
+		// NOTE: upload of MDS stores a whole object under a key assigned by MDS,
+		// there is no way to write at an offset. So appended data is proxied
+		// along with the existing object unless there is nothing to append.
+		appended := bufio.NewReader(data)
+		if _, err = appended.Peek(1); err == io.EOF {
+			return metainfo.Size, nil
+		}
+		data = appended
+
 		size := getContentSize(ctx)
 		// NOTE: Append to a file is NOT expected to be used in MDS,
-		// but noresumable tag does not work in distribution
+		// but noresumable tag does not work in distribution.
+		// DisableResumableUploads keeps the registry from appending.
 		context.GetLogger(ctx).Warnf("Append via Read/Delete is ineffective in MDS: %d %s %v", size, key, metainfo)
 		var begining io.ReadCloser
-		begining, err = m.Storage.Get(ctx, m.Namespace, metainfo.Key)
+		begining, err = m.getObject(ctx, metainfo.Key)
 		if err != nil {
+			mdsAppendProxyErrors.Add(m.Namespace, 1)
 			context.GetLogger(ctx).Errorf("Unable to read MDS File %s: %v", metainfo.Key, err)
 			return 0, err
 		}
@@ -171,9 +584,9 @@ func (m *mdsBinStorage) Append(ctx context.Context, key string, data io.Reader)
 
 		mr := io.MultiReader(
 			// trackProxy counts proxied bytes
-			io.TeeReader(begining, trackProxy{}),
+			io.TeeReader(begining, trackProxy{meter: proxiedBytesMeter(m.Namespace)}),
 			// appendTracer is injected to trace the end of proxying
-			appendTracer{ctx: ctx, start: time.Now()},
+			appendTracer{ctx: ctx, start: time.Now(), timer: appendProxyTimer(m.Namespace)},
 			// actual data
 			data)
 
@@ -182,8 +595,9 @@ func (m *mdsBinStorage) Append(ctx context.Context, key string, data io.Reader)
 			newKey = generateKey()
 		)
 
-		uinfo, err = m.Storage.Upload(ctx, m.Namespace, newKey, size, mr)
+		uinfo, err = m.upload(ctx, newKey, size, mr)
 		if err != nil {
+			mdsAppendProxyErrors.Add(m.Namespace, 1)
 			return 0, err
 		}
 
@@ -194,14 +608,14 @@ func (m *mdsBinStorage) Append(ctx context.Context, key string, data io.Reader)
 		}
 
 		// Set new metainfo for an old key
-		_, err = m.DB(pgcluster.MASTER).Exec("UPDATE mds SET mdsfileinfo = $1 WHERE (key = $2)", newMeta, key)
+		_, err = m.DB(pgcluster.MASTER).Exec(m.q("UPDATE {mds} SET mdsfileinfo = $1 WHERE (key = $2)"), m.encode(newMeta), key)
 		if err != nil {
 			context.GetLogger(ctx).Errorf("update metainfo about deleted key %s error: %v", key, err)
 			return 0, err
 		}
 
 		// Try to clean MDS
-		if err = m.Storage.Delete(ctx, m.Namespace, metainfo.Key); err != nil {
+		if err = m.deleteObject(ctx, metainfo.Key); err != nil {
 			context.GetLogger(ctx).Errorf("Unable to delete from MDS %s: %v", metainfo.Key, err)
 		}
 
@@ -217,12 +631,77 @@ func (m *mdsBinStorage) URLFor(ctx context.Context, key string, resolveRedirect
 		return "", err
 	}
 
-	return m.Storage.ReadURL(ctx, m.Namespace, metainfo.Key, resolveRedirect)
+	readURL, err := m.Storage.ReadURL(ctx, m.Namespace, metainfo.Key, resolveRedirect)
+	if err != nil {
+		return "", err
+	}
+
+	return m.publicURL(readURL)
+}
+
+// SignedURLFor returns a signed direct link to an object.
+// Links live for SignedURLTTL, so a later expiry is refused.
+func (m *mdsBinStorage) SignedURLFor(ctx context.Context, key string, expiry time.Time) (string, error) {
+	if m.SignedURLTTL <= 0 {
+		return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+
+	if expiry.After(time.Now().Add(m.SignedURLTTL)) {
+		return "", fmt.Errorf("expiry %v exceeds lifetime of signed URLs %v", expiry, m.SignedURLTTL)
+	}
+
+	metainfo, err := m.getMDSMetaInfo(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	tctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	info, err := m.Storage.DownloadInfo(tctx, m.Namespace, metainfo.Key)
+	if err != nil {
+		return "", asTimeout(tctx, "downloadinfo", err)
+	}
+
+	return info.URL(), nil
+}
+
+// publicURL replaces host and scheme of MDS URL with public ones if they're configured.
+// Path and query are preserved.
+func (m *mdsBinStorage) publicURL(rawurl string) (string, error) {
+	if m.RedirectHost == "" && m.RedirectScheme == "" {
+		return rawurl, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	if m.RedirectHost != "" {
+		u.Host = m.RedirectHost
+	}
+
+	if m.RedirectScheme != "" {
+		u.Scheme = m.RedirectScheme
+	}
+
+	return u.String(), nil
+}
+
+// Close closes idle connections to MDS.
+// The cluster is owned by the driver, so it's not closed here.
+func (m *mdsBinStorage) Close() error {
+	m.transport.CloseIdleConnections()
+	return nil
 }
 
 func (m *mdsBinStorage) getMDSMetaInfo(ctx context.Context, key string) (*metaInfo, error) {
+	return m.queryMDSMetaInfo(ctx, "SELECT mdsfileinfo FROM {mds} WHERE (key = $1 and NOT deleted)", key)
+}
+
+func (m *mdsBinStorage) queryMDSMetaInfo(ctx context.Context, query string, key string) (*metaInfo, error) {
 	var mdsmeta metaInfo
-	err := m.DB(pgcluster.MASTER).QueryRow("SELECT mdsfileinfo FROM mds WHERE (key = $1 and NOT deleted)", key).Scan(&mdsmeta)
+	err := m.DB(pgcluster.MASTER).QueryRow(m.q(query), key).Scan(&mdsmeta)
 	switch err {
 	case sql.ErrNoRows:
 		return nil, storagedriver.PathNotFoundError{Path: key, DriverName: driverName}
@@ -235,14 +714,59 @@ func (m *mdsBinStorage) getMDSMetaInfo(ctx context.Context, key string) (*metaIn
 
 // NOTE: utils to track the uploading process
 
-var bytesProxiedInAppend = expvarmetrics.NewMeterVar()
+// bytes proxied and duration of proxying in Append by namespace
+var (
+	bytesProxiedInAppend = new(expvar.Map).Init()
+	appendProxyDuration  = new(expvar.Map).Init()
+
+	appendMetricsMu sync.Mutex
+)
+
+// namespaceVar returns the var of namespace in m registering it lazily
+func namespaceVar(m *expvar.Map, namespace string, newVar func() expvar.Var) expvar.Var {
+	if v := m.Get(namespace); v != nil {
+		return v
+	}
+
+	appendMetricsMu.Lock()
+	defer appendMetricsMu.Unlock()
+	if v := m.Get(namespace); v != nil {
+		return v
+	}
+	v := newVar()
+	m.Set(namespace, v)
+	return v
+}
+
+func proxiedBytesMeter(namespace string) expvarmetrics.MeterVar {
+	return namespaceVar(bytesProxiedInAppend, namespace, func() expvar.Var {
+		return expvarmetrics.NewMeterVar()
+	}).(expvarmetrics.MeterVar)
+}
+
+func appendProxyTimer(namespace string) expvarmetrics.TimerVar {
+	return namespaceVar(appendProxyDuration, namespace, func() expvar.Var {
+		return expvarmetrics.NewTimerVar()
+	}).(expvarmetrics.TimerVar)
+}
+
+// failed requests to MDS by namespace.
+// Failed proxying in Append is counted on top of failed requests.
+var (
+	mdsUploadErrors      = new(expvar.Map).Init()
+	mdsGetErrors         = new(expvar.Map).Init()
+	mdsDeleteErrors      = new(expvar.Map).Init()
+	mdsAppendProxyErrors = new(expvar.Map).Init()
+)
 
 // trackProxy is injected to count how many bytes have been proxied
 // inside append
-type trackProxy struct{}
+type trackProxy struct {
+	meter expvarmetrics.MeterVar
+}
 
-func (trackProxy) Write(p []byte) (int, error) {
-	bytesProxiedInAppend.Mark(int64(len(p)))
+func (t trackProxy) Write(p []byte) (int, error) {
+	t.meter.Mark(int64(len(p)))
 	return 0, nil
 }
 
@@ -251,9 +775,11 @@ func (trackProxy) Write(p []byte) (int, error) {
 type appendTracer struct {
 	ctx   context.Context
 	start time.Time
+	timer expvarmetrics.TimerVar
 }
 
 func (t appendTracer) Read([]byte) (int, error) {
+	t.timer.UpdateSince(t.start)
 	context.GetLogger(t.ctx).Infof("an appended key has been proxied for %v", time.Now().Sub(t.start))
 	return 0, io.EOF
 }
@@ -0,0 +1,540 @@
+package pgdriver
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/mds"
+	netcontext "golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+type MDSSuite struct{}
+
+var _ = Suite(&MDSSuite{})
+
+func (s *MDSSuite) newStorage(c *C, options map[string]interface{}) *mdsBinStorage {
+	tables, err := newSQLTables("", "", "")
+	c.Assert(err, IsNil)
+
+	st, err := newMDSBinStorage(nil, tables, options)
+	c.Assert(err, IsNil)
+	return st.(*mdsBinStorage)
+}
+
+func (s *MDSSuite) TestPublicURL(c *C) {
+	m := s.newStorage(c, map[string]interface{}{
+		"host":           "mds.internal",
+		"readport":       80,
+		"namespace":      "registry",
+		"redirecthost":   "storage.example.com",
+		"redirectscheme": "https",
+	})
+
+	u, err := m.publicURL("http://mds.internal:80/get-registry/key?redirect=yes")
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, "https://storage.example.com/get-registry/key?redirect=yes")
+
+	m = s.newStorage(c, map[string]interface{}{"host": "mds.internal"})
+	u, err = m.publicURL("http://mds.internal:80/get-registry/key")
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, "http://mds.internal:80/get-registry/key")
+}
+
+func (s *MDSSuite) TestNamespaceAuthHeaders(c *C) {
+	var (
+		mu      sync.Mutex
+		headers = make(map[string]string)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers[r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	c.Assert(err, IsNil)
+	port, err := strconv.Atoi(u.Port())
+	c.Assert(err, IsNil)
+
+	m := s.newStorage(c, map[string]interface{}{
+		"host":       u.Hostname(),
+		"uploadport": port,
+		"readport":   port,
+		"authheader": "default",
+		"namespaceauthheaders": map[string]interface{}{
+			"tenant1": "token1",
+			"tenant2": "token2",
+		},
+	})
+
+	ctx := context.Background()
+	for _, namespace := range []string{"tenant1", "tenant2", "registry"} {
+		c.Assert(m.Storage.Delete(ctx, namespace, "key"), IsNil)
+	}
+
+	c.Assert(headers, DeepEquals, map[string]string{
+		"/delete-tenant1/key":  "token1",
+		"/delete-tenant2/key":  "token2",
+		"/delete-registry/key": "default",
+	})
+}
+
+func (s *MDSSuite) TestTransportOptions(c *C) {
+	m := s.newStorage(c, map[string]interface{}{"host": "mds.internal"})
+	c.Assert(m.dialer.Timeout, Equals, 3*time.Second)
+	c.Assert(m.transport.TLSHandshakeTimeout, Equals, time.Duration(0))
+	c.Assert(m.transport.MaxIdleConnsPerHost, Equals, 10)
+
+	m = s.newStorage(c, map[string]interface{}{
+		"host":                "mds.internal",
+		"dialtimeout":         int64(time.Second),
+		"tlshandshaketimeout": int64(2 * time.Second),
+		"maxidleconnsperhost": 100,
+	})
+	c.Assert(m.dialer.Timeout, Equals, time.Second)
+	c.Assert(m.transport.TLSHandshakeTimeout, Equals, 2*time.Second)
+	c.Assert(m.transport.MaxIdleConnsPerHost, Equals, 100)
+
+	tables, err := newSQLTables("", "", "")
+	c.Assert(err, IsNil)
+	for _, n := range []int{0, -1} {
+		_, err = newMDSBinStorage(nil, tables, map[string]interface{}{"host": "mds.internal", "maxidleconnsperhost": n})
+		c.Assert(err, ErrorMatches, "MaxIdleConnsPerHost must be positive: .*")
+	}
+}
+
+// newFakeMDS returns storage talking to a fake MDS served by handler
+func (s *MDSSuite) newFakeMDS(c *C, handler http.HandlerFunc, options map[string]interface{}) (*mdsBinStorage, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+
+	u, err := url.Parse(ts.URL)
+	c.Assert(err, IsNil)
+	port, err := strconv.Atoi(u.Port())
+	c.Assert(err, IsNil)
+
+	options["host"] = u.Hostname()
+	options["uploadport"] = port
+	options["readport"] = port
+	return s.newStorage(c, options), ts
+}
+
+func (s *MDSSuite) TestResponseHeaderTimeout(c *C) {
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}, map[string]interface{}{"responseheadertimeout": int64(100 * time.Millisecond)})
+	defer ts.Close()
+
+	start := time.Now()
+	_, err := m.upload(context.Background(), "key", 4, strings.NewReader("data"))
+	c.Assert(err, FitsTypeOf, timeoutError{})
+	c.Assert(time.Since(start) < 400*time.Millisecond, Equals, true)
+}
+
+func (s *MDSSuite) TestRequestTimeout(c *C) {
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}, map[string]interface{}{"requesttimeout": int64(100 * time.Millisecond)})
+	defer ts.Close()
+
+	_, err := m.upload(context.Background(), "key", 4, strings.NewReader("data"))
+	c.Assert(err, FitsTypeOf, timeoutError{})
+	c.Assert(m.deleteObject(context.Background(), "1/key"), FitsTypeOf, timeoutError{})
+}
+
+func (s *MDSSuite) TestServerErrorIsNotTimeout(c *C) {
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}, map[string]interface{}{"requesttimeout": int64(time.Second)})
+	defer ts.Close()
+
+	_, err := m.upload(context.Background(), "key", 4, strings.NewReader("data"))
+	c.Assert(err, FitsTypeOf, mds.MethodError{})
+}
+
+func (s *MDSSuite) TestMetaSerializers(c *C) {
+	meta := &metaInfo{Key: "123/key", Size: 42, ID: "abcdef"}
+	for name, serializer := range metaSerializers {
+		value, err := encodedMetaInfo{metaInfo: meta, serializer: serializer}.Value()
+		c.Assert(err, IsNil)
+
+		var body []byte
+		switch v := value.(type) {
+		case []byte:
+			body = v
+		case string:
+			body = []byte(v)
+		}
+
+		var decoded metaInfo
+		c.Assert(decoded.Scan(body), IsNil, Commentf("%s", name))
+		c.Assert(decoded, DeepEquals, *meta, Commentf("%s", name))
+	}
+
+	// legacy JSON
+	var legacy metaInfo
+	c.Assert(legacy.Scan([]byte(`{"key":"123/key","size":42,"id":"abcdef"}`)), IsNil)
+	c.Assert(legacy, DeepEquals, *meta)
+
+	tables, err := newSQLTables("", "", "")
+	c.Assert(err, IsNil)
+	_, err = newMDSBinStorage(nil, tables, map[string]interface{}{"host": "mds.internal", "metaencoding": "xml"})
+	c.Assert(err, ErrorMatches, "unsupported encoding of metainformation xml")
+
+	m := s.newStorage(c, map[string]interface{}{"host": "mds.internal", "metaencoding": "compact"})
+	c.Assert(m.serializer, Equals, metaSerializer(compactSerializer{}))
+}
+
+func (s *MDSSuite) TestErrorCounters(c *C) {
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, map[string]interface{}{"namespace": "errcounters"})
+	defer ts.Close()
+
+	count := func(counter *expvar.Map) int64 {
+		if v, ok := counter.Get("errcounters").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	ctx := context.Background()
+	_, err := m.upload(ctx, "key", 4, strings.NewReader("data"))
+	c.Assert(err, NotNil)
+	_, err = m.getObject(ctx, "1/key")
+	c.Assert(err, NotNil)
+	c.Assert(m.deleteObject(ctx, "1/key"), NotNil)
+	c.Assert(m.deleteObject(ctx, "1/key"), NotNil)
+
+	c.Assert(count(mdsUploadErrors), Equals, int64(1))
+	c.Assert(count(mdsGetErrors), Equals, int64(1))
+	c.Assert(count(mdsDeleteErrors), Equals, int64(2))
+
+	published := expvar.Get("postgres_driver").(*expvar.Map).Get("mds_delete_errors").String()
+	c.Assert(published, Equals, `{"errcounters": 2}`)
+}
+
+func (s *MDSSuite) TestAppendProxyMetrics(c *C) {
+	proxy := io.MultiReader(
+		io.TeeReader(strings.NewReader("data"), trackProxy{meter: proxiedBytesMeter("proxied")}),
+		appendTracer{ctx: context.Background(), start: time.Now(), timer: appendProxyTimer("proxied")},
+	)
+	_, err := io.Copy(ioutil.Discard, proxy)
+	c.Assert(err, IsNil)
+
+	c.Assert(proxiedBytesMeter("proxied").Count(), Equals, int64(4))
+	c.Assert(appendProxyTimer("proxied").Count(), Equals, int64(1))
+	// meters of other namespaces are left untouched
+	c.Assert(proxiedBytesMeter("untouched").Count(), Equals, int64(0))
+	c.Assert(appendProxyTimer("untouched").Count(), Equals, int64(0))
+
+	published := expvar.Get("postgres_driver").(*expvar.Map).Get("bytes_proxied_in_mds_append").(*expvar.Map)
+	c.Assert(published.Get("proxied"), NotNil)
+}
+
+func (s *MDSSuite) TestRangedGet(c *C) {
+	const content = "data"
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}, map[string]interface{}{"namespace": "ranges"})
+	defer ts.Close()
+
+	ctx := context.Background()
+	body, err := m.Storage.Get(ctx, m.Namespace, "1/key", 1, 2)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "at")
+
+	_, err = m.Storage.Get(ctx, m.Namespace, "1/key", 10)
+	c.Assert(err, DeepEquals, mds.ErrRangeNotSatisfiable{
+		ErrorMethodScope: err.(mds.ErrRangeNotSatisfiable).ErrorMethodScope,
+		Size:             4,
+	})
+
+	// reads past the end are empty even if the recorded size exceeds the actual one
+	for _, offset := range []int64{4, 6} {
+		body, err = m.read(ctx, &metaInfo{Key: "1/key", Size: 8}, offset)
+		c.Assert(err, IsNil)
+		data, err = ioutil.ReadAll(body)
+		c.Assert(err, IsNil)
+		c.Assert(data, HasLen, 0)
+	}
+	c.Assert(mdsGetErrors.Get("ranges"), IsNil)
+}
+
+func (s *MDSSuite) TestContentRangeSize(c *C) {
+	for header, expected := range map[string]int64{
+		"bytes 0-9/100": 100,
+		"bytes */4":     4,
+		"bytes */0":     0,
+	} {
+		size, ok := mds.ContentRangeSize(header)
+		c.Assert(ok, Equals, true, Commentf(header))
+		c.Assert(size, Equals, expected, Commentf(header))
+	}
+
+	for _, header := range []string{"", "bytes 0-9/*", "items 0-9/100", "bytes 0-9"} {
+		_, ok := mds.ContentRangeSize(header)
+		c.Assert(ok, Equals, false, Commentf(header))
+	}
+}
+
+func (s *MDSSuite) TestStat(c *C) {
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "HEAD")
+		switch r.URL.Path {
+		case "/get-stat/1/key":
+			w.Header().Set("Content-Length", "4")
+		case "/get-stat/1/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}, map[string]interface{}{"namespace": "stat"})
+	defer ts.Close()
+
+	ctx := context.Background()
+	size, exists, err := m.Storage.Stat(ctx, m.Namespace, "1/key")
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+	c.Assert(size, Equals, uint64(4))
+
+	_, exists, err = m.Storage.Stat(ctx, m.Namespace, "1/missing")
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+
+	_, _, err = m.Storage.Stat(ctx, m.Namespace, "1/broken")
+	c.Assert(err, FitsTypeOf, mds.MethodError{})
+}
+
+func (s *MDSSuite) TestHeaders(c *C) {
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]http.Header)
+	)
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[strings.SplitN(r.URL.Path[1:], "-", 2)[0]] = r.Header
+		mu.Unlock()
+	}, map[string]interface{}{
+		"namespace":  "headers",
+		"authheader": "Basic default",
+		"useragent":  "registry/2.5",
+		"headers":    map[string]interface{}{"X-Registry": "registry-1", "Authorization": "ignored"},
+	})
+	defer ts.Close()
+
+	ctx := context.Background()
+	m.Storage.Upload(ctx, m.Namespace, "key", 4, strings.NewReader("data"))
+	m.Storage.Get(ctx, m.Namespace, "1/key")
+	m.Storage.Delete(ctx, m.Namespace, "1/key")
+	m.Storage.Ping(ctx)
+	m.Storage.DownloadInfo(ctx, m.Namespace, "1/key")
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, method := range []string{"upload", "get", "delete", "ping", "downloadinfo"} {
+		header, ok := requests[method]
+		c.Assert(ok, Equals, true, Commentf(method))
+		c.Assert(header.Get("User-Agent"), Equals, "registry/2.5", Commentf(method))
+		c.Assert(header.Get("X-Registry"), Equals, "registry-1", Commentf(method))
+		c.Assert(header["Authorization"], DeepEquals, []string{"Basic default"}, Commentf(method))
+	}
+}
+
+func (s *MDSSuite) TestAuthProvider(c *C) {
+	var headers []string
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Authorization"))
+	}, map[string]interface{}{
+		"namespace":            "auth",
+		"namespaceauthheaders": map[string]interface{}{"other": "Basic other"},
+	})
+	defer ts.Close()
+
+	var calls int
+	m.Storage.AuthProvider = func(netcontext.Context) (string, error) {
+		calls++
+		return "Bearer " + strconv.Itoa(calls), nil
+	}
+
+	ctx := context.Background()
+	c.Assert(m.Storage.Delete(ctx, m.Namespace, "1/key"), IsNil)
+	c.Assert(m.Storage.Delete(ctx, m.Namespace, "1/key"), IsNil)
+	// namespace specific headers take precedence
+	c.Assert(m.Storage.Delete(ctx, "other", "1/key"), IsNil)
+	c.Assert(headers, DeepEquals, []string{"Bearer 1", "Bearer 2", "Basic other"})
+
+	m.Storage.AuthProvider = func(netcontext.Context) (string, error) {
+		return "", errors.New("no token")
+	}
+	c.Assert(m.Storage.Delete(ctx, m.Namespace, "1/key"), ErrorMatches, ".*no token")
+	c.Assert(headers, HasLen, 3)
+}
+
+func (s *MDSSuite) TestAuthHeaderFile(c *C) {
+	path := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(path, []byte("Bearer first\n"), 0600), IsNil)
+
+	_, err := newMDSBinStorage(nil, nil, map[string]interface{}{"authheader": "Basic static", "authheaderfile": path})
+	c.Assert(err, NotNil)
+	_, err = newMDSBinStorage(nil, nil, map[string]interface{}{"authheaderfile": path + ".missing"})
+	c.Assert(err, NotNil)
+
+	var header string
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}, map[string]interface{}{"namespace": "auth", "authheaderfile": path})
+	defer ts.Close()
+
+	ctx := context.Background()
+	c.Assert(m.Storage.Delete(ctx, m.Namespace, "1/key"), IsNil)
+	c.Assert(header, Equals, "Bearer first")
+
+	// a rotated token is picked up once the file is modified
+	c.Assert(ioutil.WriteFile(path, []byte("Bearer second\n"), 0600), IsNil)
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(path, later, later), IsNil)
+	c.Assert(m.Storage.Delete(ctx, m.Namespace, "1/key"), IsNil)
+	c.Assert(header, Equals, "Bearer second")
+}
+
+func (s *MDSSuite) TestGetRetries(c *C) {
+	var (
+		mu       sync.Mutex
+		requests int
+		failures = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	)
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		c.Check(r.Header.Get("Range"), Equals, "bytes=1-")
+		switch {
+		case strings.Contains(r.URL.Path, "missing"):
+			w.WriteHeader(http.StatusNotFound)
+		case requests <= len(failures):
+			w.WriteHeader(failures[requests-1])
+		default:
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "ata")
+		}
+	}, map[string]interface{}{"namespace": "retries", "getretrydelay": int64(time.Millisecond)})
+	defer ts.Close()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+	reset := func(codes ...int) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests, failures = 0, codes
+	}
+
+	ctx := context.Background()
+	body, err := m.Storage.Get(ctx, m.Namespace, "1/key", 1)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "ata")
+	c.Assert(count(), Equals, 3)
+
+	// 404 is not retried
+	reset()
+	_, err = m.Storage.Get(ctx, m.Namespace, "1/missing", 1)
+	c.Assert(err, FitsTypeOf, mds.MethodError{})
+	c.Assert(count(), Equals, 1)
+
+	// attempts are bounded
+	reset(http.StatusGatewayTimeout, http.StatusGatewayTimeout, http.StatusGatewayTimeout, http.StatusGatewayTimeout)
+	_, err = m.Storage.Get(ctx, m.Namespace, "1/key", 1)
+	c.Assert(err, FitsTypeOf, mds.MethodError{})
+	c.Assert(count(), Equals, defaultMDSGetAttempts)
+}
+
+func (s *MDSSuite) TestMethodErrorPredicates(c *C) {
+	for _, t := range []struct {
+		code        int
+		notFound    bool
+		serverError bool
+	}{
+		{http.StatusNotFound, true, false},
+		{http.StatusForbidden, false, false},
+		{http.StatusInternalServerError, false, true},
+		{http.StatusBadGateway, false, true},
+	} {
+		code := t.code
+		m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}, map[string]interface{}{"namespace": "predicates", "getattempts": 1})
+
+		_, err := m.Storage.Get(context.Background(), m.Namespace, "1/key")
+		ts.Close()
+		c.Assert(err, FitsTypeOf, mds.MethodError{}, Commentf("%d", code))
+		merr := err.(mds.MethodError)
+		c.Assert(merr.StatusCode, Equals, code)
+		c.Assert(merr.IsNotFound(), Equals, t.notFound, Commentf("%d", code))
+		c.Assert(merr.IsServerError(), Equals, t.serverError, Commentf("%d", code))
+	}
+}
+
+func (s *MDSSuite) TestDeleteMissingObject(c *C) {
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}, map[string]interface{}{"namespace": "deletemissing"})
+	defer ts.Close()
+
+	c.Assert(m.deleteObject(context.Background(), "1/key"), IsNil)
+	c.Assert(mdsDeleteErrors.Get("deletemissing"), IsNil)
+}
+
+func (s *MDSSuite) TestErrorBody(c *C) {
+	body := strings.Repeat("e", 2*mds.DefaultErrorBodyLimit)
+	var (
+		mu sync.Mutex
+		// clients are told apart by addresses of their connections
+		clients = make(map[string]bool)
+	)
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		clients[r.RemoteAddr] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, body)
+	}, map[string]interface{}{"namespace": "errorbody"})
+	defer ts.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		err := m.Storage.Delete(ctx, m.Namespace, "1/key")
+		c.Assert(err, FitsTypeOf, mds.MethodError{})
+		c.Assert(string(err.(mds.MethodError).Body), Equals, body[:mds.DefaultErrorBodyLimit])
+	}
+
+	// drained bodies let the connection be reused
+	mu.Lock()
+	c.Assert(clients, HasLen, 1)
+	mu.Unlock()
+
+	m.Storage.ErrorBodyLimit = 16
+	err := m.Storage.Delete(ctx, m.Namespace, "1/key")
+	c.Assert(err.(mds.MethodError).Body, HasLen, 16)
+}
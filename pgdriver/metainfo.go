@@ -0,0 +1,94 @@
+package pgdriver
+
+import (
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type metaInfo struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ID   string `json:"id"`
+}
+
+func (m *metaInfo) Value() (sqldriver.Value, error) {
+	return jsonSerializer{}.marshal(m)
+}
+
+// Scan decodes metainformation encoded by any of metaSerializers
+func (m *metaInfo) Scan(src interface{}) error {
+	switch body := src.(type) {
+	case []byte:
+		if len(body) > 0 && body[0] == compactMarker {
+			return m.unmarshalCompact(string(body[1:]))
+		}
+		// NOTE: it's JSON written by default or before serializers were introduced
+		return json.Unmarshal(body, m)
+	default:
+		return fmt.Errorf("can not Scan from non []byte type: %v", reflect.TypeOf(body))
+	}
+}
+
+const (
+	// compactMarker starts compact encoding. JSON never starts with it
+	compactMarker = '\x1e'
+	// compactSeparator separates fields in compact encoding
+	compactSeparator = "\x1f"
+)
+
+// metaSerializer encodes metaInfo to be stored in mds table
+type metaSerializer interface {
+	marshal(m *metaInfo) (sqldriver.Value, error)
+}
+
+var metaSerializers = map[string]metaSerializer{
+	"":        jsonSerializer{},
+	"json":    jsonSerializer{},
+	"compact": compactSerializer{},
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) marshal(m *metaInfo) (sqldriver.Value, error) {
+	return json.Marshal(m)
+}
+
+// compactSerializer joins fields by a separator.
+// It is smaller and much cheaper to parse than JSON.
+type compactSerializer struct{}
+
+func (compactSerializer) marshal(m *metaInfo) (sqldriver.Value, error) {
+	if strings.Contains(m.Key, compactSeparator) || strings.Contains(m.ID, compactSeparator) {
+		return nil, fmt.Errorf("metainformation can not be encoded compactly: %v", m)
+	}
+	return string(compactMarker) + strconv.FormatInt(m.Size, 10) + compactSeparator + m.ID + compactSeparator + m.Key, nil
+}
+
+func (m *metaInfo) unmarshalCompact(body string) error {
+	fields := strings.SplitN(body, compactSeparator, 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed compact metainformation %q", body)
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	m.Size, m.ID, m.Key = size, fields[1], fields[2]
+	return nil
+}
+
+// encodedMetaInfo encodes metaInfo with a serializer
+type encodedMetaInfo struct {
+	*metaInfo
+	serializer metaSerializer
+}
+
+func (e encodedMetaInfo) Value() (sqldriver.Value, error) {
+	return e.serializer.marshal(e.metaInfo)
+}
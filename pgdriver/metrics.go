@@ -0,0 +1,152 @@
+package pgdriver
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/noxiouz/expvarmetrics"
+)
+
+// metricsName is the name of the expvar map of the driver metrics
+const metricsName = "postgres_driver"
+
+// PrometheusHandler serves the driver metrics in the Prometheus text format.
+// Mount it at /metrics of the debug server to scrape them.
+func PrometheusHandler() http.Handler {
+	return expvarmetrics.PrometheusHandler(metricsName, expvar.Get(metricsName).(*expvar.Map))
+}
+
+// writerRegistry tracks start times of writers storing data,
+// so hung writers can be detected
+type writerRegistry struct {
+	mu      sync.Mutex
+	started map[*fileWriter]time.Time
+}
+
+func newWriterRegistry() *writerRegistry {
+	return &writerRegistry{
+		started: make(map[*fileWriter]time.Time),
+	}
+}
+
+func (r *writerRegistry) add(fw *fileWriter) {
+	r.mu.Lock()
+	r.started[fw] = time.Now()
+	r.mu.Unlock()
+	inFlightWriters.Inc(1)
+}
+
+func (r *writerRegistry) remove(fw *fileWriter) {
+	r.mu.Lock()
+	delete(r.started, fw)
+	r.mu.Unlock()
+	inFlightWriters.Dec(1)
+}
+
+// writing reports whether a writer of path is running
+func (r *writerRegistry) writing(path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for fw := range r.started {
+		if fw.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// oldest returns the age of the oldest writer or 0 if there are none
+func (r *writerRegistry) oldest() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var age time.Duration
+	for _, started := range r.started {
+		if a := time.Since(started); a > age {
+			age = a
+		}
+	}
+	return age
+}
+
+// LatencyStats describes latencies of an operation
+type LatencyStats struct {
+	Count int64
+	Mean  time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// DriverMetrics is a snapshot of metrics published to /debug/vars.
+// The metrics are shared by all drivers in the process.
+type DriverMetrics struct {
+	// BytesWritten is the total amount of bytes written by writers
+	BytesWritten int64
+	// InFlightBytes is the amount of bytes being written within MaxInFlightBytes
+	InFlightBytes int64
+	// InFlightWriters is the number of writers storing data
+	InFlightWriters int64
+	// OldestWriterAge is the age of the oldest of them
+	OldestWriterAge time.Duration
+	// Latencies are keyed by operation: GetContent, PutContent, Writer,
+	// Reader, Stat, List, Move, Delete
+	Latencies map[string]LatencyStats
+	// KVErrors are failed requests to MDS keyed by operation:
+	// upload, get, delete, append_proxy
+	KVErrors map[string]int64
+}
+
+// MetricsSnapshot returns the current values of metrics
+func (d *Driver) MetricsSnapshot() DriverMetrics {
+	snapshot := DriverMetrics{
+		BytesWritten:    bytesWrittenToStorage.Count(),
+		InFlightBytes:   inFlightBytes.Value(),
+		InFlightWriters: inFlightWriters.Value(),
+		OldestWriterAge: liveWriters.oldest(),
+		Latencies:       make(map[string]LatencyStats),
+		KVErrors:        make(map[string]int64),
+	}
+
+	for op, timer := range map[string]expvarmetrics.TimerVar{
+		"GetContent": getContentTimer,
+		"PutContent": putContentTimer,
+		"Writer":     writerTimer,
+		"Reader":     readerTimer,
+		"Stat":       statTimer,
+		"List":       listTimer,
+		"Move":       moveTimer,
+		"Delete":     deleteTimer,
+	} {
+		ss := timer.Snapshot()
+		ps := ss.Percentiles([]float64{0.5, 0.95, 0.99})
+		snapshot.Latencies[op] = LatencyStats{
+			Count: ss.Count(),
+			Mean:  time.Duration(ss.Mean()),
+			P50:   time.Duration(ps[0]),
+			P95:   time.Duration(ps[1]),
+			P99:   time.Duration(ps[2]),
+		}
+	}
+
+	for op, counter := range map[string]*expvar.Map{
+		"upload":       mdsUploadErrors,
+		"get":          mdsGetErrors,
+		"delete":       mdsDeleteErrors,
+		"append_proxy": mdsAppendProxyErrors,
+	} {
+		var total int64
+		// errors of all namespaces
+		counter.Do(func(kv expvar.KeyValue) {
+			if v, ok := kv.Value.(*expvar.Int); ok {
+				total += v.Value()
+			}
+		})
+		snapshot.KVErrors[op] = total
+	}
+
+	return snapshot
+}
@@ -0,0 +1,175 @@
+package pgdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noxiouz/expvarmetrics"
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestGaugeConcurrentUpdates(c *C) {
+	g := expvarmetrics.NewGaugeVar()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				g.Inc(2)
+				g.Dec(1)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(g.Value(), Equals, int64(10000))
+
+	g.Set(-5)
+	c.Assert(g.Value(), Equals, int64(-5))
+}
+
+func (s *MetricsSuite) TestGaugeString(c *C) {
+	g := expvarmetrics.NewGaugeVar()
+	g.Set(42)
+
+	var stats struct {
+		Value int64
+	}
+	c.Assert(json.Unmarshal([]byte(g.String()), &stats), IsNil)
+	c.Assert(stats.Value, Equals, int64(42))
+}
+
+func (s *MetricsSuite) TestHistogramString(c *C) {
+	h := expvarmetrics.NewHistogramVar()
+	for i := int64(1); i <= 100; i++ {
+		h.Update(i)
+	}
+
+	var stats struct {
+		Count      int64
+		Min        int64
+		Max        int64
+		Mean       float64
+		Percentile map[string]float64
+	}
+	c.Assert(json.Unmarshal([]byte(h.String()), &stats), IsNil)
+	c.Assert(stats.Count, Equals, int64(100))
+	c.Assert(stats.Min, Equals, int64(1))
+	c.Assert(stats.Max, Equals, int64(100))
+	c.Assert(stats.Mean, Equals, 50.5)
+
+	keys := make([]string, 0, len(stats.Percentile))
+	for key := range stats.Percentile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	c.Assert(keys, DeepEquals, []string{"50%", "75%", "90%", "95%", "98%", "99%", "99.95%"})
+	c.Assert(stats.Percentile["50%"], Equals, 50.5)
+	c.Assert(stats.Percentile["99.95%"], Equals, float64(100))
+}
+
+func (s *MetricsSuite) TestCustomPercentiles(c *C) {
+	t, err := expvarmetrics.NewTimerVarWithPercentiles([]float64{0.5, 0.999})
+	c.Assert(err, IsNil)
+	t.Update(time.Millisecond)
+
+	var timerStats struct {
+		Percentile map[string]float64
+	}
+	c.Assert(json.Unmarshal([]byte(t.String()), &timerStats), IsNil)
+	c.Assert(timerStats.Percentile, DeepEquals, map[string]float64{"50%": 1, "99.9%": 1})
+
+	h, err := expvarmetrics.NewHistogramVarWithPercentiles([]float64{0.99})
+	c.Assert(err, IsNil)
+	h.Update(7)
+
+	var histogramStats struct {
+		Percentile map[string]float64
+	}
+	c.Assert(json.Unmarshal([]byte(h.String()), &histogramStats), IsNil)
+	c.Assert(histogramStats.Percentile, DeepEquals, map[string]float64{"99%": 7})
+
+	for _, percentiles := range [][]float64{nil, {0}, {1}, {0.5, 1.5}, {-0.1}} {
+		_, err = expvarmetrics.NewTimerVarWithPercentiles(percentiles)
+		c.Assert(err, NotNil)
+		_, err = expvarmetrics.NewHistogramVarWithPercentiles(percentiles)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *MetricsSuite) TestWritePrometheus(c *C) {
+	m := new(expvar.Map).Init()
+	meter := expvarmetrics.NewMeterVar()
+	meter.Mark(3)
+	m.Set("bytes-written", meter)
+	timer, err := expvarmetrics.NewTimerVarWithPercentiles([]float64{0.99})
+	c.Assert(err, IsNil)
+	timer.Update(2 * time.Second)
+	m.Set("latency", timer)
+	gauge := expvarmetrics.NewGaugeVar()
+	gauge.Set(5)
+	m.Set("writers", gauge)
+	errors := new(expvar.Map).Init()
+	errors.Add("registry", 2)
+	m.Set("errors", errors)
+	proxied := new(expvar.Map).Init()
+	proxiedMeter := expvarmetrics.NewMeterVar()
+	proxiedMeter.Mark(4)
+	proxied.Set("registry", proxiedMeter)
+	m.Set("proxied", proxied)
+	m.Set("info", expvar.Func(func() interface{} { return "skipped" }))
+
+	buff := new(bytes.Buffer)
+	c.Assert(expvarmetrics.WritePrometheus(buff, "test", m), IsNil)
+	output := buff.String()
+
+	for _, line := range []string{
+		"# TYPE test_bytes_written_total counter\ntest_bytes_written_total 3\n",
+		`test_bytes_written_rate{window="1m"}`,
+		"test_latency_seconds_count 1\n",
+		"test_latency_seconds_sum 2\n",
+		`test_latency_seconds{quantile="0.99"} 2` + "\n",
+		"# TYPE test_writers gauge\ntest_writers 5\n",
+		`test_errors{key="registry"} 2` + "\n",
+		"test_proxied_registry_total 4\n",
+	} {
+		c.Assert(strings.Contains(output, line), Equals, true, Commentf("%q is missing in:\n%s", line, output))
+	}
+	c.Assert(strings.Contains(output, "info"), Equals, false)
+}
+
+func (s *MetricsSuite) TestPrometheusHandler(c *C) {
+	rec := httptest.NewRecorder()
+	PrometheusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(rec.Body.String(), "postgres_driver_get_content_latency_seconds_count"), Equals, true)
+	c.Assert(strings.Contains(rec.Body.String(), "postgres_driver_in_flight_writers"), Equals, true)
+}
+
+func (s *MetricsSuite) TestOldestWriter(c *C) {
+	r := newWriterRegistry()
+	c.Assert(r.oldest(), Equals, time.Duration(0))
+
+	first, second := &fileWriter{}, &fileWriter{}
+	r.add(first)
+	time.Sleep(20 * time.Millisecond)
+	r.add(second)
+	c.Assert(r.oldest() >= 20*time.Millisecond, Equals, true)
+
+	r.remove(first)
+	c.Assert(r.oldest() < 20*time.Millisecond, Equals, true)
+	r.remove(second)
+	c.Assert(r.oldest(), Equals, time.Duration(0))
+}
@@ -0,0 +1,266 @@
+package pgdriver
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/lib/pq"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// undefinedTable is the PostgreSQL error code of a missing table
+const undefinedTable pq.ErrorCode = "42P01"
+
+// migrations contain statements upgrading the schema from the version
+// equal to the index of a migration to the next one. Statements are
+// idempotent, as tables created before versioning are of version 0.
+var migrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS {mfs} (
+			PATH    TEXT PRIMARY KEY UNIQUE,
+			PARENT  TEXT NOT NULL,
+			DIR     BOOLEAN NOT NULL,
+			SIZE    BIGINT NOT NULL,
+			MODTIME TIMESTAMPTZ NOT NULL,
+			KEY     TEXT,
+			OWNER   TEXT,
+			INLINE  BYTEA,
+			DIGEST  TEXT
+		);`,
+		`ALTER TABLE {mfs} ADD COLUMN IF NOT EXISTS INLINE BYTEA;`,
+		`ALTER TABLE {mfs} ADD COLUMN IF NOT EXISTS DIGEST TEXT;`,
+		`CREATE INDEX IF NOT EXISTS {parent_idx} ON {mfs} (parent);`,
+		`CREATE INDEX IF NOT EXISTS {key_idx} ON {mfs} (key);`,
+		`CREATE INDEX IF NOT EXISTS {digest_idx} ON {mfs} (digest);`,
+		`CREATE TABLE IF NOT EXISTS {mds} (
+			KEY         TEXT PRIMARY KEY,
+			MDSFILEINFO TEXT NOT NULL,
+			DELETED     BOOLEAN NOT NULL DEFAULT FALSE,
+			PURGED      BOOLEAN NOT NULL DEFAULT FALSE
+		);`,
+		`ALTER TABLE {mds} ADD COLUMN IF NOT EXISTS PURGED BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`CREATE TABLE IF NOT EXISTS {mfs_delete_journal} (
+			KEY       TEXT NOT NULL,
+			FAILED_AT TIMESTAMP NOT NULL DEFAULT now(),
+			DELETE_ID TEXT
+		);`,
+		`ALTER TABLE {mfs_delete_journal} ADD COLUMN IF NOT EXISTS DELETE_ID TEXT;`,
+		`CREATE INDEX IF NOT EXISTS {delete_id_idx} ON {mfs_delete_journal} (delete_id);`,
+	},
+	// keyset pagination of children
+	{
+		`CREATE INDEX IF NOT EXISTS {parent_path_idx} ON {mfs} (parent, path);`,
+	},
+	// tables created before have modtime of TIME, which keeps no date,
+	// so the date of migration is assumed
+	{
+		`DO $$ BEGIN
+			IF (SELECT atttypid FROM pg_attribute WHERE attrelid = '{mfs}'::regclass AND attname = 'modtime') = 'time'::regtype THEN
+				ALTER TABLE {mfs} ALTER COLUMN modtime TYPE TIMESTAMPTZ USING current_date + modtime;
+			END IF;
+		END $$;`,
+	},
+	// expiry of temporary files
+	{
+		`ALTER TABLE {mfs} ADD COLUMN IF NOT EXISTS EXPIRES_AT TIMESTAMPTZ;`,
+		`CREATE INDEX IF NOT EXISTS {expires_idx} ON {mfs} (expires_at) WHERE expires_at IS NOT NULL;`,
+	},
+	// backends of keys stored by routes
+	{
+		`CREATE TABLE IF NOT EXISTS {kv_routes} (
+			KEY     TEXT PRIMARY KEY,
+			BACKEND TEXT NOT NULL
+		);`,
+	},
+	// objects of the postgres backend
+	{
+		`CREATE TABLE IF NOT EXISTS {kv_blobs} (
+			KEY  TEXT PRIMARY KEY,
+			DATA BYTEA NOT NULL
+		);`,
+	},
+	// descendants of a path are matched by LIKE 'path/%', which the primary key
+	// can not serve unless the database uses C collation.
+	// Since then lazy directories are materialized once, so missing
+	// parents of files written in lazy mode before are created.
+	{
+		`CREATE INDEX IF NOT EXISTS {path_pattern_idx} ON {mfs} (path text_pattern_ops);`,
+		`INSERT INTO {mfs} (path, parent, dir, size, modtime, key, owner)
+			SELECT DISTINCT ON (dirs.path) dirs.path, dirs.parent, true, 0, now(), NULL, f.owner
+			FROM {mfs} f,
+				LATERAL string_to_array(f.path, '/') parts,
+				LATERAL (
+					SELECT array_to_string(parts[1:n], '/') AS path,
+						CASE WHEN n = 2 THEN '/' ELSE array_to_string(parts[1:n-1], '/') END AS parent
+					FROM generate_series(2, array_length(parts, 1) - 1) n
+				) dirs
+			WHERE NOT f.dir AND f.parent <> '/' AND NOT EXISTS (SELECT 1 FROM {mfs} p WHERE p.path = f.parent)
+			ORDER BY dirs.path
+			ON CONFLICT (path) DO NOTHING;`,
+	},
+}
+
+// schemaVersion is the version of the schema expected by the driver
+var schemaVersion = len(migrations)
+
+const createSchemaVersion = `CREATE TABLE IF NOT EXISTS {schema_version} (
+	VERSION    INTEGER PRIMARY KEY,
+	APPLIED_AT TIMESTAMP NOT NULL DEFAULT now()
+);`
+
+// requiredColumns is used to check that existing tables are compatible
+var requiredColumns = map[string][]string{
+	"{mfs}":                {"path", "parent", "dir", "size", "modtime", "key", "owner", "inline", "digest", "expires_at"},
+	"{mds}":                {"key", "mdsfileinfo", "deleted", "purged"},
+	"{mfs_delete_journal}": {"key", "failed_at", "delete_id"},
+	"{kv_routes}":          {"key", "backend"},
+	"{kv_blobs}":           {"key", "data"},
+}
+
+// requiredTypes are types of columns, which are checked in addition
+var requiredTypes = map[string]map[string]string{
+	"{mfs}": {"modtime": "timestamp with time zone"},
+}
+
+// Migrate applies pending migrations of the schema
+func (d *Driver) Migrate(ctx context.Context) error {
+	return migrate(ctx, d.drv.cluster.DB(pgcluster.MASTER), d.drv.sqlTables)
+}
+
+// migrate applies pending migrations in a single transaction.
+// Concurrent calls are serialized by an advisory lock,
+// so only the first one of them upgrades the schema.
+func migrate(ctx context.Context, db *sql.DB, tables *sqlTables) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID(tables)); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(tables.q(createSchemaVersion)); err != nil {
+		return err
+	}
+
+	current, err := currentSchemaVersion(ctx, tx, tables)
+	if err != nil {
+		return err
+	}
+
+	if current > schemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d supported by the driver", current, schemaVersion)
+	}
+
+	for version := current; version < schemaVersion; version++ {
+		for _, statement := range migrations[version] {
+			if _, err = tx.Exec(tables.q(statement)); err != nil {
+				return fmt.Errorf("migration to version %d: %v", version+1, err)
+			}
+		}
+
+		if _, err = tx.Exec(tables.q("INSERT INTO {schema_version} (version) VALUES ($1)"), version+1); err != nil {
+			return err
+		}
+	}
+
+	for table, columns := range requiredColumns {
+		if err = checkColumns(tx, tables.q(table), columns, requiredTypes[table]); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if current < schemaVersion {
+		context.GetLogger(ctx).Infof("schema is migrated from version %d to %d", current, schemaVersion)
+	} else {
+		context.GetLogger(ctx).Debug("schema is up to date")
+	}
+	return nil
+}
+
+// checkSchemaVersion fails if the schema has to be migrated
+func checkSchemaVersion(ctx context.Context, db *sql.DB, tables *sqlTables) error {
+	current, err := currentSchemaVersion(ctx, db, tables)
+	if err != nil {
+		return err
+	}
+
+	if current != schemaVersion {
+		return fmt.Errorf("schema version %d does not match version %d expected by the driver: "+
+			"enable AutoMigrate or apply migrations by Driver.Migrate", current, schemaVersion)
+	}
+
+	return nil
+}
+
+// currentSchemaVersion returns 0 if there is no version table
+func currentSchemaVersion(ctx context.Context, db rowQuerier, tables *sqlTables) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, tables.q("SELECT COALESCE(max(version), 0) FROM {schema_version}")).Scan(&version)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == undefinedTable {
+		return 0, nil
+	}
+	return version, err
+}
+
+// migrationLockID derives a key of the advisory lock from the version table,
+// so drivers using different tables do not wait for each other
+func migrationLockID(tables *sqlTables) int64 {
+	h := fnv.New64a()
+	io.WriteString(h, tables.q("{schema_version}"))
+	return int64(h.Sum64())
+}
+
+// checkColumns verifies that an existing table has all required columns
+// and that columns listed by types are of those types
+func checkColumns(tx *sql.Tx, table string, columns []string, types map[string]string) error {
+	var schema string
+	if pos := strings.LastIndex(table, "."); pos != -1 {
+		schema = table[:pos]
+	}
+
+	rows, err := tx.Query(`
+		SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema()) AND table_name = $2
+	`, schema, unqualified(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]string)
+	for rows.Next() {
+		var column, dataType string
+		if err = rows.Scan(&column, &dataType); err != nil {
+			return err
+		}
+		existing[column] = dataType
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		if _, ok := existing[column]; !ok {
+			return fmt.Errorf("incompatible schema: table %s has no column %s", table, column)
+		}
+	}
+
+	for column, dataType := range types {
+		if existing[column] != dataType {
+			return fmt.Errorf("incompatible schema: column %s of table %s is %s instead of %s", column, table, existing[column], dataType)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package pgdriver
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// pgBlobStorage keeps objects in {kv_blobs} of the same cluster,
+// so a single PostgreSQL is enough to run the registry.
+// Objects are buffered in memory and limited to 1GB by bytea.
+type pgBlobStorage struct {
+	*pgcluster.Cluster
+	*sqlTables
+}
+
+func newPGBlobStorage(cluster *pgcluster.Cluster, tables *sqlTables) (KVStorage, error) {
+	return &pgBlobStorage{Cluster: cluster, sqlTables: tables}, nil
+}
+
+func (p *pgBlobStorage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = p.DB(pgcluster.MASTER).ExecContext(ctx, p.q(`INSERT INTO {kv_blobs} (key, data) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data`), key, body)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(body)), nil
+}
+
+func (p *pgBlobStorage) Append(ctx context.Context, key string, data io.Reader) (int64, error) {
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := p.DB(pgcluster.MASTER).ExecContext(ctx, p.q("UPDATE {kv_blobs} SET data = data || $2 WHERE key = $1"), key, body)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if affected == 0 {
+		return 0, fmt.Errorf("no such key: %s", key)
+	}
+	return int64(len(body)), nil
+}
+
+func (p *pgBlobStorage) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var (
+		size int64
+		body []byte
+	)
+	err := p.DB(pgcluster.MASTER).QueryRowContext(ctx, p.q("SELECT octet_length(data), substring(data FROM $2::integer + 1) FROM {kv_blobs} WHERE key = $1"),
+		key, offset).Scan(&size, &body)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("no such key: %s", key)
+	case err != nil:
+		return nil, err
+	case size < offset:
+		return nil, fmt.Errorf("invalid offset")
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (p *pgBlobStorage) Delete(ctx context.Context, key string) error {
+	_, err := p.DB(pgcluster.MASTER).ExecContext(ctx, p.q("DELETE FROM {kv_blobs} WHERE key = $1"), key)
+	return err
+}
+
+func (p *pgBlobStorage) Size(ctx context.Context, key string) (int64, error) {
+	var size int64
+	err := p.DB(pgcluster.MASTER).QueryRowContext(ctx, p.q("SELECT octet_length(data) FROM {kv_blobs} WHERE key = $1"), key).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no such key: %s", key)
+	}
+	return size, err
+}
+
+// URLFor is not supported, as objects are not reachable out of PostgreSQL
+func (p *pgBlobStorage) URLFor(ctx context.Context, key string, resolveRedirect bool) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+}
+
+// Close does nothing, as the cluster is closed by the driver
+func (p *pgBlobStorage) Close() error {
+	return nil
+}
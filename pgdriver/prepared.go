@@ -0,0 +1,122 @@
+package pgdriver
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// stmtCache keeps prepared statements of hot queries. Statements belong to
+// a single *sql.DB, so they are prepared again against the new master once
+// another one is elected. Statements of the old master are closed after
+// the queries which have already got them are started.
+type stmtCache struct {
+	mu  sync.Mutex
+	db  *sql.DB
+	set *stmtSet
+}
+
+// stmtSet is a generation of statements prepared against a single *sql.DB
+type stmtSet struct {
+	stmts map[string]*sql.Stmt
+	// users counts callers which have got statements of the set,
+	// but have not released them yet
+	users   int
+	retired bool
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{set: newStmtSet()}
+}
+
+func newStmtSet() *stmtSet {
+	return &stmtSet{stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepare returns a statement of query prepared against db.
+// The statement is valid until release is called.
+func (c *stmtCache) prepare(db *sql.DB, query string) (stmt *sql.Stmt, release func(), err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.db != db {
+		c.retire()
+		c.db = db
+	}
+
+	stmt, ok := c.set.stmts[query]
+	if !ok {
+		if stmt, err = db.Prepare(query); err != nil {
+			return nil, nil, err
+		}
+		c.set.stmts[query] = stmt
+	}
+
+	set := c.set
+	set.users++
+	return stmt, func() { c.release(set) }, nil
+}
+
+func (c *stmtCache) release(set *stmtSet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	set.users--
+	if set.retired && set.users == 0 {
+		set.closeAll()
+	}
+}
+
+// Close closes all prepared statements once they are released
+func (c *stmtCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retire()
+	c.db = nil
+}
+
+// retire replaces the current set by an empty one.
+// The old set is closed unless it's in use.
+func (c *stmtCache) retire() {
+	c.set.retired = true
+	if c.set.users == 0 {
+		c.set.closeAll()
+	}
+	c.set = newStmtSet()
+}
+
+func (s *stmtSet) closeAll() {
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+}
+
+// preparedQuerier runs queries by statements prepared against db
+type preparedQuerier struct {
+	cache *stmtCache
+	db    *sql.DB
+}
+
+func (p preparedQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, release, err := p.cache.prepare(p.db, query)
+	if err != nil {
+		// NOTE: the error is reported by Scan of the ad-hoc query
+		return p.db.QueryRowContext(ctx, query, args...)
+	}
+	// NOTE: the row keeps the statement alive until it's scanned,
+	// so the statement may be closed once the query is started
+	defer release()
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// hot returns the node to run frequent queries about path on.
+// Prepared statements are used for the master if PreparedStatements is set.
+func (d *driver) hot(path string) rowQuerier {
+	db := d.readDB(path)
+	if d.stmts == nil || db != d.cluster.DB(pgcluster.MASTER) {
+		return db
+	}
+	return preparedQuerier{cache: d.stmts, db: db}
+}
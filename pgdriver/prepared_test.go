@@ -0,0 +1,40 @@
+package pgdriver
+
+import (
+	"database/sql"
+
+	. "gopkg.in/check.v1"
+)
+
+type StmtCacheSuite struct{}
+
+var _ = Suite(&StmtCacheSuite{})
+
+func (s *StmtCacheSuite) TestStatementsInUseSurviveMasterChange(c *C) {
+	const query = "SELECT pg_is_in_recovery()"
+	old, err := sql.Open("fakepg", "master")
+	c.Assert(err, IsNil)
+	defer old.Close()
+	elected, err := sql.Open("fakepg", "master")
+	c.Assert(err, IsNil)
+	defer elected.Close()
+
+	cache := newStmtCache()
+	stmt, release, err := cache.prepare(old, query)
+	c.Assert(err, IsNil)
+
+	// another master is elected while the statement is in use
+	stmtElected, releaseElected, err := cache.prepare(elected, query)
+	c.Assert(err, IsNil)
+	var inRecovery bool
+	c.Assert(stmt.QueryRow().Scan(&inRecovery), IsNil)
+
+	release()
+	c.Assert(stmt.QueryRow().Scan(&inRecovery), ErrorMatches, "sql: statement is closed")
+
+	// Close waits for statements in use as well
+	cache.Close()
+	c.Assert(stmtElected.QueryRow().Scan(&inRecovery), IsNil)
+	releaseElected()
+	c.Assert(stmtElected.QueryRow().Scan(&inRecovery), ErrorMatches, "sql: statement is closed")
+}
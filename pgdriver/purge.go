@@ -0,0 +1,158 @@
+package pgdriver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// PurgeProgress counts objects processed by PurgeNamespace so far
+type PurgeProgress struct {
+	Deleted int64
+	Failed  int64
+}
+
+// PurgeError aggregates failures of PurgeNamespace
+type PurgeError struct {
+	// Errors maps keys of mds table to errors of their objects
+	Errors map[string]error
+}
+
+func (e PurgeError) Error() string {
+	return fmt.Sprintf("unable to delete %d objects from MDS", len(e.Errors))
+}
+
+// PurgeNamespace deletes every object of the MDS namespace of the driver,
+// e.g. to offboard a tenant. Rows of mds table are read by pages and
+// objects of each page are deleted by the given number of workers,
+// as MDS has no bulk delete. Rows of deleted objects are marked deleted
+// and purged. Files are kept, so they dangle afterwards.
+// progress is called after each page if it's set.
+// Failed keys are reported by PurgeError, their rows are left intact.
+func (d *Driver) PurgeNamespace(ctx context.Context, workers int, progress func(PurgeProgress)) (PurgeProgress, error) {
+	m, ok := d.drv.storage.(*mdsBinStorage)
+	if !ok {
+		return PurgeProgress{}, fmt.Errorf("purging is supported by MDS backend only")
+	}
+	return m.PurgeNamespace(ctx, workers, progress)
+}
+
+// PurgeNamespace deletes all objects referred by mds table
+func (m *mdsBinStorage) PurgeNamespace(ctx context.Context, workers int, progress func(PurgeProgress)) (PurgeProgress, error) {
+	var total PurgeProgress
+	if workers <= 0 {
+		return total, fmt.Errorf("invalid number of workers %d", workers)
+	}
+
+	var (
+		after  string
+		failed = make(map[string]error)
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		keys, objects, err := m.purgePage(ctx, after)
+		if err != nil {
+			return total, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		after = keys[len(keys)-1]
+
+		deleted, errs := m.purgeObjects(ctx, keys, objects, workers)
+		if len(deleted) != 0 {
+			_, err = m.DB(pgcluster.MASTER).Exec(m.q("UPDATE {mds} SET (deleted, purged) = (true, true) WHERE key = ANY($1::text[])"), textArray(deleted))
+			if err != nil {
+				return total, err
+			}
+		}
+
+		for key, err := range errs {
+			failed[key] = err
+		}
+		total.Deleted += int64(len(deleted))
+		total.Failed += int64(len(errs))
+		if progress != nil {
+			progress(total)
+		}
+	}
+
+	context.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"namespace": m.Namespace, "deleted": total.Deleted, "failed": total.Failed}).Info("mds namespace purged")
+	if len(failed) != 0 {
+		return total, PurgeError{Errors: failed}
+	}
+	return total, nil
+}
+
+// purgePage reads the next page of keys of mds table with MDS keys of their objects.
+// Keys are ordered, so the page starts after the last key of the previous one.
+func (m *mdsBinStorage) purgePage(ctx context.Context, after string) ([]string, []string, error) {
+	rows, err := m.DB(pgcluster.MASTER).QueryContext(ctx, m.q(`SELECT key, mdsfileinfo FROM {mds}
+		WHERE NOT purged AND key > $1 ORDER BY key LIMIT $2`), after, deletePageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var keys, objects []string
+	for rows.Next() {
+		var (
+			key  string
+			meta metaInfo
+		)
+		if err = rows.Scan(&key, &meta); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		objects = append(objects, meta.Key)
+	}
+	return keys, objects, rows.Err()
+}
+
+// purgeObjects deletes objects of keys from MDS by a pool of workers.
+// It returns deleted keys and errors of failed ones.
+func (m *mdsBinStorage) purgeObjects(ctx context.Context, keys []string, objects []string, workers int) ([]string, map[string]error) {
+	byObject := make(map[string]string, len(keys))
+	for i, key := range keys {
+		byObject[objects[i]] = key
+	}
+
+	// NOTE: the callback is called by workers concurrently
+	var (
+		mu   sync.Mutex
+		errs = make(map[string]error)
+	)
+	deleter := newKeyDeleter(ctx, mdsObjects{m}, workers, func(object string, err error) {
+		mu.Lock()
+		errs[byObject[object]] = err
+		mu.Unlock()
+	})
+
+	for _, object := range objects {
+		deleter.add(object)
+	}
+	deleter.wait()
+
+	deleted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := errs[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted, errs
+}
+
+// mdsObjects deletes objects by their MDS keys instead of keys of mds table
+type mdsObjects struct {
+	*mdsBinStorage
+}
+
+func (o mdsObjects) Delete(ctx context.Context, object string) error {
+	return o.deleteObject(ctx, object)
+}
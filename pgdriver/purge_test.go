@@ -0,0 +1,50 @@
+package pgdriver
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/mds"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MDSSuite) TestPurgeObjects(c *C) {
+	var (
+		mu      sync.Mutex
+		deletes = make(map[string]int)
+	)
+	m, ts := s.newFakeMDS(c, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		deletes[r.URL.Path]++
+		mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "bad"):
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.Contains(r.URL.Path, "gone"):
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}, map[string]interface{}{"namespace": "tenant"})
+	defer ts.Close()
+
+	keys := []string{"good1", "good2", "gone", "bad1", "good3", "bad2"}
+	objects := make([]string, len(keys))
+	for i, key := range keys {
+		objects[i] = "1/" + key
+	}
+
+	deleted, errs := m.purgeObjects(context.Background(), keys, objects, 3)
+	c.Assert(deleted, DeepEquals, []string{"good1", "good2", "gone", "good3"})
+	c.Assert(errs, HasLen, 2)
+	c.Assert(errs["bad1"], FitsTypeOf, mds.MethodError{})
+	c.Assert(errs["bad2"], FitsTypeOf, mds.MethodError{})
+
+	// each object is deleted exactly once
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(deletes, HasLen, len(keys))
+	for _, object := range objects {
+		c.Assert(deletes["/delete-tenant/"+object], Equals, 1)
+	}
+}
@@ -0,0 +1,80 @@
+package pgdriver
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// recentWrites remembers when paths have been written last time.
+// Metainformation of such paths is read from the master within the window,
+// as a replica may have not replayed the write yet.
+type recentWrites struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	paths  map[string]time.Time
+	purged time.Time
+}
+
+func newRecentWrites(window time.Duration) *recentWrites {
+	return &recentWrites{
+		window: window,
+		paths:  make(map[string]time.Time),
+		purged: time.Now(),
+	}
+}
+
+// add marks path and its parent directories as written now
+func (r *recentWrites) add(path string) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// NOTE: expired paths are dropped once per window, so the map stays small
+	if now.Sub(r.purged) > r.window {
+		for p, written := range r.paths {
+			if now.Sub(written) > r.window {
+				delete(r.paths, p)
+			}
+		}
+		r.purged = now
+	}
+
+	r.paths[path] = now
+	for _, parent := range parentDirectories(path) {
+		r.paths[parent] = now
+	}
+}
+
+// has reports whether path has been written within the window
+func (r *recentWrites) has(path string) bool {
+	r.mu.Lock()
+	written, ok := r.paths[path]
+	r.mu.Unlock()
+	return ok && time.Since(written) <= r.window
+}
+
+// wrote marks paths as written, so they are read from the master
+// within ReadYourWritesWindow
+func (d *driver) wrote(paths ...string) {
+	if d.recent == nil {
+		return
+	}
+	for _, path := range paths {
+		d.recent.add(path)
+	}
+}
+
+// readDB returns a node to read metainformation of path from. It's a replica
+// if ReadFromReplica is set and path has not been written recently.
+func (d *driver) readDB(path string) *sql.DB {
+	if d.readFromReplica && (d.recent == nil || !d.recent.has(path)) {
+		if replica, ok := d.cluster.Replica(); ok {
+			return replica
+		}
+	}
+	return d.cluster.DB(pgcluster.MASTER)
+}
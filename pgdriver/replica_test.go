@@ -0,0 +1,65 @@
+package pgdriver
+
+import (
+	"time"
+
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+	. "gopkg.in/check.v1"
+)
+
+type ReplicaSuite struct{}
+
+var _ = Suite(&ReplicaSuite{})
+
+func (s *ReplicaSuite) TestReadYourWrites(c *C) {
+	cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", []string{"master", "replica"})
+	c.Assert(err, IsNil)
+	defer cluster.Close()
+
+	master := cluster.DB(pgcluster.MASTER)
+	replica, ok := cluster.Replica()
+	c.Assert(ok, Equals, true)
+	c.Assert(replica, Not(Equals), master)
+
+	window := 100 * time.Millisecond
+	d := &driver{cluster: cluster, readFromReplica: true, recent: newRecentWrites(window)}
+	d.wrote("/a/b/c")
+
+	// a lagging replica may miss the write and its parents within the window
+	for _, path := range []string{"/a/b/c", "/a/b", "/a"} {
+		c.Assert(d.readDB(path), Equals, master, Commentf(path))
+	}
+	c.Assert(d.readDB("/x"), Equals, replica)
+
+	time.Sleep(window + 10*time.Millisecond)
+	c.Assert(d.readDB("/a/b/c"), Equals, replica)
+
+	// expired paths are dropped on the next write
+	d.wrote("/y")
+	d.recent.mu.Lock()
+	c.Assert(d.recent.paths, HasLen, 1)
+	d.recent.mu.Unlock()
+
+	d.recent = nil
+	d.wrote("/z")
+	c.Assert(d.readDB("/z"), Equals, replica)
+
+	d.readFromReplica = false
+	c.Assert(d.readDB("/x"), Equals, master)
+}
+
+func (s *ReplicaSuite) TestNoReplica(c *C) {
+	for _, nodes := range [][]string{{"master"}, {"master", "down"}, {"master", "lagging"}} {
+		cluster, err := pgcluster.NewPostgreSQLCluster("fakepg", nodes)
+		c.Assert(err, IsNil)
+		cluster.SetMaxReplicationLag(time.Minute)
+		cluster.ReElect()
+
+		_, ok := cluster.Replica()
+		c.Assert(ok, Equals, false, Commentf("%v", nodes))
+
+		d := &driver{cluster: cluster, readFromReplica: true}
+		c.Assert(d.readDB("/x"), Equals, cluster.DB(pgcluster.MASTER))
+		c.Assert(cluster.Close(), IsNil)
+	}
+}
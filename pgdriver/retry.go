@@ -0,0 +1,122 @@
+package pgdriver
+
+import (
+	sqldriver "database/sql/driver"
+	"io"
+	"net"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryDelay    = 50 * time.Millisecond
+)
+
+// defaultRetryCodes are PostgreSQL errors which are expected to disappear
+// on the next attempt
+var defaultRetryCodes = []string{
+	"40001", // serialization_failure
+	"40P01", // deadlock_detected
+	"08000", // connection_exception
+	"08003", // connection_does_not_exist
+	"08006", // connection_failure
+	"57P01", // admin_shutdown
+	"25006", // read_only_sql_transaction: a master has been demoted
+}
+
+// permanentError stops retries. It is used when a retry
+// could repeat a partial write to KV storage.
+type permanentError struct {
+	error
+}
+
+// retryPolicy retries operations failed with transient errors
+// with exponential backoff
+type retryPolicy struct {
+	attempts int
+	delay    time.Duration
+	codes    map[pq.ErrorCode]struct{}
+}
+
+func newRetryPolicy(attempts int, delay time.Duration, codes []string) *retryPolicy {
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	if len(codes) == 0 {
+		codes = defaultRetryCodes
+	}
+
+	p := &retryPolicy{
+		attempts: attempts,
+		delay:    delay,
+		codes:    make(map[pq.ErrorCode]struct{}, len(codes)),
+	}
+
+	for _, code := range codes {
+		p.codes[pq.ErrorCode(code)] = struct{}{}
+	}
+
+	return p
+}
+
+// isTransient reports whether err is worth another attempt
+func (p *retryPolicy) isTransient(err error) bool {
+	switch err := err.(type) {
+	case *pq.Error:
+		_, ok := p.codes[err.Code]
+		return ok
+	case net.Error:
+		// connection reset or refused during failover
+		return true
+	}
+
+	return err == sqldriver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// do calls fn until it succeeds, fails with non-transient error or
+// the attempts are exhausted. reelect is called between attempts
+// to pick up a new master after failover.
+func (p *retryPolicy) do(ctx context.Context, reelect func(), fn func() error) error {
+	delay := p.delay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if perr, ok := err.(permanentError); ok {
+			return perr.error
+		}
+
+		if attempt >= p.attempts || !p.isTransient(err) {
+			return err
+		}
+
+		context.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+			"attempt": attempt, "error": err.Error()}).Warn("retrying transient error")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+
+		if reelect != nil {
+			reelect()
+		}
+	}
+}
+
+// retry runs fn according to the retry policy of the driver
+func (d *driver) retry(ctx context.Context, fn func() error) error {
+	return d.retries.do(ctx, d.cluster.ReElect, fn)
+}
@@ -0,0 +1,67 @@
+package pgdriver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/lib/pq"
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) TestRetryDeadlockThenSuccess(c *C) {
+	p := newRetryPolicy(3, time.Millisecond, nil)
+
+	var calls, reelections int
+	err := p.do(context.Background(), func() { reelections++ }, func() error {
+		calls++
+		if calls == 1 {
+			return &pq.Error{Code: "40P01"}
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(calls, Equals, 2)
+	c.Assert(reelections, Equals, 1)
+}
+
+func (s *RetrySuite) TestRetryAttemptsExhausted(c *C) {
+	p := newRetryPolicy(3, time.Millisecond, nil)
+
+	var calls int
+	err := p.do(context.Background(), nil, func() error {
+		calls++
+		return &pq.Error{Code: "40001"}
+	})
+	c.Assert(err, FitsTypeOf, &pq.Error{})
+	c.Assert(calls, Equals, 3)
+}
+
+func (s *RetrySuite) TestNoRetryOnPermanentErrors(c *C) {
+	p := newRetryPolicy(3, time.Millisecond, nil)
+
+	for _, e := range []error{
+		// unique_violation
+		&pq.Error{Code: "23505"},
+		errors.New("some error"),
+		permanentError{&pq.Error{Code: "40P01"}},
+	} {
+		var calls int
+		err := p.do(context.Background(), nil, func() error {
+			calls++
+			return e
+		})
+		c.Assert(err, NotNil)
+		c.Assert(calls, Equals, 1)
+	}
+}
+
+func (s *RetrySuite) TestRetryCustomCodes(c *C) {
+	p := newRetryPolicy(2, time.Millisecond, []string{"23505"})
+	c.Assert(p.isTransient(&pq.Error{Code: "23505"}), Equals, true)
+	c.Assert(p.isTransient(&pq.Error{Code: "40P01"}), Equals, false)
+}
@@ -0,0 +1,208 @@
+package pgdriver
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+const (
+	// defaultBackend names the backend configured by type and options.
+	// It keeps objects matched by no route and objects stored before routing.
+	defaultBackend = "default"
+
+	routeMaxSizePrefix = "size<="
+	routePathPrefix    = "prefix:"
+)
+
+// routeConfig sends new objects matched by Match to Backend.
+// Match is either size<=N or prefix:/path
+type routeConfig struct {
+	Match   string
+	Backend string
+}
+
+// backendConfig configures a named KV storage used by routes
+type backendConfig struct {
+	Type    string
+	Options map[string]interface{}
+}
+
+// routeRule is a parsed routeConfig
+type routeRule struct {
+	maxSize int64
+	prefix  string
+	backend string
+}
+
+func newRouteRule(cfg routeConfig) (routeRule, error) {
+	rule := routeRule{backend: cfg.Backend}
+	switch {
+	case strings.HasPrefix(cfg.Match, routeMaxSizePrefix):
+		size, err := strconv.ParseInt(strings.TrimPrefix(cfg.Match, routeMaxSizePrefix), 10, 64)
+		if err != nil || size <= 0 {
+			return routeRule{}, fmt.Errorf("invalid size of route %q", cfg.Match)
+		}
+		rule.maxSize = size
+	case strings.HasPrefix(cfg.Match, routePathPrefix) && len(cfg.Match) > len(routePathPrefix):
+		rule.prefix = strings.TrimPrefix(cfg.Match, routePathPrefix)
+	default:
+		return routeRule{}, fmt.Errorf("unsupported match of route %q: must be %sN or %s/path", cfg.Match, routeMaxSizePrefix, routePathPrefix)
+	}
+	return rule, nil
+}
+
+// matches reports whether an object of size written to path is routed by r.
+// Objects of unknown size are never matched by size.
+func (r routeRule) matches(path string, size int64) bool {
+	if r.maxSize > 0 {
+		return size > 0 && size <= r.maxSize
+	}
+	return path != "" && strings.HasPrefix(path, r.prefix)
+}
+
+// routedStorage dispatches new objects to backends by the first matching rule.
+// Keys stored out of the default backend are recorded in {kv_routes},
+// so later calls find them whatever the rules are.
+//
+// NOTE: it does not mark objects of MDS backends deleted within transactions
+// deleting files, so they are deleted right after commit instead
+type routedStorage struct {
+	*pgcluster.Cluster
+	*sqlTables
+
+	rules    []routeRule
+	backends map[string]KVStorage
+}
+
+func newRoutedStorage(cluster *pgcluster.Cluster, tables *sqlTables, backends map[string]KVStorage, routes []routeConfig) (KVStorage, error) {
+	if _, ok := backends[defaultBackend]; !ok {
+		return nil, fmt.Errorf("no %s backend to route to", defaultBackend)
+	}
+
+	r := &routedStorage{
+		Cluster:   cluster,
+		sqlTables: tables,
+		backends:  backends,
+	}
+	for _, route := range routes {
+		rule, err := newRouteRule(route)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := backends[rule.backend]; !ok {
+			return nil, fmt.Errorf("unknown backend %q of route %q", rule.backend, route.Match)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// route returns the name of a backend for a new object
+func (r *routedStorage) route(ctx context.Context) string {
+	path, size := getContentPath(ctx), getContentSize(ctx)
+	for _, rule := range r.rules {
+		if rule.matches(path, size) {
+			return rule.backend
+		}
+	}
+	return defaultBackend
+}
+
+// lookup returns the backend keeping key
+func (r *routedStorage) lookup(ctx context.Context, key string) (KVStorage, error) {
+	var name string
+	err := r.DB(pgcluster.MASTER).QueryRowContext(ctx, r.q("SELECT backend FROM {kv_routes} WHERE key = $1"), key).Scan(&name)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		name = defaultBackend
+	default:
+		return nil, err
+	}
+
+	backend, ok := r.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("key %s is kept by unknown backend %q", key, name)
+	}
+	return backend, nil
+}
+
+func (r *routedStorage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	name := r.route(ctx)
+	// NOTE: the route is recorded first, so a stored object is never lost
+	if name != defaultBackend {
+		_, err := r.DB(pgcluster.MASTER).ExecContext(ctx, r.q(`INSERT INTO {kv_routes} (key, backend) VALUES ($1, $2)
+			ON CONFLICT (key) DO UPDATE SET backend = EXCLUDED.backend`), key, name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.backends[name].Store(ctx, key, data)
+}
+
+func (r *routedStorage) Append(ctx context.Context, key string, data io.Reader) (int64, error) {
+	backend, err := r.lookup(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return backend.Append(ctx, key, data)
+}
+
+func (r *routedStorage) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	backend, err := r.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Get(ctx, key, offset)
+}
+
+func (r *routedStorage) Delete(ctx context.Context, key string) error {
+	backend, err := r.lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err = backend.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	_, err = r.DB(pgcluster.MASTER).ExecContext(ctx, r.q("DELETE FROM {kv_routes} WHERE key = $1"), key)
+	return err
+}
+
+func (r *routedStorage) Size(ctx context.Context, key string) (int64, error) {
+	backend, err := r.lookup(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return backend.Size(ctx, key)
+}
+
+func (r *routedStorage) URLFor(ctx context.Context, key string, resolveRedirect bool) (string, error) {
+	backend, err := r.lookup(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return backend.URLFor(ctx, key, resolveRedirect)
+}
+
+// Close closes all backends
+func (r *routedStorage) Close() error {
+	var errors []error
+	for _, backend := range r.backends {
+		if err := backend.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	if len(errors) != 0 {
+		return fmt.Errorf("%v", errors)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package pgdriver
+
+import (
+	"github.com/docker/distribution/context"
+	. "gopkg.in/check.v1"
+)
+
+type RouterSuite struct{}
+
+var _ = Suite(&RouterSuite{})
+
+func (s *RouterSuite) TestRouteRules(c *C) {
+	for _, match := range []string{"", "size<=", "size<=0", "size<=-1", "size<=big", "prefix:", "path:/a"} {
+		_, err := newRouteRule(routeConfig{Match: match, Backend: "small"})
+		c.Assert(err, NotNil, Commentf(match))
+	}
+
+	small, err := newRouteRule(routeConfig{Match: "size<=1024", Backend: "small"})
+	c.Assert(err, IsNil)
+	c.Assert(small.matches("/a", 1024), Equals, true)
+	c.Assert(small.matches("/a", 1025), Equals, false)
+	// unknown size is never small
+	c.Assert(small.matches("/a", 0), Equals, false)
+
+	prefix, err := newRouteRule(routeConfig{Match: "prefix:/library/", Backend: "library"})
+	c.Assert(err, IsNil)
+	c.Assert(prefix.matches("/library/busybox", 0), Equals, true)
+	c.Assert(prefix.matches("/other/busybox", 0), Equals, false)
+	c.Assert(prefix.matches("", 0), Equals, false)
+}
+
+func (s *RouterSuite) TestRoute(c *C) {
+	backends := map[string]KVStorage{defaultBackend: nil, "small": nil, "library": nil}
+	st, err := newRoutedStorage(nil, nil, backends, []routeConfig{
+		{Match: "prefix:/library/", Backend: "library"},
+		{Match: "size<=4", Backend: "small"},
+	})
+	c.Assert(err, IsNil)
+	r := st.(*routedStorage)
+
+	route := func(path string, size int64) string {
+		return r.route(setContentSize(setContentPath(context.Background(), path), size))
+	}
+	// the first matching rule wins
+	c.Assert(route("/library/a", 4), Equals, "library")
+	c.Assert(route("/other/a", 4), Equals, "small")
+	c.Assert(route("/other/a", 5), Equals, defaultBackend)
+	c.Assert(r.route(context.Background()), Equals, defaultBackend)
+
+	_, err = newRoutedStorage(nil, nil, backends, []routeConfig{{Match: "size<=4", Backend: "missing"}})
+	c.Assert(err, NotNil)
+	_, err = newRoutedStorage(nil, nil, map[string]KVStorage{"small": nil}, nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,587 @@
+package pgdriver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/context"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	defaultS3URLTTL = 20 * time.Minute
+	// maxS3URLTTL is the longest lifetime of presigned URLs allowed by S3
+	maxS3URLTTL = 7 * 24 * time.Hour
+
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3PartSize is the minimal size of parts of multipart uploads except the last one
+	s3PartSize = 5 << 20
+)
+
+// s3Storage keeps objects in a bucket of an S3-compatible storage.
+// Requests are signed by AWS Signature Version 4 and address
+// the bucket by path, as MinIO and other implementations expect.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// urlTTL is the lifetime of URLs returned by URLFor
+	urlTTL time.Duration
+	// partSize is the size of parts buffered by multipart uploads
+	partSize int
+
+	client    *http.Client
+	transport *http.Transport
+}
+
+func newS3Storage(parameters map[string]interface{}) (KVStorage, error) {
+	var config struct {
+		Endpoint  string
+		Bucket    string
+		Region    string
+		AccessKey string
+		SecretKey string
+		URLTTL    time.Duration
+	}
+
+	config.Region = defaultS3Region
+	config.URLTTL = defaultS3URLTTL
+	if err := decodeConfig(parameters, &config); err != nil {
+		return nil, err
+	}
+
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("endpoint and bucket of s3 backend must be specified")
+	}
+
+	if config.URLTTL <= 0 || config.URLTTL > maxS3URLTTL {
+		return nil, fmt.Errorf("urlttl must be in (0, %v]: %v", maxS3URLTTL, config.URLTTL)
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint of s3 backend %q", config.Endpoint)
+	}
+
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	return &s3Storage{
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		region:    config.Region,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		urlTTL:    config.URLTTL,
+		partSize:  s3PartSize,
+		client:    &http.Client{Transport: tr},
+		transport: tr,
+	}, nil
+}
+
+// s3Error is returned for unexpected responses
+type s3Error struct {
+	Op     string
+	Key    string
+	Status int
+	Body   string
+}
+
+func (e s3Error) Error() string {
+	return fmt.Sprintf("s3 %s of %s failed with %d: %s", e.Op, e.Key, e.Status, e.Body)
+}
+
+func newS3Error(op, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return s3Error{Op: op, Key: key, Status: resp.StatusCode, Body: string(body)}
+}
+
+// objectURL returns the URL of key
+func (s *s3Storage) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.EscapedPath(), "/")
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = base + "/" + s3Escape(s.bucket, false) + "/" + s3Escape(key, false)
+	u.RawQuery = ""
+	return &u
+}
+
+// do signs and sends a request of key
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now())
+
+	return s.client.Do(req)
+}
+
+// Store puts data as an object. Content of unknown size is uploaded
+// by parts, as S3 requires the length of each request in advance.
+func (s *s3Storage) Store(ctx context.Context, key string, data io.Reader) (int64, error) {
+	if size := getContentSize(ctx); size > 0 {
+		return s.put(ctx, key, data, size)
+	}
+	return s.upload(ctx, key, "", nil, data)
+}
+
+func (s *s3Storage) put(ctx context.Context, key string, data io.Reader, size int64) (int64, error) {
+	// NOTE: an empty body must be sent explicitly, otherwise no Content-Length is set
+	if size == 0 {
+		data = http.NoBody
+	}
+
+	resp, err := s.do(ctx, "PUT", key, nil, data, size, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, newS3Error("put", key, resp)
+	}
+	return size, nil
+}
+
+// Append puts the stored object followed by data, as S3 objects are immutable.
+// An object of a part size or larger is copied by S3 as the first part of
+// a multipart upload, a smaller one is downloaded to start the first part.
+func (s *s3Storage) Append(ctx context.Context, key string, data io.Reader) (int64, error) {
+	stored, err := s.Size(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if stored >= int64(s.partSize) {
+		return s.upload(ctx, key, key, nil, data)
+	}
+
+	current, err := s.Get(ctx, key, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer current.Close()
+
+	prefix, err := ioutil.ReadAll(io.LimitReader(current, int64(s.partSize)))
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(prefix)) != stored {
+		return 0, fmt.Errorf("s3 object %s has changed while appending", key)
+	}
+	return s.upload(ctx, key, "", prefix, data)
+}
+
+// upload puts an object of the copied source, prefix and data, in that order.
+// Content fitting a part is put at once, otherwise parts are uploaded one by one,
+// so no more than a part is buffered. It returns the number of bytes read from data.
+func (s *s3Storage) upload(ctx context.Context, key, source string, prefix []byte, data io.Reader) (int64, error) {
+	part := make([]byte, s.partSize)
+	filled := copy(part, prefix)
+	n, err := io.ReadFull(data, part[filled:])
+	read, filled := int64(n), filled+n
+	eof := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !eof {
+		return 0, err
+	}
+
+	if eof && source == "" {
+		_, err = s.put(ctx, key, bytes.NewReader(part[:filled]), int64(filled))
+		return read, err
+	}
+
+	mp, err := s.initiate(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if err = mp.write(ctx, source, part[:filled], eof, data, &read); err != nil {
+		if abortErr := mp.abort(ctx); abortErr != nil {
+			context.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+				"key": key, "error": abortErr.Error()}).Warn("unable to abort s3 multipart upload")
+		}
+		return 0, err
+	}
+	return read, nil
+}
+
+// s3Upload is a multipart upload of an object
+type s3Upload struct {
+	s     *s3Storage
+	key   string
+	id    string
+	etags []string
+}
+
+func (s *s3Storage) initiate(ctx context.Context, key string) (*s3Upload, error) {
+	resp, err := s.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newS3Error("initiate upload", key, resp)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s3Upload{s: s, key: key, id: result.UploadID}, nil
+}
+
+// write copies source as the first part if it's set, uploads the buffered part
+// and the rest of data by parts, then completes the upload
+func (u *s3Upload) write(ctx context.Context, source string, part []byte, eof bool, data io.Reader, read *int64) error {
+	if source != "" {
+		if err := u.copyPart(ctx, source); err != nil {
+			return err
+		}
+	}
+
+	buff := part[:cap(part)]
+	for {
+		if len(part) != 0 {
+			if err := u.uploadPart(ctx, part); err != nil {
+				return err
+			}
+		}
+		if eof {
+			break
+		}
+
+		n, err := io.ReadFull(data, buff)
+		*read += int64(n)
+		eof = err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		part = buff[:n]
+	}
+	return u.complete(ctx)
+}
+
+func (u *s3Upload) partQuery() url.Values {
+	return url.Values{
+		"partNumber": {strconv.Itoa(len(u.etags) + 1)},
+		"uploadId":   {u.id},
+	}
+}
+
+func (u *s3Upload) uploadPart(ctx context.Context, part []byte) error {
+	resp, err := u.s.do(ctx, "PUT", u.key, u.partQuery(), bytes.NewReader(part), int64(len(part)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newS3Error("upload part", u.key, resp)
+	}
+	u.etags = append(u.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// copyPart copies the whole source object as the next part
+func (u *s3Upload) copyPart(ctx context.Context, source string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s3Escape(u.s.bucket+"/"+source, false)}}
+	resp, err := u.s.do(ctx, "PUT", u.key, u.partQuery(), nil, 0, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newS3Error("copy part", u.key, resp)
+	}
+	var result struct {
+		ETag string
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	u.etags = append(u.etags, result.ETag)
+	return nil
+}
+
+func (u *s3Upload) complete(ctx context.Context) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range u.etags {
+		request.Parts = append(request.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.s.do(ctx, "POST", u.key, url.Values{"uploadId": {u.id}}, bytes.NewReader(body), int64(len(body)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newS3Error("complete upload", u.key, resp)
+	}
+	// NOTE: S3 may report a failure of completion by an error in the body of 200 OK
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		XMLName xml.Name
+		Message string
+	}
+	if xml.Unmarshal(data, &result) == nil && result.XMLName.Local == "Error" {
+		return s3Error{Op: "complete upload", Key: u.key, Status: resp.StatusCode, Body: result.Message}
+	}
+	return nil
+}
+
+func (u *s3Upload) abort(ctx context.Context) error {
+	resp, err := u.s.do(ctx, "DELETE", u.key, url.Values{"uploadId": {u.id}}, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	default:
+		return newS3Error("abort upload", u.key, resp)
+	}
+}
+
+// Get reads an object from offset by a ranged request
+func (s *s3Storage) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+
+	resp, err := s.do(ctx, "GET", key, nil, nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		// NOTE: the range starting at the end of an object is empty,
+		// which S3 reports as unsatisfiable
+		if size, err := s.Size(ctx, key); err == nil && size == offset {
+			return ioutil.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return nil, fmt.Errorf("invalid offset")
+	default:
+		defer resp.Body.Close()
+		return nil, newS3Error("get", key, resp)
+	}
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	default:
+		return newS3Error("delete", key, resp)
+	}
+}
+
+func (s *s3Storage) Size(ctx context.Context, key string) (int64, error) {
+	resp, err := s.do(ctx, "HEAD", key, nil, nil, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, newS3Error("head", key, resp)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("s3 head of %s returned no size", key)
+	}
+	return resp.ContentLength, nil
+}
+
+// URLFor returns a presigned URL, which lives for URLTTL
+func (s *s3Storage) URLFor(ctx context.Context, key string, resolveRedirect bool) (string, error) {
+	return s.presign(s.objectURL(key), time.Now(), s.urlTTL), nil
+}
+
+// SignedURLFor returns a presigned URL, which is valid until expiry
+func (s *s3Storage) SignedURLFor(ctx context.Context, key string, expiry time.Time) (string, error) {
+	now := time.Now()
+	ttl := expiry.Sub(now)
+	if ttl <= 0 || ttl > maxS3URLTTL {
+		return "", fmt.Errorf("expiry %v must be within %v", expiry, maxS3URLTTL)
+	}
+	return s.presign(s.objectURL(key), now, ttl), nil
+}
+
+// Close closes idle connections
+func (s *s3Storage) Close() error {
+	s.transport.CloseIdleConnections()
+	return nil
+}
+
+// sign adds the authorization header of Signature Version 4 to req.
+// The payload is not signed, so bodies are streamed as is.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           now.Format(s3TimeFormat),
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		headers["range"] = r
+	}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = req.Header.Get(name)
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	signature := s.signature(now, req.Method, req.URL.EscapedPath(), s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(), signedHeaders)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, s.scope(now), signedHeaders, signature))
+}
+
+// presign signs a GET request of u by query parameters
+func (s *s3Storage) presign(u *url.URL, now time.Time, ttl time.Duration) string {
+	now = now.UTC()
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalQuery := s3CanonicalQuery(query)
+	signature := s.signature(now, "GET", u.EscapedPath(), canonicalQuery, "host:"+u.Host+"\n", "host")
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+func (s *s3Storage) scope(now time.Time) string {
+	return now.Format(s3DateFormat) + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature signs the canonical request by a key derived from the secret
+func (s *s3Storage) signature(now time.Time, method, path, query, headers, signedHeaders string) string {
+	canonicalRequest := strings.Join([]string{method, path, query, headers, signedHeaders, s3UnsignedPayload}, "\n")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), s.scope(now), hex.EncodeToString(hashed[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.secretKey), now.Format(s3DateFormat))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query sorted by names as Signature Version 4 requires
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes all bytes except unreserved ones.
+// Slashes are kept unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var buff bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			buff.WriteByte(c)
+		default:
+			fmt.Fprintf(&buff, "%%%02X", c)
+		}
+	}
+	return buff.String()
+}
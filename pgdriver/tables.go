@@ -0,0 +1,141 @@
+package pgdriver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// identifierRegexp is an allowlist for parts of table names,
+// as they are substituted into queries as is
+var identifierRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// sqlTables substitutes configured table names into queries.
+// Queries refer to tables as {mfs}, {mds}, {mfs_delete_journal}, {kv_routes},
+// {kv_blobs} and {schema_version} and to indexes as {parent_idx}, {parent_path_idx}, {key_idx}, {digest_idx},
+// {expires_idx}, {path_pattern_idx} and {delete_id_idx}.
+type sqlTables struct {
+	meta    string
+	mds     string
+	journal string
+	// history of applied migrations
+	version string
+	// backends of routed keys
+	routes string
+	// objects of the postgres backend
+	blobs string
+	// name of the index on parent column of the meta table
+	parentIndex string
+	// name of the index ordering children of a directory by path
+	parentPathIndex string
+	// names of indexes on key and digest columns of the meta table
+	keyIndex    string
+	digestIndex string
+	// name of the partial index on expires_at column of the meta table
+	expiresIndex string
+	// name of the index serving prefix matches of paths by LIKE
+	pathPatternIndex string
+	// name of the index on delete_id column of the journal
+	deleteIDIndex string
+
+	replacer *strings.Replacer
+}
+
+func validateTableName(name string) error {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid table name %q: too many dots", name)
+	}
+
+	for _, part := range parts {
+		if !identifierRegexp.MatchString(part) {
+			return fmt.Errorf("invalid table name %q: must match %s", name, identifierRegexp)
+		}
+	}
+
+	return nil
+}
+
+// qualify prefixes an unqualified table name with schema
+func qualify(schema, name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return schema + "." + name
+}
+
+// unqualified strips a schema from a table name
+func unqualified(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// newSQLTables validates table names. Unqualified names
+// are qualified by schema if it's specified.
+func newSQLTables(schema, metaTable, mdsTable string) (*sqlTables, error) {
+	if schema != "" && !identifierRegexp.MatchString(schema) {
+		return nil, fmt.Errorf("invalid schema %q: must match %s", schema, identifierRegexp)
+	}
+
+	if metaTable == "" {
+		metaTable = tableMeta
+	}
+
+	if mdsTable == "" {
+		mdsTable = tableMDS
+	}
+
+	for _, name := range []string{metaTable, mdsTable} {
+		if err := validateTableName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if schema != "" {
+		metaTable = qualify(schema, metaTable)
+		mdsTable = qualify(schema, mdsTable)
+	}
+
+	t := &sqlTables{
+		meta:        metaTable,
+		mds:         mdsTable,
+		journal:     metaTable + "_delete_journal",
+		version:     metaTable + "_schema_version",
+		routes:      metaTable + "_kv_routes",
+		blobs:       metaTable + "_kv_blobs",
+		parentIndex: "parent_idx",
+	}
+	t.parentPathIndex = unqualified(metaTable) + "_parent_path_idx"
+	t.keyIndex = unqualified(metaTable) + "_key_idx"
+	t.digestIndex = unqualified(metaTable) + "_digest_idx"
+	t.expiresIndex = unqualified(metaTable) + "_expires_idx"
+	t.pathPatternIndex = unqualified(metaTable) + "_path_pattern_idx"
+	t.deleteIDIndex = unqualified(t.journal) + "_delete_id_idx"
+
+	// NOTE: index names are unique within a schema
+	if name := unqualified(metaTable); name != tableMeta {
+		t.parentIndex = name + "_parent_idx"
+	}
+
+	t.replacer = strings.NewReplacer(
+		"{mfs_delete_journal}", t.journal,
+		"{schema_version}", t.version,
+		"{kv_routes}", t.routes,
+		"{kv_blobs}", t.blobs,
+		"{mfs}", t.meta,
+		"{mds}", t.mds,
+		"{parent_idx}", t.parentIndex,
+		"{parent_path_idx}", t.parentPathIndex,
+		"{key_idx}", t.keyIndex,
+		"{digest_idx}", t.digestIndex,
+		"{expires_idx}", t.expiresIndex,
+		"{path_pattern_idx}", t.pathPatternIndex,
+		"{delete_id_idx}", t.deleteIDIndex,
+	)
+
+	return t, nil
+}
+
+// q substitutes table names into the query
+func (t *sqlTables) q(query string) string {
+	return t.replacer.Replace(query)
+}
@@ -0,0 +1,51 @@
+package pgdriver
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TablesSuite struct{}
+
+var _ = Suite(&TablesSuite{})
+
+func (s *TablesSuite) TestDefaults(c *C) {
+	tables, err := newSQLTables("", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(tables.q("SELECT 1 FROM {mfs} JOIN {mds} USING (key)"), Equals, "SELECT 1 FROM mfs JOIN mds USING (key)")
+	c.Assert(tables.q("INSERT INTO {mfs_delete_journal}"), Equals, "INSERT INTO mfs_delete_journal")
+	c.Assert(tables.q("{parent_idx}"), Equals, "parent_idx")
+	c.Assert(tables.q("{schema_version}"), Equals, "mfs_schema_version")
+	c.Assert(tables.q("{kv_routes}"), Equals, "mfs_kv_routes")
+	c.Assert(tables.q("{kv_blobs}"), Equals, "mfs_kv_blobs")
+}
+
+func (s *TablesSuite) TestCustomNames(c *C) {
+	tables, err := newSQLTables("", "registry.files", "registry.blobs")
+	c.Assert(err, IsNil)
+	c.Assert(tables.q("SELECT {mfs}.path FROM {mfs}, {mds}"), Equals, "SELECT registry.files.path FROM registry.files, registry.blobs")
+	c.Assert(tables.q("{mfs_delete_journal}"), Equals, "registry.files_delete_journal")
+	c.Assert(tables.q("{parent_idx}"), Equals, "files_parent_idx")
+	c.Assert(tables.q("{key_idx} {digest_idx}"), Equals, "files_key_idx files_digest_idx")
+	c.Assert(tables.q("{parent_path_idx}"), Equals, "files_parent_path_idx")
+	c.Assert(tables.q("{expires_idx}"), Equals, "files_expires_idx")
+	c.Assert(tables.q("{path_pattern_idx}"), Equals, "files_path_pattern_idx")
+}
+
+func (s *TablesSuite) TestInvalidNames(c *C) {
+	for _, name := range []string{"mfs; DROP TABLE mds", "a.b.c", "Mfs", "1mfs", "mfs\"", "."} {
+		_, err := newSQLTables("", name, "")
+		c.Assert(err, NotNil, Commentf("%s", name))
+
+		_, err = newSQLTables("", "", name)
+		c.Assert(err, NotNil, Commentf("%s", name))
+	}
+}
+
+func (s *TablesSuite) TestSchema(c *C) {
+	tables, err := newSQLTables("tenant", "", "other.blobs")
+	c.Assert(err, IsNil)
+	c.Assert(tables.q("{mfs} {mds} {mfs_delete_journal} {parent_idx}"), Equals, "tenant.mfs other.blobs tenant.mfs_delete_journal parent_idx")
+
+	_, err = newSQLTables("tenant; DROP", "", "")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,158 @@
+package pgdriver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/noxiouz/go-postgresql-cluster/pgcluster"
+)
+
+// ErrUnknownDigest is returned by VerifyContent in dedup mode for files
+// without a digest, which are being appended to or stored before digests
+// were introduced
+var ErrUnknownDigest = errors.New("digest of the content is unknown")
+
+// ContentMismatchError is returned if content read from KV storage
+// does not match the digest computed on write
+type ContentMismatchError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e ContentMismatchError) Error() string {
+	return fmt.Sprintf("content of %s is corrupted: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// VerifyContent re-reads the content of the file stored at path
+// and compares its digest with the one computed on write.
+// A digest left unknown by append is computed and recorded.
+func (d *Driver) VerifyContent(ctx context.Context, path string) error {
+	return d.drv.VerifyContent(ctx, path)
+}
+
+func (d *driver) VerifyContent(ctx context.Context, path string) error {
+	digest, err := d.getDigest(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !digest.Valid {
+		// NOTE: files being appended to must not be linked to in dedup mode
+		if d.dedup {
+			return ErrUnknownDigest
+		}
+		return d.recordDigest(ctx, path)
+	}
+
+	reader, err := d.readAll(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, newVerifyingReader(reader, path, digest.String))
+	return err
+}
+
+// recordDigest computes the digest of a file, which has none
+func (d *driver) recordDigest(ctx context.Context, path string) error {
+	reader, err := d.readAll(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, reader)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: the file may be appended to meanwhile, then the size differs
+	_, err = d.cluster.DB(pgcluster.MASTER).ExecContext(ctx, d.q("UPDATE {mfs} SET digest = $2 WHERE path = $1 AND digest IS NULL AND size = $3"),
+		path, contentDigest(hasher), size)
+	return err
+}
+
+// getDigest returns the digest of a file. It's NULL if it's unknown.
+func (d *driver) getDigest(ctx context.Context, path string) (sql.NullString, error) {
+	var (
+		isDir  bool
+		digest sql.NullString
+	)
+
+	err := d.cluster.DB(pgcluster.MASTER).QueryRowContext(ctx, d.q("SELECT dir, digest FROM {mfs} WHERE path = $1"), path).Scan(&isDir, &digest)
+	switch {
+	case err == sql.ErrNoRows, err == nil && isDir:
+		return digest, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	case err != nil:
+		return digest, err
+	}
+
+	return digest, nil
+}
+
+// readAll reads the whole content of a file either from KV storage or from mfs
+func (d *driver) readAll(ctx context.Context, path string) (io.ReadCloser, error) {
+	reader, err := d.read(ctx, path, 0)
+	if err != errNoKVObject {
+		return reader, err
+	}
+
+	content, err := d.getInline(ctx, path, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// verifyRead wraps a reader of the whole content of a file, so the content is
+// verified at the end of reading. Files of unknown digests are not verified.
+func (d *driver) verifyRead(ctx context.Context, path string, reader io.ReadCloser) (io.ReadCloser, error) {
+	digest, err := d.getDigest(ctx, path)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if !digest.Valid {
+		return reader, nil
+	}
+	return newVerifyingReader(reader, path, digest.String), nil
+}
+
+// verifyingReader hashes content as it's read. ContentMismatchError
+// is returned instead of io.EOF if the content does not match the digest.
+type verifyingReader struct {
+	io.ReadCloser
+	path     string
+	expected string
+	hasher   hash.Hash
+}
+
+func newVerifyingReader(reader io.ReadCloser, path, expected string) *verifyingReader {
+	return &verifyingReader{
+		ReadCloser: reader,
+		path:       path,
+		expected:   expected,
+		hasher:     sha256.New(),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF {
+		if actual := contentDigest(r.hasher); actual != r.expected {
+			return n, ContentMismatchError{Path: r.path, Expected: r.expected, Actual: actual}
+		}
+	}
+	return n, err
+}
@@ -1,5 +1,7 @@
 CREATE TABLE mds (
     KEY 	TEXT PRIMARY KEY,
     MDSFILEINFO TEXT NOT NULL,
-    DELETED BOOLEAN NOT NULL DEFAULT FALSE
+    DELETED BOOLEAN NOT NULL DEFAULT FALSE,
+    -- set once the object is gone from MDS
+    PURGED  BOOLEAN NOT NULL DEFAULT FALSE
 );
@@ -3,8 +3,41 @@ CREATE TABLE mfs (
             PARENT	TEXT NOT NULL,
             DIR		BOOLEAN NOT NULL,
             SIZE 	BIGINT NOT NULL,
-            MODTIME TIME NOT NULL,
+            MODTIME TIMESTAMPTZ NOT NULL,
             KEY     TEXT,
-            OWNER   TEXT
+            OWNER   TEXT,
+            INLINE  BYTEA,
+            -- sha256 of content
+            DIGEST  TEXT,
+            -- temporary files are deleted by ExpireSweep after that
+            EXPIRES_AT TIMESTAMPTZ
 );
 CREATE INDEX parent_idx ON mfs (parent);
+CREATE INDEX mfs_parent_path_idx ON mfs (parent, path);
+CREATE INDEX mfs_key_idx ON mfs (key);
+CREATE INDEX mfs_digest_idx ON mfs (digest);
+CREATE INDEX mfs_expires_idx ON mfs (expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX mfs_path_pattern_idx ON mfs (path text_pattern_ops);
+CREATE TABLE mfs_delete_journal (
+            KEY       TEXT NOT NULL,
+            FAILED_AT TIMESTAMP NOT NULL DEFAULT now(),
+            -- set for keys pending deletion after commit of Delete
+            DELETE_ID TEXT
+);
+CREATE INDEX mfs_delete_journal_delete_id_idx ON mfs_delete_journal (delete_id);
+-- backends of keys stored by routes
+CREATE TABLE mfs_kv_routes (
+            KEY     TEXT PRIMARY KEY,
+            BACKEND TEXT NOT NULL
+);
+-- objects of the postgres backend
+CREATE TABLE mfs_kv_blobs (
+            KEY  TEXT PRIMARY KEY,
+            DATA BYTEA NOT NULL
+);
+CREATE TABLE mfs_schema_version (
+            VERSION    INTEGER PRIMARY KEY,
+            APPLIED_AT TIMESTAMP NOT NULL DEFAULT now()
+);
+-- versions of migrations included above
+INSERT INTO mfs_schema_version (version) VALUES (1), (2), (3), (4), (5), (6), (7);